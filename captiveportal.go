@@ -0,0 +1,106 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// well known URL which returns 204 without content if there is no captive portal
+const CAPTIVEPORTAL_DEFAULT_URL = "http://connectivitycheck.gstatic.com/generate_204"
+
+// interval of captive portal checks while portal blocks network, check blocks for up to its timeout
+const CAPTIVEPORTAL_CHECKINTERVAL = 15 * time.Second
+
+// captive portal state is read by rpc handlers
+var servicecheckCaptivePortalLock sync.Mutex
+var servicecheckCaptivePortal bool = false
+var servicecheckCaptivePortalURL string = ""
+
+// next check of detected captive portal, used only by pinger
+var servicecheckCaptivePortalNextCheck time.Time
+
+func ServiceCheckGetCaptivePortal() (bool, string) {
+	servicecheckCaptivePortalLock.Lock()
+	defer servicecheckCaptivePortalLock.Unlock()
+	return servicecheckCaptivePortal, servicecheckCaptivePortalURL
+}
+
+func servicecheckCaptivePortalSet(detected bool, portal string) {
+	servicecheckCaptivePortalLock.Lock()
+	defer servicecheckCaptivePortalLock.Unlock()
+	servicecheckCaptivePortal = detected
+	servicecheckCaptivePortalURL = portal
+}
+
+// CaptivePortalSafeURL returns sign-in URL which can be opened in browser, location comes from untrusted
+// network so only absolute http and https URLs are allowed, relative location is resolved against base,
+// default URL is returned otherwise
+func CaptivePortalSafeURL(location string, base string) string {
+	u, err := url.Parse(location)
+	if err == nil && base != "" {
+		if b, berr := url.Parse(base); berr == nil {
+			u = b.ResolveReference(u)
+		}
+	}
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.User != nil {
+		return CAPTIVEPORTAL_DEFAULT_URL
+	}
+	return u.String()
+}
+
+// CaptivePortalDetect requests known-content URL without following redirects;
+// redirect or unexpected content means captive portal, error means that network is not available at all.
+// If expected content is empty, 204 No Content response is expected.
+func CaptivePortalDetect(checkURL string, expected string) (detected bool, portal string, err error) {
+	client := http.Client{
+		Timeout: 5 * time.Second,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Get(checkURL)
+	if err != nil {
+		return false, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 && resp.StatusCode < 400 {
+		return true, CaptivePortalSafeURL(resp.Header.Get("Location"), checkURL), nil
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		return false, "", err
+	}
+	if expected == "" {
+		if resp.StatusCode == http.StatusNoContent && len(body) == 0 {
+			return false, "", nil
+		}
+	} else if resp.StatusCode == http.StatusOK && strings.Contains(string(body), expected) {
+		return false, "", nil
+	}
+	// portal answered by itself, user has to open any page to get sign-in form
+	return true, checkURL, nil
+}
+
+// servicecheckTestCaptivePortal updates captive portal state, returns true if captive portal blocks network
+func servicecheckTestCaptivePortal() bool {
+	detected, portal, err := CaptivePortalDetect(myconfig.CaptivePortalURL, myconfig.CaptivePortalContent)
+	if err != nil {
+		log.Debug("servicecheck - captive portal check error: ", err)
+	}
+	active, _ := ServiceCheckGetCaptivePortal()
+	if detected && !active {
+		log.Info("servicecheck - captive portal detected: ", portal)
+		servicecheckCaptivePortalSet(true, portal)
+		servicecheckCaptivePortalNextCheck = time.Now().Add(CAPTIVEPORTAL_CHECKINTERVAL)
+		connstateTransition(CONNSTATE_CAPTIVEPORTAL, "captive portal detected: "+portal)
+	} else if !detected && active {
+		log.Info("servicecheck - captive portal cleared")
+		servicecheckCaptivePortalSet(false, "")
+		connstateTransition(CONNSTATE_DEGRADED, "captive portal cleared")
+	}
+	return detected
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCaptivePortalDetect(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/generate_204":
+			w.WriteHeader(http.StatusNoContent)
+		case "/redirect":
+			http.Redirect(w, r, "http://portal.example.com/login", http.StatusFound)
+		case "/relative":
+			w.Header().Set("Location", "/login")
+			w.WriteHeader(http.StatusFound)
+		case "/script":
+			w.Header().Set("Location", "javascript:alert(1)")
+			w.WriteHeader(http.StatusFound)
+		case "/file":
+			w.Header().Set("Location", "file:///etc/passwd")
+			w.WriteHeader(http.StatusFound)
+		case "/success.txt":
+			w.Write([]byte("success\n"))
+		default:
+			w.Write([]byte("<html><body>please sign in</body></html>"))
+		}
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		path     string
+		expected string
+		detected bool
+		portal   string
+	}{
+		{"/generate_204", "", false, ""},
+		{"/redirect", "", true, "http://portal.example.com/login"},
+		{"/relative", "", true, srv.URL + "/login"},
+		{"/script", "", true, CAPTIVEPORTAL_DEFAULT_URL},
+		{"/file", "", true, CAPTIVEPORTAL_DEFAULT_URL},
+		{"/login", "", true, srv.URL + "/login"},
+		{"/success.txt", "success", false, ""},
+		{"/login", "success", true, srv.URL + "/login"},
+	}
+	for _, tt := range tests {
+		detected, portal, err := CaptivePortalDetect(srv.URL+tt.path, tt.expected)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.path, err)
+		}
+		if detected != tt.detected || portal != tt.portal {
+			t.Errorf("%s (%q): got %v %q, expected %v %q", tt.path, tt.expected, detected, portal, tt.detected, tt.portal)
+		}
+	}
+
+	// unreachable network is not captive portal
+	srv.Close()
+	if detected, _, err := CaptivePortalDetect(srv.URL+"/generate_204", ""); detected || err == nil {
+		t.Errorf("closed server: got detected %v, err %v", detected, err)
+	}
+}
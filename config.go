@@ -34,6 +34,8 @@ func WSTunnelCredentials() (usr string, pwd string, wss string) {
 		pwd = cred[1]
 	}
 	wss = strings.TrimSpace(localconf.ConfigData.WebSocketUrl)
+	LogRedactRegister(pwd)
+	LogRedactRegister(base64.StdEncoding.EncodeToString([]byte(localconf.ConfigData.WebSocketUsernamePassword)))
 	return
 }
 
@@ -117,6 +119,13 @@ func InitConfig(isDesktop bool) {
 	if myconfig.AutoUpdateChannel != "latest" && myconfig.AutoUpdateChannel != "beta" {
 		myconfig.AutoUpdateChannel = "latest"
 	}
+	if myconfig.CaptivePortalURL == "" {
+		myconfig.CaptivePortalURL = CAPTIVEPORTAL_DEFAULT_URL
+		myconfig.CaptivePortalContent = ""
+	}
+	if len(NetprobeCreate(myconfig.ConnectivityProbe, myconfig.ConnectivityProbeURL)) == 0 {
+		myconfig.ConnectivityProbe = NETPROBE_DEFAULT
+	}
 }
 
 func removeLocalConf() {
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ConnState is lifecycle state of agent connection
+type ConnState int
+
+const (
+	CONNSTATE_STOPPED ConnState = iota
+	CONNSTATE_CONFIGURING
+	CONNSTATE_CONNECTING
+	CONNSTATE_CONNECTED
+	CONNSTATE_RESTRICTED
+	CONNSTATE_DEGRADED
+	CONNSTATE_STOPPING
+	CONNSTATE_CAPTIVEPORTAL
+)
+
+// max number of events kept in history
+const CONNSTATE_MAXHISTORY int = 200
+
+var connstateNames = map[ConnState]string{
+	CONNSTATE_STOPPED:       "stopped",
+	CONNSTATE_CONFIGURING:   "configuring",
+	CONNSTATE_CONNECTING:    "connecting",
+	CONNSTATE_CONNECTED:     "connected",
+	CONNSTATE_RESTRICTED:    "restricted",
+	CONNSTATE_DEGRADED:      "degraded",
+	CONNSTATE_STOPPING:      "stopping",
+	CONNSTATE_CAPTIVEPORTAL: "captiveportal",
+}
+
+func (s ConnState) String() string {
+	if n, ok := connstateNames[s]; ok {
+		return n
+	}
+	return fmt.Sprintf("unknown(%d)", int(s))
+}
+
+// allowed transitions, stopping is allowed from every running state
+var connstateTransitions = map[ConnState][]ConnState{
+	CONNSTATE_STOPPED:     {CONNSTATE_CONFIGURING},
+	CONNSTATE_CONFIGURING: {CONNSTATE_CONNECTING, CONNSTATE_STOPPING},
+	CONNSTATE_CONNECTING:  {CONNSTATE_CONNECTED, CONNSTATE_RESTRICTED, CONNSTATE_DEGRADED, CONNSTATE_CAPTIVEPORTAL, CONNSTATE_CONFIGURING, CONNSTATE_STOPPING},
+	CONNSTATE_CONNECTED:   {CONNSTATE_RESTRICTED, CONNSTATE_DEGRADED, CONNSTATE_CAPTIVEPORTAL, CONNSTATE_CONFIGURING, CONNSTATE_STOPPING},
+	CONNSTATE_RESTRICTED:  {CONNSTATE_CONNECTED, CONNSTATE_DEGRADED, CONNSTATE_CAPTIVEPORTAL, CONNSTATE_CONFIGURING, CONNSTATE_STOPPING},
+	CONNSTATE_DEGRADED:    {CONNSTATE_CONNECTED, CONNSTATE_RESTRICTED, CONNSTATE_CAPTIVEPORTAL, CONNSTATE_CONFIGURING, CONNSTATE_STOPPING},
+	CONNSTATE_STOPPING:    {CONNSTATE_STOPPED},
+	// mode switching is on hold until captive portal is cleared
+	CONNSTATE_CAPTIVEPORTAL: {CONNSTATE_CONNECTED, CONNSTATE_RESTRICTED, CONNSTATE_DEGRADED, CONNSTATE_CONFIGURING, CONNSTATE_STOPPING},
+}
+
+// ConnStateEvent is record in state history, events without state change have From equal to To
+type ConnStateEvent struct {
+	Seq       uint64    `json:"seq"`
+	Timestamp time.Time `json:"timestamp"`
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	Reason    string    `json:"reason"`
+}
+
+// ConnStateMachine holds current state and bounded history of events
+type ConnStateMachine struct {
+	lock    sync.Mutex
+	state   ConnState
+	since   time.Time
+	history []ConnStateEvent
+	seq     uint64
+	acked   uint64
+	max     int
+}
+
+func NewConnStateMachine(maxHistory int) *ConnStateMachine {
+	return &ConnStateMachine{
+		state: CONNSTATE_STOPPED,
+		since: time.Now().UTC(),
+		max:   maxHistory,
+	}
+}
+
+func connstateAllowed(from ConnState, to ConnState) bool {
+	for _, s := range connstateTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *ConnStateMachine) record(from ConnState, to ConnState, reason string) {
+	m.seq++
+	m.history = append(m.history, ConnStateEvent{
+		Seq:       m.seq,
+		Timestamp: time.Now().UTC(),
+		From:      from.String(),
+		To:        to.String(),
+		Reason:    reason,
+	})
+	if len(m.history) > m.max {
+		m.history = m.history[len(m.history)-m.max:]
+	}
+}
+
+// Transition changes state, transition to current state is ignored and invalid transition returns error
+func (m *ConnStateMachine) Transition(to ConnState, reason string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.state == to {
+		return nil
+	}
+	if !connstateAllowed(m.state, to) {
+		return fmt.Errorf("invalid state transition %v -> %v (%s)", m.state, to, reason)
+	}
+	m.record(m.state, to, reason)
+	m.state = to
+	m.since = time.Now().UTC()
+	return nil
+}
+
+// Event records event without state change
+func (m *ConnStateMachine) Event(reason string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.record(m.state, m.state, reason)
+}
+
+func (m *ConnStateMachine) State() (ConnState, time.Time) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.state, m.since
+}
+
+func (m *ConnStateMachine) Is(states ...ConnState) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, s := range states {
+		if m.state == s {
+			return true
+		}
+	}
+	return false
+}
+
+// History returns copy of events
+func (m *ConnStateMachine) History() []ConnStateEvent {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return append([]ConnStateEvent{}, m.history...)
+}
+
+// Unsent returns events which were not acknowledged by Ack yet
+func (m *ConnStateMachine) Unsent() []ConnStateEvent {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	var ret []ConnStateEvent
+	for _, e := range m.history {
+		if e.Seq > m.acked {
+			ret = append(ret, e)
+		}
+	}
+	return ret
+}
+
+// Ack marks events up to seq as delivered
+func (m *ConnStateMachine) Ack(seq uint64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if seq > m.acked {
+		m.acked = seq
+	}
+}
+
+// global agent connection state
+var connstate = NewConnStateMachine(CONNSTATE_MAXHISTORY)
+
+// connstateTransition changes global state and logs it
+func connstateTransition(to ConnState, reason string) {
+	if err := connstate.Transition(to, reason); err != nil {
+		log.Debug("connstate - ", err)
+		return
+	}
+	log.Debug("connstate - ", to, ": ", reason)
+}
+
+// connstateUpdateConnectivity changes global state based on result of connectivity probe
+func connstateUpdateConnectivity(connected bool, restricted bool) {
+	if !connstate.Is(CONNSTATE_CONNECTING, CONNSTATE_CONNECTED, CONNSTATE_RESTRICTED, CONNSTATE_DEGRADED, CONNSTATE_CAPTIVEPORTAL) {
+		return
+	}
+	switch {
+	case connected && restricted:
+		connstateTransition(CONNSTATE_RESTRICTED, "lighthouse reachable over websocket tunnel")
+	case connected:
+		connstateTransition(CONNSTATE_CONNECTED, "lighthouse reachable")
+	case connstate.Is(CONNSTATE_CONNECTED, CONNSTATE_RESTRICTED):
+		connstateTransition(CONNSTATE_DEGRADED, "lighthouse unreachable")
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestConnStateTransitions(t *testing.T) {
+	m := NewConnStateMachine(10)
+	steps := []struct {
+		to    ConnState
+		valid bool
+	}{
+		{CONNSTATE_CONNECTED, false},
+		{CONNSTATE_CONFIGURING, true},
+		{CONNSTATE_CONNECTING, true},
+		{CONNSTATE_CONNECTED, true},
+		{CONNSTATE_CONNECTED, true},
+		{CONNSTATE_DEGRADED, true},
+		{CONNSTATE_STOPPED, false},
+		{CONNSTATE_RESTRICTED, true},
+		{CONNSTATE_STOPPING, true},
+		{CONNSTATE_CONNECTED, false},
+		{CONNSTATE_STOPPED, true},
+	}
+	for i, s := range steps {
+		err := m.Transition(s.to, "test")
+		if s.valid && err != nil {
+			t.Errorf("step %d: unexpected error: %v", i, err)
+		}
+		if !s.valid && err == nil {
+			t.Errorf("step %d: transition to %v has to fail", i, s.to)
+		}
+	}
+	if st, _ := m.State(); st != CONNSTATE_STOPPED {
+		t.Errorf("expected stopped state, got %v", st)
+	}
+	// repeated transition to the same state is not recorded
+	if h := m.History(); len(h) != 7 {
+		t.Errorf("expected 7 events, got %d: %+v", len(h), h)
+	}
+}
+
+func TestConnStateHistory(t *testing.T) {
+	m := NewConnStateMachine(3)
+	m.Transition(CONNSTATE_CONFIGURING, "start")
+	m.Event("e1")
+	m.Event("e2")
+	m.Event("e3")
+	h := m.History()
+	if len(h) != 3 {
+		t.Fatalf("history has to be bounded to 3 events, got %d", len(h))
+	}
+	if h[0].Reason != "e1" || h[2].Reason != "e3" {
+		t.Errorf("oldest events have to be dropped: %+v", h)
+	}
+	if h[0].From != "configuring" || h[0].To != "configuring" {
+		t.Errorf("event without transition has to keep state: %+v", h[0])
+	}
+
+	unsent := m.Unsent()
+	if len(unsent) != 3 {
+		t.Fatalf("expected 3 unsent events, got %d", len(unsent))
+	}
+	m.Ack(unsent[1].Seq)
+	if u := m.Unsent(); len(u) != 1 || u[0].Reason != "e3" {
+		t.Errorf("expected only e3 unsent after ack, got %+v", u)
+	}
+}
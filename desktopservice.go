@@ -5,6 +5,7 @@ import (
 	"net"
 	"os"
 	"strings"
+	"time"
 
 	rpc "github.com/shieldoo/shieldoo-mesh/rpc"
 )
@@ -31,7 +32,7 @@ func deskserviceProcessor(client net.Conn) {
 			log.Error("deskservice - error deserializing message", err)
 			return
 		}
-		if svcconnIsRunning {
+		if svcconnIsRunning.Load() {
 			resp.Status = "ERROR - service already running"
 		} else {
 			myconfig.AccessId = j.AccessId
@@ -39,6 +40,7 @@ func deskserviceProcessor(client net.Conn) {
 			myconfig.Secret = j.Secret
 			myconfig.RPCClientID = j.ClientID
 			myconfig.LighthouseRoute = j.LighthouseRoute
+			myconfig.KillSwitch = j.KillSwitch
 			if j.HeartbeatInterval >= 5 && j.HeartbeatInterval <= 300 {
 				myconfig.SendInterval = j.HeartbeatInterval
 			} else {
@@ -46,7 +48,7 @@ func deskserviceProcessor(client net.Conn) {
 			}
 			ServiceCheckPingerStop()
 			removeLocalConf()
-			myconfig.RestrictedNetwork = false
+			svcRestrictedNetwork.Store(false)
 			go SvcConnectionStart(deskserviceEnableWinLog)
 			go ServiceCheckPinger()
 		}
@@ -54,29 +56,176 @@ func deskserviceProcessor(client net.Conn) {
 		ServiceCheckPingerStop()
 		SvcConnectionStop()
 		removeLocalConf()
-		myconfig.RestrictedNetwork = false
-		gtelLogin = OAuthLoginResponse{}
+		svcRestrictedNetwork.Store(false)
+		telemetryLoginReset()
 	case rpc.RPCCOMMANDSTATUS:
+	case rpc.RPCCOMMANDHISTORY:
+		for _, e := range connstate.History() {
+			resp.History = append(resp.History, rpc.RpcStateEvent{
+				Timestamp: e.Timestamp,
+				From:      e.From,
+				To:        e.To,
+				Reason:    e.Reason,
+			})
+		}
+	case rpc.RPCCOMMANDPEERS:
+		// RTT of active peers is measured on schedule and refreshed on request, result is returned by next request
+		PeerstatsProbeRequest()
+		resp.Peers = deskservicePeers()
 	default:
 		resp.Status = "ERROR - unknown command"
 	}
 
 	// grab status information
-	resp.IsRunning = svcconnIsRunning
+	resp.IsRunning = svcconnIsRunning.Load()
 	resp.IsConnected = ServiceCheckGetPingerSuccess()
 	resp.AccessId = myconfig.AccessId
 	resp.Uri = myconfig.Uri
-	resp.RestrictedNetwork = myconfig.RestrictedNetwork
-	resp.TunnelExists = ServicecheckExistingTunnels
+	resp.RestrictedNetwork = svcRestrictedNetwork.Load()
+	resp.TunnelExists = ServicecheckExistingTunnels.Load()
 	resp.LighthouseRoute = myconfig.LighthouseRoute
+	resp.KillSwitch = SvcKillSwitchIsActive()
+	resp.CaptivePortal, resp.CaptivePortalURL = ServiceCheckGetCaptivePortal()
+	state, since := connstate.State()
+	resp.State = state.String()
+	resp.StateSince = since
 	resp.Lighthouse = strings.Split(lighthousePublicIpPort, ":")[0]
+	resp.WSTunnel = deskserviceTunnelStats()
+	resp.Listeners = deskserviceListenerStats()
+	deskserviceFitResponse(&resp)
 	// send response to client
 	errs := rpc.RpcSendMessage(client, &resp)
-	if err != nil {
+	if errs != nil {
 		log.Error("deskservice - send error: ", errs)
 	}
 }
 
+// deskserviceFitResponse shortens response until it fits into rpc message, histories of peers are dropped
+// first, then older state events, peers and listeners, every step removes data so loop ends
+func deskserviceFitResponse(resp *rpc.RpcCommandResponse) {
+	for rpc.RpcMessageSize(resp) > rpc.RPC_MAXMESSAGESIZE {
+		resp.Truncated = true
+		withHistory := 0
+		for _, p := range resp.Peers {
+			if len(p.History) > 0 {
+				withHistory++
+			}
+		}
+		switch {
+		case withHistory > 0:
+			// histories of later half of peers are dropped
+			keep := withHistory / 2
+			for i := range resp.Peers {
+				if len(resp.Peers[i].History) > 0 {
+					if keep > 0 {
+						keep--
+					} else {
+						resp.Peers[i].History = nil
+					}
+				}
+			}
+		case len(resp.History) > 0:
+			resp.History = resp.History[len(resp.History)/2+len(resp.History)%2:]
+		case len(resp.Peers) > 0:
+			resp.Peers = resp.Peers[:len(resp.Peers)/2]
+		case len(resp.Listeners) > 0:
+			resp.Listeners = resp.Listeners[:len(resp.Listeners)/2]
+		default:
+			// captive portal URL comes from untrusted network
+			resp.CaptivePortalURL = ""
+			log.Error("deskservice - response does not fit into rpc message")
+			return
+		}
+	}
+}
+
+func deskserviceTunnelStats() *rpc.RpcTunnelStats {
+	st := svcWsTunnel.Stats()
+	if !st.IsRunning {
+		return nil
+	}
+	ret := &rpc.RpcTunnelStats{
+		RTTMs:       float64(st.RTT.Microseconds()) / 1000,
+		Reconnects:  st.Reconnects,
+		BytesIn:     st.BytesIn,
+		BytesOut:    st.BytesOut,
+		LastError:   st.LastError,
+		LastErrorAt: st.LastErrorAt,
+		Peers:       []rpc.RpcTunnelPeer{},
+	}
+	for _, p := range st.Peers {
+		ret.Peers = append(ret.Peers, rpc.RpcTunnelPeer{
+			LocalAddr: p.LocalAddr,
+			Connected: p.Connected,
+			Framed:    p.Framed,
+			Transport: p.Transport,
+			RTTMs:     float64(p.RTT.Microseconds()) / 1000,
+		})
+	}
+	return ret
+}
+
+func deskserviceListenerStats() []rpc.RpcListenerStats {
+	var ret []rpc.RpcListenerStats
+	for _, w := range svcWorkersStats() {
+		r := rpc.RpcListenerStats{
+			Listen:         w.Listen,
+			Protocol:       w.Protocol,
+			Sessions:       w.Metrics.Sessions,
+			Active:         w.Metrics.Active,
+			Rejected:       w.Metrics.Rejected,
+			RejectedLimit:  w.Limits.RejectedConnections + w.Limits.RejectedRate,
+			DroppedPackets: w.Limits.DroppedPackets,
+			ThrottledMs:    float64(w.Limits.ThrottledNanos) / float64(time.Millisecond),
+			BytesIn:        w.Metrics.BytesIn,
+			BytesOut:       w.Metrics.BytesOut,
+			DialErrors:     w.Metrics.DialErrors,
+			Backends:       []rpc.RpcListenerBackend{},
+		}
+		for _, b := range w.Metrics.Backends {
+			r.Backends = append(r.Backends, rpc.RpcListenerBackend{
+				Address:      b.Address,
+				Dials:        b.Dials,
+				DialErrors:   b.DialErrors,
+				AvgLatencyMs: float64(b.AvgLatency.Microseconds()) / 1000,
+				MaxLatencyMs: float64(b.MaxLatency.Microseconds()) / 1000,
+			})
+		}
+		ret = append(ret, r)
+	}
+	return ret
+}
+
+func deskservicePeers() []rpc.RpcPeerInfo {
+	list := PeerstatsList(true)
+	ret := []rpc.RpcPeerInfo{}
+	for _, p := range list {
+		r := rpc.RpcPeerInfo{
+			VpnIP:           p.VpnIP,
+			Name:            p.Name,
+			RemoteAddr:      p.RemoteAddr,
+			Relayed:         p.Relayed,
+			Relays:          p.Relays,
+			HandshakeSeenAt: p.HandshakeSeenAt,
+			MessageCounter:  p.MessageCounter,
+			RTTMs:           p.RTTMs,
+			PacketLoss:      p.PacketLoss,
+		}
+		// response is shortened by deskserviceFitResponse if it is too large
+		for _, s := range p.History {
+			r.History = append(r.History, rpc.RpcPeerSample{
+				Timestamp:      s.Timestamp,
+				RTTMs:          s.RTTMs,
+				PacketLoss:     s.PacketLoss,
+				MessageCounter: s.MessageCounter,
+				Relayed:        s.Relayed,
+			})
+		}
+		ret = append(ret, r)
+	}
+	return ret
+}
+
 var deskserviceEnableWinLog bool
 
 func DeskserviceStart(enableWinLog bool) {
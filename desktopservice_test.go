@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shieldoo/shieldoo-mesh/rpc"
+)
+
+func TestDeskserviceFitResponse(t *testing.T) {
+	resp := rpc.RpcCommandResponse{Status: "OK", CaptivePortalURL: "http://portal.example.com/login"}
+	for i := 0; i < CONNSTATE_MAXHISTORY; i++ {
+		resp.History = append(resp.History, rpc.RpcStateEvent{Timestamp: time.Now(), From: "connected", To: "degraded", Reason: fmt.Sprintf("event %d", i)})
+	}
+	for i := 0; i < 150; i++ {
+		p := rpc.RpcPeerInfo{VpnIP: fmt.Sprintf("100.64.%d.%d", i/250, i%250), Name: fmt.Sprintf("peer-%d.example.com", i), Relays: []string{"100.64.0.1"}}
+		for j := 0; j < PEERSTATS_MAXSAMPLES; j++ {
+			p.History = append(p.History, rpc.RpcPeerSample{Timestamp: time.Now(), RTTMs: 12.5, MessageCounter: uint64(j)})
+		}
+		resp.Peers = append(resp.Peers, p)
+	}
+	for i := 0; i < 50; i++ {
+		resp.Listeners = append(resp.Listeners, rpc.RpcListenerStats{Listen: fmt.Sprintf("100.64.0.2:%d", 8000+i), Protocol: "tcp",
+			Backends: []rpc.RpcListenerBackend{{Address: "10.0.0.1:80"}, {Address: "10.0.0.2:80"}}})
+	}
+	if _, err := rpc.RpcCreateMessage(&resp); err != rpc.ErrRpcMessageTooLarge {
+		t.Fatalf("too large message is not refused: %v", err)
+	}
+
+	deskserviceFitResponse(&resp)
+	if _, err := rpc.RpcCreateMessage(&resp); err != nil {
+		t.Fatalf("response does not fit: %v", err)
+	}
+	if !resp.Truncated || len(resp.Peers) != 150 || len(resp.Listeners) != 50 {
+		t.Errorf("peers and listeners are dropped before histories: truncated %v, peers %d, listeners %d", resp.Truncated, len(resp.Peers), len(resp.Listeners))
+	}
+	if n := len(resp.History); n > 0 && !strings.HasSuffix(resp.History[n-1].Reason, fmt.Sprint(CONNSTATE_MAXHISTORY-1)) {
+		t.Errorf("newest state event is dropped: %+v", resp.History[n-1])
+	}
+	if len(resp.Peers[0].History) == 0 && len(resp.Peers[149].History) != 0 {
+		t.Errorf("history of later peer is kept instead of first one")
+	}
+
+	small := rpc.RpcCommandResponse{Status: "OK"}
+	deskserviceFitResponse(&small)
+	if small.Truncated {
+		t.Errorf("small response is truncated")
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+)
+
+// SvcFirewallListener is appliance listener port which is protected by host firewall
+type SvcFirewallListener struct {
+	Port     int
+	Protocol string
+}
+
+// SvcFirewallConfig describes rules which are enforced in host firewall for running nebula
+type SvcFirewallConfig struct {
+	CIDR           string
+	Dev            string
+	IPAddress      string
+	BlockListeners bool
+	Listeners      []SvcFirewallListener
+}
+
+var svcFirewallApplied *SvcFirewallConfig
+
+func svcFirewallConfigCreate(c *ManagementResponseConfig, proc *SvcNetworkCard) SvcFirewallConfig {
+	ret := SvcFirewallConfig{
+		CIDR:           c.NebulaCIDR,
+		IPAddress:      proc.IPAddress,
+		BlockListeners: myconfig.FirewallBlockListeners,
+	}
+	if proc.ncfg != nil {
+		ret.Dev = proc.ncfg.GetString("tun.dev", "")
+	}
+	for _, l := range c.ApplianceListeners {
+		proto := l.Protocol
+		if proto == "" {
+			proto = "tcp"
+		}
+		ret.Listeners = append(ret.Listeners, SvcFirewallListener{Port: l.Port, Protocol: proto})
+	}
+	// stable order to be able to compare configs
+	sort.Slice(ret.Listeners, func(i, j int) bool {
+		if ret.Listeners[i].Protocol != ret.Listeners[j].Protocol {
+			return ret.Listeners[i].Protocol < ret.Listeners[j].Protocol
+		}
+		return ret.Listeners[i].Port < ret.Listeners[j].Port
+	})
+	return ret
+}
+
+// svcFirewallUpdate applies host firewall rules if they differ from rules applied last time
+func svcFirewallUpdate(c *ManagementResponseConfig, proc *SvcNetworkCard) {
+	if !myconfig.WindowsFW || len(c.NebulaCIDR) == 0 || proc == nil {
+		return
+	}
+	fw := svcFirewallConfigCreate(c, proc)
+	if svcFirewallApplied != nil && reflect.DeepEqual(*svcFirewallApplied, fw) {
+		return
+	}
+	log.Debug("configuring host firewall for cidr: ", fw.CIDR)
+	if err := svcFirewallSetup(&fw); err != nil {
+		log.Error("cannot configure host firewall: ", err)
+		return
+	}
+	svcFirewallApplied = &fw
+}
+
+// svcFirewallReset removes all rules from host firewall, it is safe to call it repeatedly
+func svcFirewallReset() {
+	svcFirewallCleanup()
+	svcFirewallApplied = nil
+}
+
+// SvcKillSwitchConfig describes egress rules which block all traffic outside of tunnel in full-tunnel mode
+type SvcKillSwitchConfig struct {
+	Dev        string
+	IPAddress  string
+	AllowedIPs []string
+}
+
+var svcKillSwitchApplied *SvcKillSwitchConfig
+
+// svcKillSwitchRequested returns true if kill switch has to be active for current connection
+func svcKillSwitchRequested() bool {
+	return myconfig.LighthouseRoute && myconfig.KillSwitch
+}
+
+func SvcKillSwitchIsActive() bool {
+	return svcKillSwitchApplied != nil
+}
+
+// svcKillSwitchUpdate engages kill switch in full-tunnel mode, allowed are only lighthouse, wstunnel
+// and management IPs, DHCP and traffic through tun device
+func svcKillSwitchUpdate(proc *SvcNetworkCard) {
+	if !svcKillSwitchRequested() || proc == nil {
+		return
+	}
+	if !myconfig.WindowsFW {
+		log.Warn("kill switch is requested, but host firewall control is disabled")
+		return
+	}
+	ks := SvcKillSwitchConfig{
+		IPAddress:  proc.IPAddress,
+		AllowedIPs: ServiceCheckGetServiceDNSIPs(),
+	}
+	if proc.ncfg != nil {
+		ks.Dev = proc.ncfg.GetString("tun.dev", "")
+	}
+	sort.Strings(ks.AllowedIPs)
+	if svcKillSwitchApplied != nil && reflect.DeepEqual(*svcKillSwitchApplied, ks) {
+		return
+	}
+	log.Info("kill switch - blocking traffic outside of tunnel, allowed IPs: ", ks.AllowedIPs)
+	if err := svcKillSwitchSetup(&ks); err != nil {
+		log.Error("cannot configure kill switch: ", err)
+		return
+	}
+	svcKillSwitchApplied = &ks
+}
+
+// svcKillSwitchReset releases kill switch, it has to be called only when user explicitly disconnects
+func svcKillSwitchReset() {
+	if !myconfig.WindowsFW {
+		return
+	}
+	if svcKillSwitchApplied != nil {
+		log.Info("kill switch - releasing")
+	}
+	svcKillSwitchCleanup()
+	svcKillSwitchApplied = nil
+}
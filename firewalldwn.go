@@ -0,0 +1,22 @@
+//go:build darwin
+// +build darwin
+
+package main
+
+func svcFirewallCleanup() {
+	// Do nothing because it is not needed for darwin
+}
+
+func svcFirewallSetup(fw *SvcFirewallConfig) error {
+	// Do nothing because it is not needed for darwin
+	return nil
+}
+
+func svcKillSwitchCleanup() {
+	// Do nothing because kill switch is not supported on darwin
+}
+
+func svcKillSwitchSetup(ks *SvcKillSwitchConfig) error {
+	log.Warn("kill switch is not supported on darwin")
+	return nil
+}
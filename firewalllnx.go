@@ -0,0 +1,421 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+const (
+	FIREWALL_NFT_TABLE         = "shieldoo_mesh"
+	FIREWALL_NFT_KS_TABLE      = "shieldoo_mesh_killswitch"
+	FIREWALL_RULE_COMMENT      = "shieldoo-mesh"
+	FIREWALL_IPTABLES_CHAIN    = "SHIELDOO-MESH"
+	FIREWALL_IPTABLES_KS_CHAIN = "SHIELDOO-MESH-KS"
+)
+
+// firewallCommand creates command for firewall tools, tests can replace it to run commands in network namespace
+var firewallCommand = exec.Command
+
+type firewallBackend interface {
+	Name() string
+	Setup(fw *SvcFirewallConfig) error
+	Cleanup() error
+	KillSwitchSetup(ks *SvcKillSwitchConfig) error
+	KillSwitchCleanup() error
+}
+
+func firewallRun(stdin string, name string, args ...string) (string, error) {
+	cmd := firewallCommand(name, args...)
+	if stdin != "" {
+		cmd.Stdin = strings.NewReader(stdin)
+	}
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	err := cmd.Run()
+	if err != nil {
+		return out.String(), fmt.Errorf("%s %s: %v: %s", name, strings.Join(args, " "), err, strings.TrimSpace(out.String()))
+	}
+	return out.String(), nil
+}
+
+// firewallSelectBackend prefers nftables and falls back to iptables, iptables is used also if input
+// is filtered by iptables-nft (e.g. ufw), rules of nft tool would break iptables management of such table
+func firewallSelectBackend() firewallBackend {
+	_, errIptables := exec.LookPath("iptables")
+	if _, err := exec.LookPath("nft"); err == nil {
+		if out, err := firewallRun("", "nft", "list", "chains"); err == nil {
+			if errIptables == nil && firewallNftIptablesManaged(firewallNftInputChains(out)) {
+				log.Debug("input is filtered by iptables-nft, using iptables")
+				return &firewallIptables{}
+			}
+			return &firewallNft{}
+		}
+	}
+	if errIptables == nil {
+		return &firewallIptables{}
+	}
+	return nil
+}
+
+func svcFirewallSetup(fw *SvcFirewallConfig) error {
+	b := firewallSelectBackend()
+	if b == nil {
+		return fmt.Errorf("neither nft nor iptables is available")
+	}
+	log.Info("adding firewall rules for ShieldooMesh using ", b.Name())
+	return b.Setup(fw)
+}
+
+func svcFirewallCleanup() {
+	log.Info("deleting firewall rules for ShieldooMesh")
+	// cleanup both backends, previous instance could use different one
+	if _, err := exec.LookPath("nft"); err == nil {
+		if err := (&firewallNft{}).Cleanup(); err != nil {
+			log.Error("cannot cleanup nftables rules: ", err)
+		}
+	}
+	if _, err := exec.LookPath("iptables"); err == nil {
+		if err := (&firewallIptables{}).Cleanup(); err != nil {
+			log.Error("cannot cleanup iptables rules: ", err)
+		}
+	}
+}
+
+func svcKillSwitchSetup(ks *SvcKillSwitchConfig) error {
+	b := firewallSelectBackend()
+	if b == nil {
+		return fmt.Errorf("neither nft nor iptables is available")
+	}
+	log.Info("adding kill switch rules for ShieldooMesh using ", b.Name())
+	return b.KillSwitchSetup(ks)
+}
+
+func svcKillSwitchCleanup() {
+	log.Info("deleting kill switch rules for ShieldooMesh")
+	if _, err := exec.LookPath("nft"); err == nil {
+		if err := (&firewallNft{}).KillSwitchCleanup(); err != nil {
+			log.Error("cannot cleanup nftables kill switch rules: ", err)
+		}
+	}
+	if _, err := exec.LookPath("iptables"); err == nil {
+		if err := (&firewallIptables{}).KillSwitchCleanup(); err != nil {
+			log.Error("cannot cleanup iptables kill switch rules: ", err)
+		}
+	}
+}
+
+func firewallListenerPorts(fw *SvcFirewallConfig, proto string) (ret []string) {
+	for _, l := range fw.Listeners {
+		if l.Protocol == proto {
+			ret = append(ret, fmt.Sprintf("%d", l.Port))
+		}
+	}
+	return
+}
+
+// ### nftables
+
+type firewallNft struct{}
+
+func (f *firewallNft) Name() string {
+	return "nftables"
+}
+
+func firewallNftAllowRule(fw *SvcFirewallConfig) string {
+	if fw.Dev != "" {
+		return fmt.Sprintf("iifname %q ip saddr %s accept", fw.Dev, fw.CIDR)
+	}
+	return fmt.Sprintf("ip saddr %s accept", fw.CIDR)
+}
+
+// firewallNftScript creates atomic nft transaction which (re)creates dedicated table
+func firewallNftScript(fw *SvcFirewallConfig) string {
+	var b strings.Builder
+	// "add" before "delete" makes the transaction valid even if the table does not exist yet
+	fmt.Fprintf(&b, "add table inet %s\n", FIREWALL_NFT_TABLE)
+	fmt.Fprintf(&b, "delete table inet %s\n", FIREWALL_NFT_TABLE)
+	fmt.Fprintf(&b, "table inet %s {\n", FIREWALL_NFT_TABLE)
+	b.WriteString("\tchain input {\n")
+	b.WriteString("\t\ttype filter hook input priority -10; policy accept;\n")
+	if fw.BlockListeners && fw.IPAddress != "" {
+		for _, proto := range []string{"tcp", "udp"} {
+			ports := firewallListenerPorts(fw, proto)
+			if len(ports) > 0 {
+				fmt.Fprintf(&b, "\t\tip saddr != %s ip daddr %s %s dport { %s } drop\n",
+					fw.CIDR, fw.IPAddress, proto, strings.Join(ports, ", "))
+			}
+		}
+	}
+	fmt.Fprintf(&b, "\t\t%s\n", firewallNftAllowRule(fw))
+	b.WriteString("\t}\n")
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// firewallNftKillSwitchScript creates atomic nft transaction with output chain which drops
+// everything except loopback, tun device, DHCP and allowed underlay IPs;
+// direct peer to peer tunnels are blocked too, so nebula falls back to relays
+func firewallNftKillSwitchScript(ks *SvcKillSwitchConfig) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "add table inet %s\n", FIREWALL_NFT_KS_TABLE)
+	fmt.Fprintf(&b, "delete table inet %s\n", FIREWALL_NFT_KS_TABLE)
+	fmt.Fprintf(&b, "table inet %s {\n", FIREWALL_NFT_KS_TABLE)
+	b.WriteString("\tchain output {\n")
+	b.WriteString("\t\ttype filter hook output priority 0; policy drop;\n")
+	b.WriteString("\t\toifname \"lo\" accept\n")
+	if ks.Dev != "" {
+		fmt.Fprintf(&b, "\t\toifname %q accept\n", ks.Dev)
+	}
+	if ks.IPAddress != "" {
+		fmt.Fprintf(&b, "\t\tip saddr %s accept\n", ks.IPAddress)
+	}
+	b.WriteString("\t\tudp sport 68 udp dport 67 accept\n")
+	b.WriteString("\t\tip6 daddr { ff02::1:2, fe80::/10 } udp sport 546 udp dport 547 accept\n")
+	b.WriteString("\t\ticmpv6 type { nd-router-solicit, nd-neighbor-solicit, nd-neighbor-advert } accept\n")
+	var ip4, ip6 []string
+	for _, ip := range ks.AllowedIPs {
+		if strings.Contains(ip, ":") {
+			ip6 = append(ip6, ip)
+		} else {
+			ip4 = append(ip4, ip)
+		}
+	}
+	if len(ip4) > 0 {
+		fmt.Fprintf(&b, "\t\tip daddr { %s } accept\n", strings.Join(ip4, ", "))
+	}
+	if len(ip6) > 0 {
+		fmt.Fprintf(&b, "\t\tip6 daddr { %s } accept\n", strings.Join(ip6, ", "))
+	}
+	b.WriteString("\t}\n")
+	b.WriteString("}\n")
+	return b.String()
+}
+
+var firewallNftHandleRegex = regexp.MustCompile(`comment "` + FIREWALL_RULE_COMMENT + `".*# handle (\d+)`)
+
+var firewallNftTableRegex = regexp.MustCompile(`^table (\S+) (\S+) \{`)
+var firewallNftChainRegex = regexp.MustCompile(`^chain (\S+) \{`)
+
+// firewallNftChain is base chain of other tables hooked to input
+type firewallNftChain struct {
+	Family string
+	Table  string
+	Chain  string
+}
+
+// firewallNftInputChains parses output of "nft list chains" and returns base chains hooked to input,
+// only ip and inet families filter IPv4 mesh traffic
+func firewallNftInputChains(listing string) (ret []firewallNftChain) {
+	var family, table, chain string
+	for _, line := range strings.Split(listing, "\n") {
+		line = strings.TrimSpace(line)
+		if m := firewallNftTableRegex.FindStringSubmatch(line); m != nil {
+			family, table, chain = m[1], m[2], ""
+		} else if m := firewallNftChainRegex.FindStringSubmatch(line); m != nil {
+			chain = m[1]
+		} else if chain != "" && strings.Contains(line, " hook input ") &&
+			(family == "ip" || family == "inet") && table != FIREWALL_NFT_TABLE {
+			ret = append(ret, firewallNftChain{Family: family, Table: table, Chain: chain})
+		}
+	}
+	return
+}
+
+// firewallNftIptablesManaged returns true if input is filtered by table created by iptables-nft
+func firewallNftIptablesManaged(chains []firewallNftChain) bool {
+	for _, c := range chains {
+		if c.Family == "ip" && c.Table == "filter" && c.Chain == "INPUT" {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *firewallNft) inputChains() ([]firewallNftChain, error) {
+	out, err := firewallRun("", "nft", "list", "chains")
+	if err != nil {
+		return nil, err
+	}
+	return firewallNftInputChains(out), nil
+}
+
+func (f *firewallNft) Setup(fw *SvcFirewallConfig) error {
+	if _, err := firewallRun(firewallNftScript(fw), "nft", "-f", "-"); err != nil {
+		return err
+	}
+	// accept verdict is not final across nftables tables, so every default-deny input chain
+	// of other tables (inet filter, firewalld) needs its own accept rule for mesh traffic
+	if err := f.cleanupInputChains(); err != nil {
+		return err
+	}
+	chains, err := f.inputChains()
+	if err != nil {
+		return err
+	}
+	for _, c := range chains {
+		rule := fmt.Sprintf("insert rule %s %s %s %s comment %q", c.Family, c.Table, c.Chain, firewallNftAllowRule(fw), FIREWALL_RULE_COMMENT)
+		if _, err := firewallRun(rule+"\n", "nft", "-f", "-"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *firewallNft) cleanupInputChains() error {
+	chains, err := f.inputChains()
+	if err != nil {
+		return err
+	}
+	for _, c := range chains {
+		out, err := firewallRun("", "nft", "-a", "list", "chain", c.Family, c.Table, c.Chain)
+		if err != nil {
+			continue
+		}
+		for _, m := range firewallNftHandleRegex.FindAllStringSubmatch(out, -1) {
+			if _, err := firewallRun("", "nft", "delete", "rule", c.Family, c.Table, c.Chain, "handle", m[1]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (f *firewallNft) Cleanup() error {
+	script := fmt.Sprintf("add table inet %s\ndelete table inet %s\n", FIREWALL_NFT_TABLE, FIREWALL_NFT_TABLE)
+	if _, err := firewallRun(script, "nft", "-f", "-"); err != nil {
+		return err
+	}
+	return f.cleanupInputChains()
+}
+
+func (f *firewallNft) KillSwitchSetup(ks *SvcKillSwitchConfig) error {
+	_, err := firewallRun(firewallNftKillSwitchScript(ks), "nft", "-f", "-")
+	return err
+}
+
+func (f *firewallNft) KillSwitchCleanup() error {
+	script := fmt.Sprintf("add table inet %s\ndelete table inet %s\n", FIREWALL_NFT_KS_TABLE, FIREWALL_NFT_KS_TABLE)
+	_, err := firewallRun(script, "nft", "-f", "-")
+	return err
+}
+
+// ### iptables
+
+type firewallIptables struct{}
+
+func (f *firewallIptables) Name() string {
+	return "iptables"
+}
+
+// firewallIptablesRules creates rules appended to dedicated chain
+func firewallIptablesRules(fw *SvcFirewallConfig) (ret [][]string) {
+	if fw.BlockListeners && fw.IPAddress != "" {
+		for _, l := range fw.Listeners {
+			ret = append(ret, []string{"!", "-s", fw.CIDR, "-d", fw.IPAddress, "-p", l.Protocol,
+				"--dport", fmt.Sprintf("%d", l.Port), "-j", "DROP"})
+		}
+	}
+	allow := []string{"-s", fw.CIDR, "-j", "ACCEPT"}
+	if fw.Dev != "" {
+		allow = append([]string{"-i", fw.Dev}, allow...)
+	}
+	return append(ret, allow)
+}
+
+func (f *firewallIptables) Setup(fw *SvcFirewallConfig) error {
+	return f.chainSetup("iptables", FIREWALL_IPTABLES_CHAIN, "INPUT", firewallIptablesRules(fw))
+}
+
+func (f *firewallIptables) Cleanup() error {
+	return f.chainCleanup("iptables", FIREWALL_IPTABLES_CHAIN, "INPUT")
+}
+
+// firewallIptablesKillSwitchRules creates rules appended to dedicated output chain, last rule drops everything
+func firewallIptablesKillSwitchRules(ks *SvcKillSwitchConfig) (ret [][]string) {
+	ret = append(ret, []string{"-o", "lo", "-j", "ACCEPT"})
+	if ks.Dev != "" {
+		ret = append(ret, []string{"-o", ks.Dev, "-j", "ACCEPT"})
+	}
+	if ks.IPAddress != "" {
+		ret = append(ret, []string{"-s", ks.IPAddress, "-j", "ACCEPT"})
+	}
+	ret = append(ret, []string{"-p", "udp", "--sport", "68", "--dport", "67", "-j", "ACCEPT"})
+	for _, ip := range ks.AllowedIPs {
+		if strings.Contains(ip, ":") {
+			// IPv6 is blocked completely by iptables backend
+			continue
+		}
+		ret = append(ret, []string{"-d", ip, "-j", "ACCEPT"})
+	}
+	return append(ret, []string{"-j", "DROP"})
+}
+
+// chainSetup (re)creates dedicated chain and makes sure that it is referenced from hook chain
+func (f *firewallIptables) chainSetup(tool string, chain string, hook string, rules [][]string) error {
+	// chain can already exist after crash, so error is ignored and chain is flushed
+	_, _ = firewallRun("", tool, "-w", "-N", chain)
+	if _, err := firewallRun("", tool, "-w", "-F", chain); err != nil {
+		return err
+	}
+	for _, r := range rules {
+		args := append([]string{"-w", "-A", chain}, r...)
+		if _, err := firewallRun("", tool, args...); err != nil {
+			return err
+		}
+	}
+	if _, err := firewallRun("", tool, "-w", "-C", hook, "-j", chain); err != nil {
+		if _, err := firewallRun("", tool, "-w", "-I", hook, "1", "-j", chain); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *firewallIptables) chainCleanup(tool string, chain string, hook string) error {
+	if _, err := firewallRun("", tool, "-w", "-L", chain, "-n"); err != nil {
+		// chain does not exist
+		return nil
+	}
+	// remove all jumps, rule can be there multiple times
+	for i := 0; i < 16; i++ {
+		if _, err := firewallRun("", tool, "-w", "-D", hook, "-j", chain); err != nil {
+			break
+		}
+	}
+	if _, err := firewallRun("", tool, "-w", "-F", chain); err != nil {
+		return err
+	}
+	_, err := firewallRun("", tool, "-w", "-X", chain)
+	return err
+}
+
+func (f *firewallIptables) KillSwitchSetup(ks *SvcKillSwitchConfig) error {
+	if err := f.chainSetup("iptables", FIREWALL_IPTABLES_KS_CHAIN, "OUTPUT", firewallIptablesKillSwitchRules(ks)); err != nil {
+		return err
+	}
+	if _, err := exec.LookPath("ip6tables"); err == nil {
+		rules := [][]string{{"-o", "lo", "-j", "ACCEPT"}}
+		if ks.Dev != "" {
+			rules = append(rules, []string{"-o", ks.Dev, "-j", "ACCEPT"})
+		}
+		rules = append(rules, []string{"-j", "DROP"})
+		return f.chainSetup("ip6tables", FIREWALL_IPTABLES_KS_CHAIN, "OUTPUT", rules)
+	}
+	return nil
+}
+
+func (f *firewallIptables) KillSwitchCleanup() error {
+	if _, err := exec.LookPath("ip6tables"); err == nil {
+		if err := f.chainCleanup("ip6tables", FIREWALL_IPTABLES_KS_CHAIN, "OUTPUT"); err != nil {
+			return err
+		}
+	}
+	return f.chainCleanup("iptables", FIREWALL_IPTABLES_KS_CHAIN, "OUTPUT")
+}
@@ -0,0 +1,204 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func testFirewallConfig() *SvcFirewallConfig {
+	return &SvcFirewallConfig{
+		CIDR:           "100.64.0.0/10",
+		Dev:            "shieldoo0",
+		IPAddress:      "100.64.0.5",
+		BlockListeners: true,
+		Listeners: []SvcFirewallListener{
+			{Port: 53, Protocol: "udp"},
+			{Port: 80, Protocol: "tcp"},
+			{Port: 443, Protocol: "tcp"},
+		},
+	}
+}
+
+func TestFirewallNftScript(t *testing.T) {
+	script := firewallNftScript(testFirewallConfig())
+	expected := []string{
+		"add table inet shieldoo_mesh\ndelete table inet shieldoo_mesh\n",
+		"ip saddr != 100.64.0.0/10 ip daddr 100.64.0.5 tcp dport { 80, 443 } drop",
+		"ip saddr != 100.64.0.0/10 ip daddr 100.64.0.5 udp dport { 53 } drop",
+		`iifname "shieldoo0" ip saddr 100.64.0.0/10 accept`,
+	}
+	for _, e := range expected {
+		if !strings.Contains(script, e) {
+			t.Errorf("nft script does not contain %q:\n%s", e, script)
+		}
+	}
+
+	fw := testFirewallConfig()
+	fw.BlockListeners = false
+	fw.Dev = ""
+	script = firewallNftScript(fw)
+	if strings.Contains(script, "drop") {
+		t.Errorf("nft script contains drop rule while listeners are not blocked:\n%s", script)
+	}
+	if !strings.Contains(script, "\t\tip saddr 100.64.0.0/10 accept") {
+		t.Errorf("nft script does not contain allow rule without device:\n%s", script)
+	}
+}
+
+func TestFirewallNftInputChains(t *testing.T) {
+	// iptables-nft with ufw, native inet filter table and firewalld
+	listing := `table ip filter {
+	chain INPUT {
+		type filter hook input priority filter; policy drop;
+	}
+	chain FORWARD {
+		type filter hook forward priority filter; policy drop;
+	}
+	chain ufw-before-input {
+	}
+}
+table ip6 filter {
+	chain INPUT {
+		type filter hook input priority filter; policy drop;
+	}
+}
+table inet filter {
+	chain input {
+		type filter hook input priority filter; policy drop;
+	}
+}
+table inet firewalld {
+	chain filter_INPUT {
+		type filter hook input priority filter + 10; policy accept;
+	}
+	chain filter_IN_public {
+	}
+}
+table inet shieldoo_mesh {
+	chain input {
+		type filter hook input priority -10; policy accept;
+	}
+}
+`
+	chains := firewallNftInputChains(listing)
+	expected := []firewallNftChain{
+		{Family: "ip", Table: "filter", Chain: "INPUT"},
+		{Family: "inet", Table: "filter", Chain: "input"},
+		{Family: "inet", Table: "firewalld", Chain: "filter_INPUT"},
+	}
+	if fmt.Sprint(chains) != fmt.Sprint(expected) {
+		t.Errorf("expected input chains %v, got %v", expected, chains)
+	}
+	// ufw layout has to be managed by iptables
+	if !firewallNftIptablesManaged(chains) {
+		t.Errorf("iptables-nft table is not detected")
+	}
+	if firewallNftIptablesManaged(chains[1:]) {
+		t.Errorf("native nftables tables are detected as iptables-nft")
+	}
+}
+
+func TestFirewallIptablesRules(t *testing.T) {
+	rules := firewallIptablesRules(testFirewallConfig())
+	if len(rules) != 4 {
+		t.Fatalf("expected 4 rules, got %d: %v", len(rules), rules)
+	}
+	if r := strings.Join(rules[0], " "); r != "! -s 100.64.0.0/10 -d 100.64.0.5 -p udp --dport 53 -j DROP" {
+		t.Errorf("unexpected drop rule: %s", r)
+	}
+	if r := strings.Join(rules[3], " "); r != "-i shieldoo0 -s 100.64.0.0/10 -j ACCEPT" {
+		t.Errorf("unexpected allow rule: %s", r)
+	}
+}
+
+func TestFirewallNftKillSwitchScript(t *testing.T) {
+	ks := &SvcKillSwitchConfig{
+		Dev:        "shieldoo0",
+		IPAddress:  "100.64.0.5",
+		AllowedIPs: []string{"1.2.3.4", "2001:db8::1", "5.6.7.8"},
+	}
+	script := firewallNftKillSwitchScript(ks)
+	expected := []string{
+		"type filter hook output priority 0; policy drop;",
+		`oifname "lo" accept`,
+		`oifname "shieldoo0" accept`,
+		"udp sport 68 udp dport 67 accept",
+		"ip6 daddr { ff02::1:2, fe80::/10 } udp sport 546 udp dport 547 accept",
+		"ip daddr { 1.2.3.4, 5.6.7.8 } accept",
+		"ip6 daddr { 2001:db8::1 } accept",
+	}
+	for _, e := range expected {
+		if !strings.Contains(script, e) {
+			t.Errorf("nft kill switch script does not contain %q:\n%s", e, script)
+		}
+	}
+	// DHCPv6 is allowed only to DHCP servers on local link
+	if strings.Contains(script, "\t\tudp dport 547 accept") {
+		t.Errorf("nft kill switch script allows any DHCPv6 traffic:\n%s", script)
+	}
+
+	rules := firewallIptablesKillSwitchRules(ks)
+	if r := strings.Join(rules[len(rules)-1], " "); r != "-j DROP" {
+		t.Errorf("last iptables kill switch rule has to drop everything, got: %s", r)
+	}
+	for _, r := range rules {
+		if strings.Contains(strings.Join(r, " "), "2001:db8::1") {
+			t.Errorf("iptables kill switch rules contain IPv6 address: %v", r)
+		}
+	}
+}
+
+// TestFirewallNetns applies and removes rules in throw-away network namespace,
+// it runs only as root with nft and ip tools available
+func TestFirewallNetns(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+	if _, err := exec.LookPath("ip"); err != nil {
+		t.Skip("requires ip tool")
+	}
+	if _, err := exec.LookPath("nft"); err != nil {
+		t.Skip("requires nft tool")
+	}
+	ns := fmt.Sprintf("shieldoo-test-%d", os.Getpid())
+	if out, err := exec.Command("ip", "netns", "add", ns).CombinedOutput(); err != nil {
+		t.Skipf("cannot create network namespace: %v: %s", err, out)
+	}
+	defer exec.Command("ip", "netns", "delete", ns).Run()
+
+	firewallCommand = func(name string, args ...string) *exec.Cmd {
+		return exec.Command("ip", append([]string{"netns", "exec", ns, name}, args...)...)
+	}
+	defer func() { firewallCommand = exec.Command }()
+
+	f := &firewallNft{}
+	fw := testFirewallConfig()
+	// setup has to be idempotent
+	for i := 0; i < 2; i++ {
+		if err := f.Setup(fw); err != nil {
+			t.Fatalf("setup %d failed: %v", i, err)
+		}
+	}
+	out, err := firewallRun("", "nft", "list", "table", "inet", FIREWALL_NFT_TABLE)
+	if err != nil {
+		t.Fatalf("table is missing after setup: %v", err)
+	}
+	if strings.Count(out, "accept") != 1 {
+		t.Errorf("expected exactly one accept rule:\n%s", out)
+	}
+	// cleanup has to be idempotent too
+	for i := 0; i < 2; i++ {
+		if err := f.Cleanup(); err != nil {
+			t.Fatalf("cleanup %d failed: %v", i, err)
+		}
+	}
+	if _, err := firewallRun("", "nft", "list", "table", "inet", FIREWALL_NFT_TABLE); err == nil {
+		t.Errorf("table still exists after cleanup")
+	}
+}
@@ -2,12 +2,28 @@ package config
 
 import (
 	"fmt"
+	"log"
+	"net"
 	"strings"
 	"time"
 
+	"github.com/shieldoo/shieldoo-mesh/goproxy/core/metrics"
 	"github.com/shieldoo/shieldoo-mesh/goproxy/core/scheduler"
 )
 
+const (
+	// interval of active health checks when more backends are configured
+	DefaultHealthCheckInterval = 10 * time.Second
+	// consecutive failed connections before backend is marked down
+	DefaultMaxFails = 1
+	// backend marked down by failed connections is tried again after this time if active checks are disabled
+	DefaultFailTimeout = 30 * time.Second
+	// active sessions are closed after this time when listener is drained
+	DefaultDrainTimeout = 30 * time.Second
+	// UDP flow without packets in both directions is closed after this time
+	DefaultUDPIdleTimeout = 30 * time.Second
+)
+
 // Configure
 type Config struct {
 	Debug     bool
@@ -16,6 +32,97 @@ type Config struct {
 	Timeout   time.Duration // time.Millisecond
 	Local     string
 	Servers   []string
+	// weights of servers for weighted schedulers, servers without weight have weight 1
+	Weights map[string]int
+	// active health checks, zero interval disables them
+	HealthCheckInterval time.Duration
+	// path of HTTP GET health check, TCP connect is used if empty
+	HealthCheckPath string
+	// passive failure tracking
+	MaxFails    int
+	FailTimeout time.Duration
+	// version of PROXY protocol header sent to TCP backends, 0 disables it
+	ProxyProtocol int
+	// returns identity of client, nil means unknown
+	Identify func(client net.Addr) *Identity
+	// clients allowed by certificate name or group, all clients are allowed if both are empty
+	AllowedNames  []string
+	AllowedGroups []string
+	// limits of listener and of every source IP
+	Limits Limits
+	// routes of http and https listener, Servers contain backends of all routes
+	Routes []Route
+	// PEM certificate and key of https listener
+	TLSCert string
+	TLSKey  string
+	// deadline of active sessions when listener is drained, zero closes them immediately
+	DrainTimeout time.Duration
+	// idle UDP flows and TCP sessions are closed after this time, zero disables it for TCP
+	IdleTimeout time.Duration
+	// TCP session closed by one side is closed after this time without data in other direction,
+	// zero keeps half-closed sessions until IdleTimeout
+	HalfCloseTimeout time.Duration
+	// logger of listener, standard log package is used by default
+	Logger Logger
+	// events of listener are recorded into sink, they are ignored by default
+	Metrics metrics.Sink
+}
+
+// Logger of proxy, logrus logger and entry implement it
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// StdLogger writes to standard log package, debug messages are written only in debug mode of config
+type StdLogger struct {
+	Config *Config
+}
+
+func (l *StdLogger) Debugf(format string, args ...interface{}) {
+	if l.Config.Debug {
+		log.Printf(format, args...)
+	}
+}
+
+func (l *StdLogger) Infof(format string, args ...interface{}) {
+	log.Printf(format, args...)
+}
+
+func (l *StdLogger) Warnf(format string, args ...interface{}) {
+	log.Printf(format, args...)
+}
+
+func (l *StdLogger) Errorf(format string, args ...interface{}) {
+	log.Printf(format, args...)
+}
+
+// Route of http listener, empty host matches any host and empty path prefix matches any path
+type Route struct {
+	Host       string
+	PathPrefix string
+	Servers    []string
+}
+
+// Limits of connections and bandwidth, zero values mean unlimited
+type Limits struct {
+	// concurrent TCP connections or UDP flows
+	MaxConnections          int
+	MaxConnectionsPerSource int
+	// new connections or flows per second
+	ConnectionRate          float64
+	ConnectionRatePerSource float64
+	// bytes per second in both directions
+	Bandwidth          int64
+	BandwidthPerSource int64
+}
+
+// Identity of client from nebula certificate
+type Identity struct {
+	Name   string
+	Groups []string
 }
 
 // Create configuration
@@ -23,23 +130,79 @@ func New(protocol string, local string, server string) (*Config, error) {
 	t := new(Config)
 	t.Scheduler = scheduler.IPHashName
 	t.Timeout = 2000
+	t.MaxFails = DefaultMaxFails
+	t.FailTimeout = DefaultFailTimeout
+	t.DrainTimeout = DefaultDrainTimeout
+	t.Logger = &StdLogger{Config: t}
+	t.Metrics = metrics.Nop{}
 	if protocol == "" {
 		protocol = "tcp"
 	}
-	if protocol == "tcp" || protocol == "udp" {
+	switch protocol {
+	case "tcp", "udp", "http", "https":
 		t.Protocol = protocol
-	} else {
-		return nil, fmt.Errorf("Only support tcp/udp protocol")
+		if protocol == "udp" {
+			t.IdleTimeout = DefaultUDPIdleTimeout
+		}
+	default:
+		return nil, fmt.Errorf("Only support tcp/udp/http/https protocol")
 	}
 	if local == "" {
 		return nil, fmt.Errorf("Local monitoring ports cannot be empty")
 	}
 	t.Local = local
-	servers := strings.Split(server, ",")
-	if len(servers) == 0 {
-		return nil, fmt.Errorf("Real server address can't be empty")
+	servers := splitServers(server)
+	if t.IsHTTP() {
+		// servers of http listener are default route, other routes can be added
+		if len(servers) > 0 {
+			t.AddRoute("", "", server)
+		}
+	} else {
+		if len(servers) == 0 {
+			return nil, fmt.Errorf("Real server address can't be empty")
+		}
+		t.Servers = servers
+	}
+	if len(servers) > 1 {
+		t.HealthCheckInterval = DefaultHealthCheckInterval
 	}
-	t.Servers = servers
 
 	return t, nil
 }
+
+func splitServers(server string) []string {
+	var servers []string
+	for _, s := range strings.Split(server, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			servers = append(servers, s)
+		}
+	}
+	return servers
+}
+
+// IsHTTP returns true for http and https listener
+func (t *Config) IsHTTP() bool {
+	return t.Protocol == "http" || t.Protocol == "https"
+}
+
+// AddRoute adds route of http listener to comma separated backends
+func (t *Config) AddRoute(host string, pathPrefix string, server string) error {
+	servers := splitServers(server)
+	if len(servers) == 0 {
+		return fmt.Errorf("Real server address of route %s%s can't be empty", host, pathPrefix)
+	}
+	t.Routes = append(t.Routes, Route{Host: strings.ToLower(host), PathPrefix: pathPrefix, Servers: servers})
+	for _, s := range servers {
+		known := false
+		for _, k := range t.Servers {
+			known = known || k == s
+		}
+		if !known {
+			t.Servers = append(t.Servers, s)
+		}
+	}
+	if len(t.Servers) > 1 && t.HealthCheckInterval == 0 {
+		t.HealthCheckInterval = DefaultHealthCheckInterval
+	}
+	return nil
+}
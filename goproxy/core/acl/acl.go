@@ -0,0 +1,42 @@
+package acl
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/shieldoo/shieldoo-mesh/goproxy/config"
+)
+
+// Enabled returns true if listener restricts clients
+func Enabled(config *config.Config) bool {
+	return len(config.AllowedNames) > 0 || len(config.AllowedGroups) > 0
+}
+
+// Check returns error with reason if client is not allowed by certificate name or group,
+// client without known identity is rejected when restrictions are configured
+func Check(config *config.Config, client net.Addr) error {
+	if !Enabled(config) {
+		return nil
+	}
+	if config.Identify == nil {
+		return fmt.Errorf("identity of client is not available")
+	}
+	id := config.Identify(client)
+	if id == nil {
+		return fmt.Errorf("no nebula tunnel with certificate for client")
+	}
+	for _, n := range config.AllowedNames {
+		if strings.EqualFold(n, id.Name) {
+			return nil
+		}
+	}
+	for _, g := range config.AllowedGroups {
+		for _, cg := range id.Groups {
+			if g == cg {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("certificate %q with groups %v is not allowed", id.Name, id.Groups)
+}
@@ -0,0 +1,48 @@
+package acl
+
+import (
+	"net"
+	"testing"
+
+	"github.com/shieldoo/shieldoo-mesh/goproxy/config"
+)
+
+func TestCheck(t *testing.T) {
+	ids := map[string]*config.Identity{
+		"100.64.0.2": {Name: "john@example.com", Groups: []string{"developers"}},
+		"100.64.0.3": {Name: "jane@example.com", Groups: []string{"admins", "dba"}},
+		"100.64.0.4": {Name: "server-1"},
+	}
+	cfg, _ := config.New("tcp", ":0", "db:5432")
+	cfg.Identify = func(client net.Addr) *config.Identity {
+		return ids[client.(*net.TCPAddr).IP.String()]
+	}
+	addr := func(ip string) net.Addr { return &net.TCPAddr{IP: net.ParseIP(ip), Port: 40000} }
+
+	// no restrictions
+	for _, ip := range []string{"100.64.0.2", "100.64.0.9"} {
+		if err := Check(cfg, addr(ip)); err != nil {
+			t.Errorf("%s rejected without restrictions: %v", ip, err)
+		}
+	}
+
+	cfg.AllowedGroups = []string{"dba"}
+	cfg.AllowedNames = []string{"JOHN@example.com"}
+	tests := map[string]bool{
+		"100.64.0.2": true,  // by name
+		"100.64.0.3": true,  // by group
+		"100.64.0.4": false, // neither name nor group
+		"100.64.0.9": false, // unknown peer
+	}
+	for ip, allowed := range tests {
+		err := Check(cfg, addr(ip))
+		if (err == nil) != allowed {
+			t.Errorf("%s: allowed %v, error %v", ip, allowed, err)
+		}
+	}
+
+	cfg.Identify = nil
+	if err := Check(cfg, addr("100.64.0.2")); err == nil {
+		t.Error("client is allowed without identity lookup")
+	}
+}
@@ -0,0 +1,177 @@
+package health
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shieldoo/shieldoo-mesh/goproxy/config"
+)
+
+// Checker tracks health of backends by active checks and by results of client connections
+type Checker struct {
+	config   *config.Config
+	lock     sync.RWMutex
+	backends map[string]*backend
+	shutdown chan struct{}
+	once     sync.Once
+}
+
+type backend struct {
+	down      bool
+	fails     int
+	downSince time.Time
+}
+
+// New return a new health checker, all backends are healthy until check fails
+func New(config *config.Config) *Checker {
+	t := new(Checker)
+	t.config = config
+	t.backends = make(map[string]*backend)
+	for _, s := range config.Servers {
+		t.backends[s] = &backend{}
+	}
+	t.shutdown = make(chan struct{})
+	return t
+}
+
+// Start runs active health checks until Stop is called
+func (t *Checker) Start() {
+	if t.config.HealthCheckInterval <= 0 {
+		return
+	}
+	// TCP connect to UDP backend proves nothing, only HTTP check is used
+	if t.config.Protocol == "udp" && t.config.HealthCheckPath == "" {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(t.config.HealthCheckInterval)
+		defer ticker.Stop()
+		for {
+			t.checkAll()
+			select {
+			case <-t.shutdown:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Stop stops active health checks
+func (t *Checker) Stop() {
+	t.once.Do(func() { close(t.shutdown) })
+}
+
+// Healthy returns backends which are up, all backends are returned if none is up
+// so clients are not refused because of wrong check
+func (t *Checker) Healthy(servers []string) []string {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	var ret []string
+	for _, s := range servers {
+		if t.isUp(s) {
+			ret = append(ret, s)
+		}
+	}
+	if len(ret) == 0 {
+		return servers
+	}
+	return ret
+}
+
+// isUp must be called with lock held
+func (t *Checker) isUp(server string) bool {
+	b, ok := t.backends[server]
+	if !ok || !b.down {
+		return true
+	}
+	// without active checks backend is tried again after fail timeout
+	if t.config.HealthCheckInterval <= 0 && t.config.FailTimeout > 0 && time.Since(b.downSince) > t.config.FailTimeout {
+		return true
+	}
+	return false
+}
+
+// Fail records failed connection to backend
+func (t *Checker) Fail(server string, err error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	b := t.backend(server)
+	b.fails++
+	maxFails := t.config.MaxFails
+	if maxFails <= 0 {
+		maxFails = config.DefaultMaxFails
+	}
+	if b.fails >= maxFails {
+		if !b.down {
+			t.config.Logger.Warnf("Health backend [%v] is down: %v", server, err)
+		}
+		b.down = true
+		b.downSince = time.Now()
+	}
+}
+
+// Success records successful connection to backend
+func (t *Checker) Success(server string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	b := t.backend(server)
+	if b.down {
+		t.config.Logger.Infof("Health backend [%v] is up", server)
+	}
+	b.down = false
+	b.fails = 0
+}
+
+// backend must be called with lock held
+func (t *Checker) backend(server string) *backend {
+	b, ok := t.backends[server]
+	if !ok {
+		b = &backend{}
+		t.backends[server] = b
+	}
+	return b
+}
+
+func (t *Checker) checkAll() {
+	var wg sync.WaitGroup
+	for _, s := range t.config.Servers {
+		wg.Add(1)
+		go func(server string) {
+			defer wg.Done()
+			if err := t.check(server); err != nil {
+				t.config.Logger.Debugf("Health check of [%v] failed: %v", server, err)
+				t.Fail(server, err)
+			} else {
+				t.Success(server)
+			}
+		}(s)
+	}
+	wg.Wait()
+}
+
+// check connects backend by TCP or sends HTTP GET if path is configured
+func (t *Checker) check(server string) error {
+	timeout := time.Millisecond * t.config.Timeout
+	if t.config.HealthCheckPath != "" {
+		client := http.Client{Timeout: timeout}
+		resp, err := client.Get(fmt.Sprintf("http://%s/%s", server, strings.TrimPrefix(t.config.HealthCheckPath, "/")))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+			return fmt.Errorf("status code %d", resp.StatusCode)
+		}
+		return nil
+	}
+	conn, err := net.DialTimeout("tcp", server, timeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
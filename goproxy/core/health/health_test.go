@@ -0,0 +1,79 @@
+package health
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shieldoo/shieldoo-mesh/goproxy/config"
+)
+
+func TestCheckerPassive(t *testing.T) {
+	cfg, _ := config.New("tcp", ":0", "a:1,b:1")
+	cfg.HealthCheckInterval = 0
+	cfg.MaxFails = 2
+	cfg.FailTimeout = 50 * time.Millisecond
+	h := New(cfg)
+
+	h.Fail("a:1", errors.New("refused"))
+	if got := h.Healthy(cfg.Servers); len(got) != 2 {
+		t.Errorf("backend is down before max fails: %v", got)
+	}
+	h.Fail("a:1", errors.New("refused"))
+	if got := h.Healthy(cfg.Servers); !reflect.DeepEqual(got, []string{"b:1"}) {
+		t.Errorf("unexpected healthy backends: %v", got)
+	}
+	// all backends down, clients are not refused
+	h.Fail("b:1", errors.New("refused"))
+	h.Fail("b:1", errors.New("refused"))
+	if got := h.Healthy(cfg.Servers); len(got) != 2 {
+		t.Errorf("all backends should be returned when none is up: %v", got)
+	}
+	// without active checks backend is tried again after fail timeout
+	h.Success("b:1")
+	time.Sleep(60 * time.Millisecond)
+	if got := h.Healthy(cfg.Servers); len(got) != 2 {
+		t.Errorf("backend is not retried after fail timeout: %v", got)
+	}
+}
+
+func TestCheckerActive(t *testing.T) {
+	up := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" || !up {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+	live := strings.TrimPrefix(srv.URL, "http://")
+
+	// closed port
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	dead := l.Addr().String()
+	l.Close()
+
+	cfg, _ := config.New("tcp", ":0", live+","+dead)
+	h := New(cfg)
+	h.checkAll()
+	if got := h.Healthy(cfg.Servers); !reflect.DeepEqual(got, []string{live}) {
+		t.Errorf("tcp check: unexpected healthy backends: %v", got)
+	}
+
+	cfg.HealthCheckPath = "health"
+	up = false
+	h.checkAll()
+	if got := h.Healthy(cfg.Servers); len(got) != 2 {
+		t.Errorf("http check: all backends are down, all should be returned: %v", got)
+	}
+	h.Fail(live, errors.New("x"))
+	up = true
+	h.checkAll()
+	if got := h.Healthy(cfg.Servers); !reflect.DeepEqual(got, []string{live}) {
+		t.Errorf("http check: backend did not recover: %v", got)
+	}
+}
@@ -0,0 +1,264 @@
+package httpproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shieldoo/shieldoo-mesh/goproxy/config"
+	"github.com/shieldoo/shieldoo-mesh/goproxy/core/acl"
+	"github.com/shieldoo/shieldoo-mesh/goproxy/core/health"
+	"github.com/shieldoo/shieldoo-mesh/goproxy/core/limit"
+	"github.com/shieldoo/shieldoo-mesh/goproxy/core/scheduler"
+	"github.com/shieldoo/shieldoo-mesh/goproxy/core/server"
+)
+
+const (
+	// headers with identity of client from nebula certificate, values sent by client are removed
+	HeaderCertName   = "X-Nebula-Cert-Name"
+	HeaderCertGroups = "X-Nebula-Cert-Groups"
+)
+
+// HTTP reverse proxy with routing by host and path prefix
+type HTTP struct {
+	config    *config.Config
+	health    *health.Checker
+	limiter   *limit.Limiter
+	load      *scheduler.Load
+	routes    []*route
+	server    *http.Server
+	transport *http.Transport
+	conns     *server.Registry
+	// protects listener, listener is not opened after it was closed
+	lock     sync.Mutex
+	listener net.Listener
+	closed   bool
+}
+
+type route struct {
+	config.Route
+	sched scheduler.Scheduler
+}
+
+type contextKey int
+
+// key of backend chosen for request
+const backendKey contextKey = 0
+
+// New return a new http proxy instance
+func New(config *config.Config, health *health.Checker, limiter *limit.Limiter) *HTTP {
+	t := new(HTTP)
+	t.config = config
+	t.health = health
+	t.limiter = limiter
+	t.load = scheduler.NewLoad(config.Weights)
+	for _, r := range config.Routes {
+		t.routes = append(t.routes, &route{Route: r, sched: scheduler.New(config.Scheduler)})
+	}
+	// the most specific route wins, routes with host first and longer path prefix first
+	sort.SliceStable(t.routes, func(i, j int) bool {
+		if (t.routes[i].Host != "") != (t.routes[j].Host != "") {
+			return t.routes[i].Host != ""
+		}
+		return len(t.routes[i].PathPrefix) > len(t.routes[j].PathPrefix)
+	})
+	t.server = &http.Server{
+		Handler:           t,
+		ReadHeaderTimeout: 30 * time.Second,
+		ErrorLog:          log.New(&logWriter{logger: config.Logger}, "", 0),
+	}
+	t.transport = t.newTransport()
+	t.conns = server.NewRegistry()
+	return t
+}
+
+// Start listen and serve
+func (t *HTTP) Start() {
+	var err error
+	var listener net.Listener
+	for i := 0; i < 16; i++ {
+		listener, err = net.Listen("tcp", t.config.Local)
+		if err != nil {
+			t.config.Logger.Warnf("HTTP.Start attempt(%d) error: %v", i, err)
+			time.Sleep(500 * time.Millisecond)
+		} else {
+			break
+		}
+	}
+	if err != nil {
+		t.config.Logger.Errorf("HTTP.Start error: %v", err)
+		return
+	}
+	listener = &limitListener{Listener: listener, config: t.config, limiter: t.limiter, conns: t.conns}
+	t.lock.Lock()
+	if t.closed {
+		t.lock.Unlock()
+		listener.Close()
+		return
+	}
+	t.listener = listener
+	t.lock.Unlock()
+	if t.config.Protocol == "https" {
+		cert, err := tls.X509KeyPair([]byte(t.config.TLSCert), []byte(t.config.TLSKey))
+		if err != nil {
+			listener.Close()
+			t.config.Logger.Errorf("HTTP.Start certificate error: %v", err)
+			return
+		}
+		listener = tls.NewListener(listener, &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12})
+	}
+	t.config.Logger.Infof("HTTP.Start %v, backends: %v", t.config.Local, t.config.Servers)
+	err = t.server.Serve(listener)
+	if err != nil && err != http.ErrServerClosed && !strings.Contains(err.Error(), server.ErrNetClosing.Error()) {
+		t.config.Logger.Errorf("HTTP.Serve error: %v", err)
+	}
+}
+
+// Stop stop serve and close active connections
+func (t *HTTP) Stop() {
+	t.config.Logger.Infof("HTTP.Stop %v, backends: %v", t.config.Local, t.config.Servers)
+	t.server.Close()
+	t.conns.CloseAll()
+	t.transport.CloseIdleConnections()
+}
+
+// StopAccepting closes listener, port is released immediately and active requests and websockets keep running
+func (t *HTTP) StopAccepting() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.closed = true
+	if t.listener != nil {
+		t.listener.Close()
+	}
+}
+
+// Drain stop accepting and wait for active requests and websockets until timeout
+func (t *HTTP) Drain(timeout time.Duration) {
+	t.config.Logger.Infof("HTTP.Drain %v, active connections: %d", t.config.Local, t.conns.Len())
+	deadline := time.Now().Add(timeout)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	t.StopAccepting()
+	// shutdown closes idle connections but it does not track hijacked websocket connections
+	t.server.Shutdown(ctx)
+	if !t.conns.Wait(time.Until(deadline)) {
+		t.config.Logger.Infof("HTTP.Drain %v timeout, closing connections: %d", t.config.Local, t.conns.Len())
+	}
+	t.Stop()
+}
+
+// match returns route of request
+func (t *HTTP) match(r *http.Request) *route {
+	host := strings.ToLower(r.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	for _, rt := range t.routes {
+		if (rt.Host == "" || rt.Host == host) && matchPath(r.URL.Path, rt.PathPrefix) {
+			return rt
+		}
+	}
+	return nil
+}
+
+// matchPath reports whether path is in prefix on segment boundary, /api matches /api/v1 but not /apiary
+func matchPath(path string, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
+
+func (t *HTTP) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	client, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	if err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	if err := acl.Check(t.config, client); err != nil {
+		t.config.Logger.Infof("HTTP Client is rejected: %v => %v: %v", r.RemoteAddr, t.config.Local, err)
+		t.config.Metrics.SessionRejected()
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	rt := t.match(r)
+	if rt == nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	addr := rt.sched.Schedule(r.RemoteAddr, t.health.Healthy(rt.Servers), t.load)
+	t.load.Inc(addr)
+	defer t.load.Dec(addr)
+	t.config.Logger.Debugf("HTTP %v %v%v => %v", r.Method, r.Host, r.URL.Path, addr)
+	proxy := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme = "http"
+			req.URL.Host = addr
+			// X-Forwarded-For is set by reverse proxy to address of client, value sent by client is removed
+			req.Header.Del("X-Forwarded-For")
+			req.Header.Set("X-Forwarded-Host", r.Host)
+			if r.TLS != nil {
+				req.Header.Set("X-Forwarded-Proto", "https")
+			} else {
+				req.Header.Set("X-Forwarded-Proto", "http")
+			}
+			req.Header.Del(HeaderCertName)
+			req.Header.Del(HeaderCertGroups)
+			if t.config.Identify != nil {
+				if id := t.config.Identify(client); id != nil {
+					req.Header.Set(HeaderCertName, id.Name)
+					req.Header.Set(HeaderCertGroups, strings.Join(id.Groups, ","))
+				}
+			}
+		},
+		Transport: t.transport,
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			if req.Context().Err() == nil {
+				t.config.Logger.Warnf("HTTP connect to the server [%v] fail: %v", addr, err)
+			}
+			w.WriteHeader(http.StatusBadGateway)
+		},
+		ErrorLog: t.server.ErrorLog,
+	}
+	proxy.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), backendKey, addr)))
+}
+
+// newTransport dials backend with timeout of listener and records result for health checks
+func (t *HTTP) newTransport() *http.Transport {
+	dialer := &net.Dialer{Timeout: time.Millisecond * t.config.Timeout}
+	return &http.Transport{
+		DialContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
+			start := time.Now()
+			conn, err := dialer.DialContext(ctx, network, addr)
+			if backend, ok := ctx.Value(backendKey).(string); ok {
+				if err != nil && ctx.Err() == nil {
+					t.config.Metrics.BackendFailed(backend, err)
+					t.health.Fail(backend, err)
+				} else if err == nil {
+					t.config.Metrics.BackendDialed(backend, time.Since(start))
+					t.health.Success(backend)
+				}
+			}
+			return conn, err
+		},
+		MaxIdleConnsPerHost: 16,
+		IdleConnTimeout:     90 * time.Second,
+	}
+}
+
+// logWriter passes messages of http server and reverse proxy to logger, they are mostly client errors
+type logWriter struct {
+	logger config.Logger
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	w.logger.Debugf("HTTP %s", strings.TrimSuffix(string(p), "\n"))
+	return len(p), nil
+}
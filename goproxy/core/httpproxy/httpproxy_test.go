@@ -0,0 +1,304 @@
+package httpproxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/shieldoo/shieldoo-mesh/goproxy/config"
+	"github.com/shieldoo/shieldoo-mesh/goproxy/core/health"
+	"github.com/shieldoo/shieldoo-mesh/goproxy/core/limit"
+)
+
+func testFreeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// testBackend answers with its name and received identity headers
+func testBackend(name string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s %s|%s|%s|%s", name, r.URL.Path, r.Header.Get(HeaderCertName), r.Header.Get(HeaderCertGroups),
+			r.Header.Get("X-Forwarded-Proto"), r.Header.Get("X-Forwarded-For"))
+	}))
+}
+
+func testStart(t *testing.T, cfg *config.Config) *HTTP {
+	p := New(cfg, health.New(cfg), limit.New(cfg.Limits))
+	go p.Start()
+	for i := 0; i < 50; i++ {
+		if c, err := net.Dial("tcp", cfg.Local); err == nil {
+			c.Close()
+			return p
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("proxy is not listening")
+	return nil
+}
+
+func testGet(t *testing.T, client *http.Client, url string, host string) (int, string) {
+	req, _ := http.NewRequest("GET", url, nil)
+	req.Host = host
+	req.Header.Set(HeaderCertName, "spoofed")
+	req.Header.Set("X-Forwarded-For", "10.1.1.1")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+func TestHTTPRouting(t *testing.T) {
+	def := testBackend("default")
+	defer def.Close()
+	api := testBackend("api")
+	defer api.Close()
+	app := testBackend("app")
+	defer app.Close()
+
+	local := testFreeAddr(t)
+	cfg, err := config.New("http", local, def.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.AddRoute("", "/api/", api.Listener.Addr().String())
+	cfg.AddRoute("", "/app", api.Listener.Addr().String())
+	cfg.AddRoute("App.Example.com", "", app.Listener.Addr().String())
+	if len(cfg.Servers) != 3 || cfg.HealthCheckInterval == 0 {
+		t.Fatalf("servers of routes are not configured: %v", cfg)
+	}
+	cfg.HealthCheckInterval = 0
+	cfg.Identify = func(addr net.Addr) *config.Identity {
+		return &config.Identity{Name: "laptop", Groups: []string{"dev", "ops"}}
+	}
+	p := testStart(t, cfg)
+	defer p.Stop()
+
+	tests := []struct {
+		host string
+		path string
+		want string
+	}{
+		{"other.example.com", "/", "default /"},
+		{"other.example.com", "/api/v1", "api /api/v1"},
+		{"other.example.com", "/app", "api /app"},
+		{"other.example.com", "/app/x", "api /app/x"},
+		{"other.example.com", "/apple", "default /apple"},
+		{"app.example.com:8080", "/api/v1", "app /api/v1"},
+		{"app.example.com", "/index.html", "app /index.html"},
+	}
+	for _, tt := range tests {
+		code, body := testGet(t, http.DefaultClient, "http://"+local+tt.path, tt.host)
+		if code != http.StatusOK || !strings.HasPrefix(body, tt.want+" ") {
+			t.Errorf("%s%s: unexpected response %d %q", tt.host, tt.path, code, body)
+		}
+		if !strings.HasSuffix(body, " laptop|dev,ops|http|127.0.0.1") {
+			t.Errorf("%s%s: unexpected headers %q", tt.host, tt.path, body)
+		}
+	}
+}
+
+func TestHTTPNoRouteAndDeadBackend(t *testing.T) {
+	dead := testFreeAddr(t)
+	local := testFreeAddr(t)
+	cfg, _ := config.New("http", local, "")
+	cfg.AddRoute("", "/api/", dead)
+	p := testStart(t, cfg)
+	defer p.Stop()
+
+	if code, _ := testGet(t, http.DefaultClient, "http://"+local+"/", "x"); code != http.StatusNotFound {
+		t.Errorf("expected not found, got %d", code)
+	}
+	if code, _ := testGet(t, http.DefaultClient, "http://"+local+"/api/", "x"); code != http.StatusBadGateway {
+		t.Errorf("expected bad gateway, got %d", code)
+	}
+}
+
+func TestHTTPAccessDenied(t *testing.T) {
+	def := testBackend("default")
+	defer def.Close()
+	local := testFreeAddr(t)
+	cfg, _ := config.New("http", local, def.Listener.Addr().String())
+	cfg.AllowedGroups = []string{"admins"}
+	cfg.Identify = func(addr net.Addr) *config.Identity {
+		return &config.Identity{Name: "laptop", Groups: []string{"dev"}}
+	}
+	p := testStart(t, cfg)
+	defer p.Stop()
+
+	if code, _ := testGet(t, http.DefaultClient, "http://"+local+"/", "x"); code != http.StatusForbidden {
+		t.Errorf("expected forbidden, got %d", code)
+	}
+}
+
+func TestHTTPWebsocket(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		for {
+			mt, msg, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			c.WriteMessage(mt, append([]byte(r.Header.Get(HeaderCertName)+":"), msg...))
+		}
+	}))
+	defer backend.Close()
+
+	local := testFreeAddr(t)
+	cfg, _ := config.New("http", local, backend.Listener.Addr().String())
+	cfg.Identify = func(addr net.Addr) *config.Identity {
+		return &config.Identity{Name: "laptop"}
+	}
+	p := testStart(t, cfg)
+	defer p.Stop()
+
+	c, _, err := websocket.DefaultDialer.Dial("ws://"+local+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for i := 0; i < 3; i++ {
+		if err := c.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		_, msg, err := c.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(msg) != "laptop:hello" {
+			t.Fatalf("unexpected message %q", msg)
+		}
+	}
+}
+
+func testCertificate(t *testing.T) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kder, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kder}))
+}
+
+func TestHTTPS(t *testing.T) {
+	def := testBackend("default")
+	defer def.Close()
+	local := testFreeAddr(t)
+	cfg, _ := config.New("https", local, def.Listener.Addr().String())
+	cfg.TLSCert, cfg.TLSKey = testCertificate(t)
+	p := testStart(t, cfg)
+	defer p.Stop()
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	code, body := testGet(t, client, "https://"+local+"/", "x")
+	if code != http.StatusOK || body != "default / ||https|127.0.0.1" {
+		t.Errorf("unexpected response %d %q", code, body)
+	}
+}
+
+func TestHTTPConnectionLimit(t *testing.T) {
+	def := testBackend("default")
+	defer def.Close()
+	local := testFreeAddr(t)
+	cfg, _ := config.New("http", local, def.Listener.Addr().String())
+	cfg.Limits.MaxConnections = 1
+	p := testStart(t, cfg)
+	defer p.Stop()
+	// probe connection of testStart must be released first
+	for i := 0; i < 50 && (p.limiter.Metrics().Accepted == 0 || p.limiter.Metrics().Active > 0); i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// first connection is kept open by keep-alive, second one is refused
+	first := &http.Client{Transport: &http.Transport{}}
+	if code, _ := testGet(t, first, "http://"+local+"/", "x"); code != http.StatusOK {
+		t.Fatalf("unexpected status %d", code)
+	}
+	second := &http.Client{Transport: &http.Transport{}}
+	req, _ := http.NewRequest("GET", "http://"+local+"/", nil)
+	if resp, err := second.Do(req); err == nil {
+		resp.Body.Close()
+		t.Errorf("connection over limit is accepted")
+	}
+	if m := p.limiter.Metrics(); m.RejectedConnections == 0 {
+		t.Errorf("rejected connection is not counted: %+v", m)
+	}
+}
+
+func TestHTTPStopClosesWebsocket(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		for {
+			if _, _, err := c.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	defer backend.Close()
+
+	local := testFreeAddr(t)
+	cfg, _ := config.New("http", local, backend.Listener.Addr().String())
+	p := testStart(t, cfg)
+
+	c, _, err := websocket.DefaultDialer.Dial("ws://"+local+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	start := time.Now()
+	p.Drain(200 * time.Millisecond)
+	if time.Since(start) > 2*time.Second {
+		t.Errorf("drain exceeded deadline: %v", time.Since(start))
+	}
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, _, err = c.ReadMessage()
+	if ne, ok := err.(net.Error); err == nil || ok && ne.Timeout() {
+		t.Errorf("websocket is not closed after drain deadline: %v", err)
+	}
+}
@@ -0,0 +1,76 @@
+package httpproxy
+
+import (
+	"net"
+	"sync"
+
+	"github.com/shieldoo/shieldoo-mesh/goproxy/config"
+	"github.com/shieldoo/shieldoo-mesh/goproxy/core/limit"
+	"github.com/shieldoo/shieldoo-mesh/goproxy/core/server"
+)
+
+// limitListener enforces connection limits on accept and bandwidth limits on connections,
+// connections are registered so hijacked websocket connections are closed on stop too
+type limitListener struct {
+	net.Listener
+	config  *config.Config
+	limiter *limit.Limiter
+	conns   *server.Registry
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		key := limit.Source(conn.RemoteAddr())
+		if err := l.limiter.Acquire(key); err != nil {
+			l.config.Logger.Debugf("HTTP Client is rejected: %v => %v: %v", conn.RemoteAddr(), conn.LocalAddr(), err)
+			conn.Close()
+			continue
+		}
+		c := &limitConn{Conn: conn, config: l.config, limiter: l.limiter, conns: l.conns, key: key}
+		if !l.conns.Add(c) {
+			conn.Close()
+			l.limiter.Release(key)
+			continue
+		}
+		l.config.Metrics.SessionOpened()
+		return c, nil
+	}
+}
+
+type limitConn struct {
+	net.Conn
+	config  *config.Config
+	limiter *limit.Limiter
+	conns   *server.Registry
+	key     string
+	once    sync.Once
+}
+
+func (c *limitConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.limiter.Throttle(c.key, n)
+		c.config.Metrics.BytesIn(n)
+	}
+	return n, err
+}
+
+func (c *limitConn) Write(p []byte) (int, error) {
+	c.limiter.Throttle(c.key, len(p))
+	n, err := c.Conn.Write(p)
+	c.config.Metrics.BytesOut(n)
+	return n, err
+}
+
+func (c *limitConn) Close() error {
+	c.once.Do(func() {
+		c.conns.Remove(c)
+		c.limiter.Release(c.key)
+		c.config.Metrics.SessionClosed()
+	})
+	return c.Conn.Close()
+}
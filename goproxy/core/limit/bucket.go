@@ -0,0 +1,63 @@
+package limit
+
+import (
+	"time"
+)
+
+// smallest bandwidth burst, one read of io.Copy buffer fits into it
+const minBandwidthBurst = 32 * 1024
+
+// bucket is token bucket, nil bucket is unlimited
+type bucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(rate float64, burst float64) *bucket {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &bucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+func bandwidthBurst(rate int64) float64 {
+	if rate < minBandwidthBurst {
+		return minBandwidthBurst
+	}
+	return float64(rate)
+}
+
+func (b *bucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// available returns true if n tokens can be taken without waiting
+func (b *bucket) available(n float64, now time.Time) bool {
+	if b == nil {
+		return true
+	}
+	b.refill(now)
+	return b.tokens >= n
+}
+
+// take takes n tokens and returns time to wait until they are paid, bucket can go into debt
+func (b *bucket) take(n float64, now time.Time) time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.refill(now)
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
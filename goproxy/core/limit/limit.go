@@ -0,0 +1,210 @@
+package limit
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/shieldoo/shieldoo-mesh/goproxy/config"
+)
+
+// state of idle source is forgotten after this time
+const sourceIdleTimeout = time.Minute
+
+var (
+	ErrConnections = errors.New("connection limit reached")
+	ErrRate        = errors.New("connection rate limit reached")
+)
+
+// Metrics of limits enforcement since start of listener
+type Metrics struct {
+	Accepted            uint64
+	RejectedConnections uint64
+	RejectedRate        uint64
+	// UDP packets dropped by bandwidth limit
+	DroppedPackets uint64
+	// time spent by waiting for bandwidth limit
+	ThrottledNanos uint64
+	Active         int64
+}
+
+// Limiter enforces limits of connections and bandwidth of listener and of every source IP
+type Limiter struct {
+	// accessed atomically, first in struct because of 64-bit alignment on 32-bit platforms
+	metrics Metrics
+	limits  config.Limits
+	lock    sync.Mutex
+	active  int
+	rate    *bucket
+	bw      *bucket
+	sources map[string]*source
+	lastGC  time.Time
+}
+
+type source struct {
+	active int
+	rate   *bucket
+	bw     *bucket
+	last   time.Time
+}
+
+// New return a new limiter of listener
+func New(limits config.Limits) *Limiter {
+	t := new(Limiter)
+	t.limits = limits
+	t.rate = newBucket(limits.ConnectionRate, limits.ConnectionRate)
+	t.bw = newBucket(float64(limits.Bandwidth), bandwidthBurst(limits.Bandwidth))
+	t.sources = make(map[string]*source)
+	t.lastGC = time.Now()
+	return t
+}
+
+// Source returns key of source for limits, it is IP address of client
+func Source(addr net.Addr) string {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP.String()
+	case *net.UDPAddr:
+		return a.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// source must be called with lock held
+func (t *Limiter) source(key string, now time.Time) *source {
+	s, ok := t.sources[key]
+	if !ok {
+		s = &source{
+			rate: newBucket(t.limits.ConnectionRatePerSource, t.limits.ConnectionRatePerSource),
+			bw:   newBucket(float64(t.limits.BandwidthPerSource), bandwidthBurst(t.limits.BandwidthPerSource)),
+		}
+		t.sources[key] = s
+	}
+	s.last = now
+	// idle sources are not kept forever, state is kept for a while so reconnecting does not reset rate limit
+	if now.Sub(t.lastGC) > sourceIdleTimeout {
+		t.lastGC = now
+		for k, v := range t.sources {
+			if v.active == 0 && now.Sub(v.last) > sourceIdleTimeout {
+				delete(t.sources, k)
+			}
+		}
+	}
+	return s
+}
+
+// Acquire reserves new connection of source, Release must be called when connection is closed
+func (t *Limiter) Acquire(key string) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	now := time.Now()
+	s := t.source(key, now)
+	if (t.limits.MaxConnections > 0 && t.active >= t.limits.MaxConnections) ||
+		(t.limits.MaxConnectionsPerSource > 0 && s.active >= t.limits.MaxConnectionsPerSource) {
+		atomic.AddUint64(&t.metrics.RejectedConnections, 1)
+		return ErrConnections
+	}
+	if !s.rate.available(1, now) || !t.rate.available(1, now) {
+		atomic.AddUint64(&t.metrics.RejectedRate, 1)
+		return ErrRate
+	}
+	s.rate.take(1, now)
+	t.rate.take(1, now)
+	s.active++
+	t.active++
+	atomic.AddUint64(&t.metrics.Accepted, 1)
+	atomic.AddInt64(&t.metrics.Active, 1)
+	return nil
+}
+
+// Release frees connection of source
+func (t *Limiter) Release(key string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if s, ok := t.sources[key]; ok && s.active > 0 {
+		s.active--
+		s.last = time.Now()
+	}
+	if t.active > 0 {
+		t.active--
+		atomic.AddInt64(&t.metrics.Active, -1)
+	}
+}
+
+// Throttle waits until n bytes of source fit into bandwidth limits
+func (t *Limiter) Throttle(key string, n int) {
+	if t.limits.Bandwidth <= 0 && t.limits.BandwidthPerSource <= 0 {
+		return
+	}
+	t.lock.Lock()
+	now := time.Now()
+	s := t.source(key, now)
+	wait := t.bw.take(float64(n), now)
+	if w := s.bw.take(float64(n), now); w > wait {
+		wait = w
+	}
+	t.lock.Unlock()
+	if wait > 0 {
+		atomic.AddUint64(&t.metrics.ThrottledNanos, uint64(wait))
+		time.Sleep(wait)
+	}
+}
+
+// Allow returns true if packet of n bytes fits into bandwidth limits, packets which do not fit are dropped
+func (t *Limiter) Allow(key string, n int) bool {
+	if t.limits.Bandwidth <= 0 && t.limits.BandwidthPerSource <= 0 {
+		return true
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	now := time.Now()
+	s := t.source(key, now)
+	if !t.bw.available(float64(n), now) || !s.bw.available(float64(n), now) {
+		atomic.AddUint64(&t.metrics.DroppedPackets, 1)
+		return false
+	}
+	t.bw.take(float64(n), now)
+	s.bw.take(float64(n), now)
+	return true
+}
+
+// Reader returns reader throttled by bandwidth limits of source
+func (t *Limiter) Reader(r io.Reader, key string) io.Reader {
+	if t.limits.Bandwidth <= 0 && t.limits.BandwidthPerSource <= 0 {
+		return r
+	}
+	return &reader{r: r, limiter: t, key: key}
+}
+
+type reader struct {
+	r       io.Reader
+	limiter *Limiter
+	key     string
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.limiter.Throttle(r.key, n)
+	}
+	return n, err
+}
+
+// Metrics returns copy of counters
+func (t *Limiter) Metrics() Metrics {
+	return Metrics{
+		Accepted:            atomic.LoadUint64(&t.metrics.Accepted),
+		RejectedConnections: atomic.LoadUint64(&t.metrics.RejectedConnections),
+		RejectedRate:        atomic.LoadUint64(&t.metrics.RejectedRate),
+		DroppedPackets:      atomic.LoadUint64(&t.metrics.DroppedPackets),
+		ThrottledNanos:      atomic.LoadUint64(&t.metrics.ThrottledNanos),
+		Active:              atomic.LoadInt64(&t.metrics.Active),
+	}
+}
@@ -0,0 +1,107 @@
+package limit
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/shieldoo/shieldoo-mesh/goproxy/config"
+)
+
+func TestSource(t *testing.T) {
+	if s := Source(&net.TCPAddr{IP: net.ParseIP("100.64.0.2"), Port: 4000}); s != "100.64.0.2" {
+		t.Errorf("unexpected source %s", s)
+	}
+	if s := Source(&net.UDPAddr{IP: net.ParseIP("fd00::2"), Port: 4000}); s != "fd00::2" {
+		t.Errorf("unexpected source %s", s)
+	}
+}
+
+func TestConnections(t *testing.T) {
+	l := New(config.Limits{MaxConnections: 3, MaxConnectionsPerSource: 2})
+	for i, expected := range []error{nil, nil, ErrConnections} {
+		if err := l.Acquire("a"); err != expected {
+			t.Errorf("connection %d of a: %v, expected %v", i, err, expected)
+		}
+	}
+	// other source is limited by listener limit
+	if err := l.Acquire("b"); err != nil {
+		t.Error(err)
+	}
+	if err := l.Acquire("c"); err != ErrConnections {
+		t.Errorf("listener limit is not enforced: %v", err)
+	}
+	l.Release("a")
+	if err := l.Acquire("c"); err != nil {
+		t.Errorf("released connection is not available: %v", err)
+	}
+	m := l.Metrics()
+	if m.Accepted != 4 || m.RejectedConnections != 2 || m.Active != 3 {
+		t.Errorf("unexpected metrics %+v", m)
+	}
+}
+
+func TestRate(t *testing.T) {
+	l := New(config.Limits{ConnectionRatePerSource: 5})
+	accepted := 0
+	for i := 0; i < 20; i++ {
+		if l.Acquire("a") == nil {
+			accepted++
+			l.Release("a")
+		}
+	}
+	if accepted != 5 {
+		t.Errorf("burst of %d connections accepted, expected 5", accepted)
+	}
+	// other sources have own rate
+	if err := l.Acquire("b"); err != nil {
+		t.Error(err)
+	}
+	time.Sleep(250 * time.Millisecond)
+	if err := l.Acquire("a"); err != nil {
+		t.Errorf("rate is not refilled: %v", err)
+	}
+	if m := l.Metrics(); m.RejectedRate != 15 {
+		t.Errorf("unexpected metrics %+v", m)
+	}
+}
+
+func TestBandwidth(t *testing.T) {
+	// 64 kB burst and 64 kB/s, 192 kB takes about 2 seconds
+	l := New(config.Limits{BandwidthPerSource: 64 * 1024})
+	start := time.Now()
+	n, err := io.Copy(io.Discard, l.Reader(bytes.NewReader(make([]byte, 192*1024)), "a"))
+	if err != nil || n != 192*1024 {
+		t.Fatal(n, err)
+	}
+	if d := time.Since(start); d < 1500*time.Millisecond || d > 3*time.Second {
+		t.Errorf("copy took %v, expected about 2s", d)
+	}
+	if l.Metrics().ThrottledNanos == 0 {
+		t.Error("throttling is not recorded")
+	}
+	// unlimited listener does not wrap reader
+	r := bytes.NewReader(nil)
+	if New(config.Limits{}).Reader(r, "a") != r {
+		t.Error("reader of unlimited listener is wrapped")
+	}
+}
+
+func TestAllow(t *testing.T) {
+	l := New(config.Limits{Bandwidth: 1000})
+	// burst is at least 32 kB
+	sent := 0
+	for i := 0; i < 100; i++ {
+		if l.Allow("a", 1000) {
+			sent++
+		}
+	}
+	if sent != 32 {
+		t.Errorf("%d packets allowed, expected 32", sent)
+	}
+	if m := l.Metrics(); m.DroppedPackets != 68 {
+		t.Errorf("unexpected metrics %+v", m)
+	}
+}
@@ -0,0 +1,153 @@
+package metrics
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Sink receives events of one listener, implementation must be safe for concurrent use
+type Sink interface {
+	// session is TCP connection, UDP flow or HTTP connection of client
+	SessionOpened()
+	SessionClosed()
+	// client refused by access control
+	SessionRejected()
+	// bytes received from clients and sent to clients
+	BytesIn(n int)
+	BytesOut(n int)
+	// connection to backend, latency is time of TCP connect
+	BackendDialed(backend string, latency time.Duration)
+	BackendFailed(backend string, err error)
+}
+
+// Nop sink ignores all events
+type Nop struct{}
+
+func (Nop) SessionOpened()                      {}
+func (Nop) SessionClosed()                      {}
+func (Nop) SessionRejected()                    {}
+func (Nop) BytesIn(int)                         {}
+func (Nop) BytesOut(int)                        {}
+func (Nop) BackendDialed(string, time.Duration) {}
+func (Nop) BackendFailed(string, error)         {}
+
+// Collector keeps counters of listener in memory
+type Collector struct {
+	// accessed atomically, first in struct because of 64-bit alignment on 32-bit platforms
+	sessions   uint64
+	active     int64
+	rejected   uint64
+	bytesIn    uint64
+	bytesOut   uint64
+	dialErrors uint64
+	lock       sync.Mutex
+	backends   map[string]*backend
+}
+
+type backend struct {
+	dials      uint64
+	dialErrors uint64
+	latency    time.Duration
+	maxLatency time.Duration
+}
+
+// Snapshot of listener counters
+type Snapshot struct {
+	Sessions   uint64
+	Active     int64
+	Rejected   uint64
+	BytesIn    uint64
+	BytesOut   uint64
+	DialErrors uint64
+	Backends   []BackendSnapshot
+}
+
+// BackendSnapshot of backend counters, average latency is computed from successful dials
+type BackendSnapshot struct {
+	Address    string
+	Dials      uint64
+	DialErrors uint64
+	AvgLatency time.Duration
+	MaxLatency time.Duration
+}
+
+// New return a new empty collector
+func New() *Collector {
+	t := new(Collector)
+	t.backends = make(map[string]*backend)
+	return t
+}
+
+func (t *Collector) SessionOpened() {
+	atomic.AddUint64(&t.sessions, 1)
+	atomic.AddInt64(&t.active, 1)
+}
+
+func (t *Collector) SessionClosed() {
+	atomic.AddInt64(&t.active, -1)
+}
+
+func (t *Collector) SessionRejected() {
+	atomic.AddUint64(&t.rejected, 1)
+}
+
+func (t *Collector) BytesIn(n int) {
+	atomic.AddUint64(&t.bytesIn, uint64(n))
+}
+
+func (t *Collector) BytesOut(n int) {
+	atomic.AddUint64(&t.bytesOut, uint64(n))
+}
+
+func (t *Collector) BackendDialed(server string, latency time.Duration) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	b := t.backend(server)
+	b.dials++
+	b.latency += latency
+	if latency > b.maxLatency {
+		b.maxLatency = latency
+	}
+}
+
+func (t *Collector) BackendFailed(server string, err error) {
+	atomic.AddUint64(&t.dialErrors, 1)
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.backend(server).dialErrors++
+}
+
+// backend must be called with lock held
+func (t *Collector) backend(server string) *backend {
+	b, ok := t.backends[server]
+	if !ok {
+		b = &backend{}
+		t.backends[server] = b
+	}
+	return b
+}
+
+// Snapshot returns copy of counters, backends are sorted by address
+func (t *Collector) Snapshot() Snapshot {
+	ret := Snapshot{
+		Sessions:   atomic.LoadUint64(&t.sessions),
+		Active:     atomic.LoadInt64(&t.active),
+		Rejected:   atomic.LoadUint64(&t.rejected),
+		BytesIn:    atomic.LoadUint64(&t.bytesIn),
+		BytesOut:   atomic.LoadUint64(&t.bytesOut),
+		DialErrors: atomic.LoadUint64(&t.dialErrors),
+	}
+	t.lock.Lock()
+	for k, v := range t.backends {
+		b := BackendSnapshot{Address: k, Dials: v.dials, DialErrors: v.dialErrors, MaxLatency: v.maxLatency}
+		if v.dials > 0 {
+			b.AvgLatency = v.latency / time.Duration(v.dials)
+		}
+		ret.Backends = append(ret.Backends, b)
+	}
+	t.lock.Unlock()
+	sort.Slice(ret.Backends, func(i, j int) bool { return ret.Backends[i].Address < ret.Backends[j].Address })
+	return ret
+}
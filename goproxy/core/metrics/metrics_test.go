@@ -0,0 +1,33 @@
+package metrics
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCollector(t *testing.T) {
+	c := New()
+	c.SessionOpened()
+	c.SessionOpened()
+	c.SessionClosed()
+	c.SessionRejected()
+	c.BytesIn(100)
+	c.BytesOut(50)
+	c.BytesOut(25)
+	c.BackendDialed("b:1", 10*time.Millisecond)
+	c.BackendDialed("b:1", 30*time.Millisecond)
+	c.BackendFailed("a:1", errors.New("refused"))
+
+	s := c.Snapshot()
+	if s.Sessions != 2 || s.Active != 1 || s.Rejected != 1 || s.BytesIn != 100 || s.BytesOut != 75 || s.DialErrors != 1 {
+		t.Errorf("unexpected counters: %+v", s)
+	}
+	if len(s.Backends) != 2 || s.Backends[0].Address != "a:1" || s.Backends[0].DialErrors != 1 {
+		t.Fatalf("unexpected backends: %+v", s.Backends)
+	}
+	b := s.Backends[1]
+	if b.Dials != 2 || b.AvgLatency != 20*time.Millisecond || b.MaxLatency != 30*time.Millisecond {
+		t.Errorf("unexpected latency: %+v", b)
+	}
+}
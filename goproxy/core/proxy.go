@@ -1,9 +1,13 @@
 package core
 
 import (
-	"log"
+	"time"
 
 	"github.com/shieldoo/shieldoo-mesh/goproxy/config"
+	"github.com/shieldoo/shieldoo-mesh/goproxy/core/health"
+	"github.com/shieldoo/shieldoo-mesh/goproxy/core/httpproxy"
+	"github.com/shieldoo/shieldoo-mesh/goproxy/core/limit"
+	"github.com/shieldoo/shieldoo-mesh/goproxy/core/metrics"
 	"github.com/shieldoo/shieldoo-mesh/goproxy/core/server"
 	"github.com/shieldoo/shieldoo-mesh/goproxy/core/tcp"
 	"github.com/shieldoo/shieldoo-mesh/goproxy/core/udp"
@@ -13,35 +17,79 @@ import (
 type Proxy struct {
 	Config   *config.Config
 	Shutdown chan struct{}
+	limiter  *limit.Limiter
+	drain    chan time.Duration
+	released chan struct{}
+	stopped  chan struct{}
 }
 
-// Create a new proxy instance
-func New(config *config.Config) *Proxy {
+// Create a new proxy instance, logger and metrics sink are taken from config
+func New(cfg *config.Config) *Proxy {
+	if cfg.Logger == nil {
+		cfg.Logger = &config.StdLogger{Config: cfg}
+	}
+	if cfg.Metrics == nil {
+		cfg.Metrics = metrics.Nop{}
+	}
 	t := new(Proxy)
-	t.Config = config
+	t.Config = cfg
 	t.Shutdown = make(chan struct{})
+	t.drain = make(chan time.Duration)
+	t.released = make(chan struct{})
+	t.stopped = make(chan struct{})
+	t.limiter = limit.New(cfg.Limits)
 	return t
 }
 
+// LimitMetrics returns counters of connection and bandwidth limits enforcement
+func (t *Proxy) LimitMetrics() limit.Metrics {
+	return t.limiter.Metrics()
+}
+
 // Start service
 func (t *Proxy) Start() {
 	var s server.Server
+	h := health.New(t.Config)
 	switch t.Config.Protocol {
 	case "tcp":
-		s = tcp.New(t.Config)
+		s = tcp.New(t.Config, h, t.limiter)
 	case "udp":
-		s = udp.New(t.Config)
+		s = udp.New(t.Config, h, t.limiter)
+	case "http", "https":
+		s = httpproxy.New(t.Config, h, t.limiter)
 	}
+	h.Start()
 	go s.Start()
 
-	<-t.Shutdown
-	s.Stop()
-	log.Println("proxy stopped")
+	select {
+	case <-t.Shutdown:
+		s.Stop()
+	case timeout := <-t.drain:
+		s.StopAccepting()
+		close(t.released)
+		s.Drain(timeout)
+	}
+	h.Stop()
+	close(t.stopped)
+	t.Config.Logger.Infof("proxy stopped")
 }
 
-// Stop
+// Stop closes listener and active sessions immediately
 func (t *Proxy) Stop() {
 	t.Shutdown <- struct{}{}
+	<-t.stopped
+}
+
+// Drain stops accepting new sessions and returns, active sessions are drained in background until
+// drain timeout of config and remaining sessions are closed then, Wait waits for it
+func (t *Proxy) Drain() {
+	t.drain <- t.Config.DrainTimeout
+	<-t.released
+}
+
+// Wait waits until proxy is stopped
+func (t *Proxy) Wait() {
+	<-t.stopped
 }
 
 // monitor Listening system signal, restart or stop service
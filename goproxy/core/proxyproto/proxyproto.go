@@ -0,0 +1,109 @@
+package proxyproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+const (
+	// versions of PROXY protocol header
+	Version1 = 1
+	Version2 = 2
+
+	// TLV with nebula certificate name of client, custom type range PP2_TYPE_MIN_CUSTOM .. PP2_TYPE_MAX_CUSTOM
+	TypeNebulaCertName byte = 0xE0
+)
+
+// Signature of version 2 header
+var Signature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+// TLV is type-length-value extension of version 2 header
+type TLV struct {
+	Type  byte
+	Value []byte
+}
+
+// Header returns PROXY protocol header of given version for TCP connection from src to dst,
+// TLVs are used only in version 2
+func Header(version int, src net.Addr, dst net.Addr, tlvs []TLV) ([]byte, error) {
+	switch version {
+	case Version1:
+		return HeaderV1(src, dst), nil
+	case Version2:
+		return HeaderV2(src, dst, tlvs)
+	}
+	return nil, fmt.Errorf("unsupported PROXY protocol version: %d", version)
+}
+
+// addrs returns TCP addresses of the same family, IPv4 is mapped to IPv6 if families differ
+func addrs(src net.Addr, dst net.Addr) (*net.TCPAddr, *net.TCPAddr, bool) {
+	s, ok1 := src.(*net.TCPAddr)
+	d, ok2 := dst.(*net.TCPAddr)
+	if !ok1 || !ok2 {
+		return nil, nil, false
+	}
+	if s.IP.To4() != nil && d.IP.To4() != nil {
+		return &net.TCPAddr{IP: s.IP.To4(), Port: s.Port}, &net.TCPAddr{IP: d.IP.To4(), Port: d.Port}, true
+	}
+	return &net.TCPAddr{IP: s.IP.To16(), Port: s.Port}, &net.TCPAddr{IP: d.IP.To16(), Port: d.Port}, true
+}
+
+// HeaderV1 returns human-readable header, e.g. "PROXY TCP4 10.0.0.1 10.0.0.2 50000 443\r\n"
+func HeaderV1(src net.Addr, dst net.Addr) []byte {
+	s, d, ok := addrs(src, dst)
+	if !ok {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	if len(s.IP) == net.IPv4len {
+		return []byte(fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", s.IP, d.IP, s.Port, d.Port))
+	}
+	return []byte(fmt.Sprintf("PROXY TCP6 %s %s %d %d\r\n", ipv6String(s.IP), ipv6String(d.IP), s.Port, d.Port))
+}
+
+// ipv6String formats also IPv4-mapped address in IPv6 notation
+func ipv6String(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return "::ffff:" + ip4.String()
+	}
+	return ip.String()
+}
+
+// HeaderV2 returns binary header with TLVs
+func HeaderV2(src net.Addr, dst net.Addr, tlvs []TLV) ([]byte, error) {
+	var body bytes.Buffer
+	// version 2, command PROXY
+	verCmd := byte(0x21)
+	// unspecified family and protocol
+	fam := byte(0x00)
+	if s, d, ok := addrs(src, dst); ok {
+		if len(s.IP) == net.IPv4len {
+			// TCP over IPv4
+			fam = 0x11
+		} else {
+			// TCP over IPv6
+			fam = 0x21
+		}
+		body.Write(s.IP)
+		body.Write(d.IP)
+		binary.Write(&body, binary.BigEndian, uint16(s.Port))
+		binary.Write(&body, binary.BigEndian, uint16(d.Port))
+	}
+	for _, tlv := range tlvs {
+		if len(tlv.Value) > 0xFFFF {
+			return nil, fmt.Errorf("TLV 0x%02x is too long", tlv.Type)
+		}
+		body.WriteByte(tlv.Type)
+		binary.Write(&body, binary.BigEndian, uint16(len(tlv.Value)))
+		body.Write(tlv.Value)
+	}
+	if body.Len() > 0xFFFF {
+		return nil, fmt.Errorf("PROXY protocol header is too long")
+	}
+	ret := make([]byte, 0, 16+body.Len())
+	ret = append(ret, Signature...)
+	ret = append(ret, verCmd, fam)
+	ret = binary.BigEndian.AppendUint16(ret, uint16(body.Len()))
+	return append(ret, body.Bytes()...), nil
+}
@@ -0,0 +1,56 @@
+package proxyproto
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestHeaderV1(t *testing.T) {
+	tests := []struct {
+		src, dst net.Addr
+		expected string
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("100.64.0.5"), Port: 50000}, &net.TCPAddr{IP: net.ParseIP("100.64.0.1"), Port: 443}, "PROXY TCP4 100.64.0.5 100.64.0.1 50000 443\r\n"},
+		{&net.TCPAddr{IP: net.ParseIP("fd00::5"), Port: 50000}, &net.TCPAddr{IP: net.ParseIP("fd00::1"), Port: 443}, "PROXY TCP6 fd00::5 fd00::1 50000 443\r\n"},
+		{&net.TCPAddr{IP: net.ParseIP("100.64.0.5"), Port: 50000}, &net.TCPAddr{IP: net.ParseIP("fd00::1"), Port: 443}, "PROXY TCP6 ::ffff:100.64.0.5 fd00::1 50000 443\r\n"},
+		{&net.UDPAddr{IP: net.ParseIP("100.64.0.5"), Port: 50000}, &net.UDPAddr{IP: net.ParseIP("100.64.0.1"), Port: 443}, "PROXY UNKNOWN\r\n"},
+	}
+	for _, tt := range tests {
+		if got := string(HeaderV1(tt.src, tt.dst)); got != tt.expected {
+			t.Errorf("got %q, expected %q", got, tt.expected)
+		}
+	}
+}
+
+func TestHeaderV2(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("100.64.0.5"), Port: 50000}
+	dst := &net.TCPAddr{IP: net.ParseIP("100.64.0.1"), Port: 443}
+	h, err := HeaderV2(src, dst, []TLV{{Type: TypeNebulaCertName, Value: []byte("john@example.com")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := append([]byte{}, Signature...)
+	expected = append(expected, 0x21, 0x11, 0x00, 12+3+16)
+	expected = append(expected, 100, 64, 0, 5, 100, 64, 0, 1, 0xC3, 0x50, 0x01, 0xBB)
+	expected = append(expected, TypeNebulaCertName, 0x00, 16)
+	expected = append(expected, []byte("john@example.com")...)
+	if !bytes.Equal(h, expected) {
+		t.Errorf("got %x, expected %x", h, expected)
+	}
+
+	h, _ = HeaderV2(&net.TCPAddr{IP: net.ParseIP("fd00::5"), Port: 1}, &net.TCPAddr{IP: net.ParseIP("fd00::1"), Port: 2}, nil)
+	if len(h) != 16+36 || h[13] != 0x21 {
+		t.Errorf("unexpected IPv6 header %x", h)
+	}
+	h, _ = HeaderV2(&net.UDPAddr{}, &net.UDPAddr{}, nil)
+	if len(h) != 16 || h[13] != 0x00 {
+		t.Errorf("unexpected header of unknown addresses %x", h)
+	}
+	if _, err := HeaderV2(src, dst, []TLV{{Type: 0xE1, Value: make([]byte, 0x10000)}}); err == nil {
+		t.Error("too long TLV is accepted")
+	}
+	if _, err := Header(3, src, dst, nil); err == nil {
+		t.Error("unknown version is accepted")
+	}
+}
@@ -9,7 +9,7 @@ type IPHash struct {
 }
 
 // Schedule 调度
-func (strategy *IPHash) Schedule(client string, servers []string) string {
+func (strategy *IPHash) Schedule(client string, servers []string, load *Load) string {
 	host, _, _ := net.SplitHostPort(client)
 	intIP := int(IP2Long(host))
 	length := len(servers)
@@ -18,5 +18,5 @@ func (strategy *IPHash) Schedule(client string, servers []string) string {
 }
 
 func init() {
-	Register(IPHashName, new(IPHash))
+	Register(IPHashName, func() Scheduler { return new(IPHash) })
 }
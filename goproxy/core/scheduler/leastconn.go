@@ -0,0 +1,44 @@
+package scheduler
+
+import (
+	"sync"
+)
+
+// LeastConn scheduler takes backend with fewest active connections,
+// ties are resolved in turn so idle backends are used evenly
+type LeastConn struct {
+	lock     sync.Mutex
+	next     int
+	weighted bool
+}
+
+// Schedule Dispatch
+func (strategy *LeastConn) Schedule(client string, servers []string, load *Load) string {
+	strategy.lock.Lock()
+	defer strategy.lock.Unlock()
+	start := strategy.next % len(servers)
+	strategy.next = (strategy.next + 1) % len(servers)
+	best := servers[start]
+	bestActive, bestWeight := load.Active(best), strategy.weight(best, load)
+	for i := 1; i < len(servers); i++ {
+		s := servers[(start+i)%len(servers)]
+		active, weight := load.Active(s), strategy.weight(s, load)
+		// active/weight < bestActive/bestWeight
+		if active*bestWeight < bestActive*weight {
+			best, bestActive, bestWeight = s, active, weight
+		}
+	}
+	return best
+}
+
+func (strategy *LeastConn) weight(server string, load *Load) int {
+	if !strategy.weighted {
+		return 1
+	}
+	return load.Weight(server)
+}
+
+func init() {
+	Register(LeastConnName, func() Scheduler { return new(LeastConn) })
+	Register(WeightedLeastConnName, func() Scheduler { return &LeastConn{weighted: true} })
+}
@@ -0,0 +1,56 @@
+package scheduler
+
+import "sync"
+
+// Load tracks active connections and weights of backends
+type Load struct {
+	lock    sync.Mutex
+	active  map[string]int
+	weights map[string]int
+}
+
+// NewLoad creates load accounting, backends without weight have weight 1
+func NewLoad(weights map[string]int) *Load {
+	t := new(Load)
+	t.active = make(map[string]int)
+	t.weights = make(map[string]int)
+	for s, w := range weights {
+		t.weights[s] = w
+	}
+	return t
+}
+
+// Inc records new connection to backend
+func (t *Load) Inc(server string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.active[server]++
+}
+
+// Dec records closed connection to backend
+func (t *Load) Dec(server string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.active[server] <= 1 {
+		delete(t.active, server)
+		return
+	}
+	t.active[server]--
+}
+
+// Active returns number of active connections of backend
+func (t *Load) Active(server string) int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.active[server]
+}
+
+// Weight returns weight of backend
+func (t *Load) Weight(server string) int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if w, ok := t.weights[server]; ok && w > 0 {
+		return w
+	}
+	return 1
+}
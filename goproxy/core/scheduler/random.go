@@ -1,7 +1,7 @@
 package scheduler
 
 import (
-	"time"
+	"math/rand"
 )
 
 // Random Random scheduler
@@ -9,12 +9,10 @@ type Random struct {
 }
 
 // Schedule Dispatch
-func (strategy *Random) Schedule(client string, servers []string) string {
-	length := len(servers)
-	server := servers[int(time.Now().UnixNano())%length]
-	return server
+func (strategy *Random) Schedule(client string, servers []string, load *Load) string {
+	return servers[rand.Intn(len(servers))]
 }
 
 func init() {
-	Register(RandomName, new(Random))
+	Register(RandomName, func() Scheduler { return new(Random) })
 }
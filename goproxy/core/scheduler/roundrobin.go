@@ -0,0 +1,53 @@
+package scheduler
+
+import (
+	"sync"
+)
+
+// RoundRobin scheduler takes backends in turn
+type RoundRobin struct {
+	lock sync.Mutex
+	next int
+}
+
+// Schedule Dispatch
+func (strategy *RoundRobin) Schedule(client string, servers []string, load *Load) string {
+	strategy.lock.Lock()
+	defer strategy.lock.Unlock()
+	server := servers[strategy.next%len(servers)]
+	strategy.next = (strategy.next + 1) % len(servers)
+	return server
+}
+
+// WeightedRoundRobin scheduler takes backends in turn proportionally to weights,
+// smooth algorithm interleaves backends instead of sending bursts to one of them
+type WeightedRoundRobin struct {
+	lock    sync.Mutex
+	current map[string]int
+}
+
+// Schedule Dispatch
+func (strategy *WeightedRoundRobin) Schedule(client string, servers []string, load *Load) string {
+	strategy.lock.Lock()
+	defer strategy.lock.Unlock()
+	if strategy.current == nil {
+		strategy.current = make(map[string]int)
+	}
+	total := 0
+	best := ""
+	for _, s := range servers {
+		w := load.Weight(s)
+		total += w
+		strategy.current[s] += w
+		if best == "" || strategy.current[s] > strategy.current[best] {
+			best = s
+		}
+	}
+	strategy.current[best] -= total
+	return best
+}
+
+func init() {
+	Register(RoundRobinName, func() Scheduler { return new(RoundRobin) })
+	Register(WeightedRoundRobinName, func() Scheduler { return new(WeightedRoundRobin) })
+}
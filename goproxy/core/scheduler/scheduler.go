@@ -1,23 +1,38 @@
 package scheduler
 
 const (
-	IPHashName = "iphash"
-	RandomName = "random"
+	IPHashName             = "iphash"
+	RandomName             = "random"
+	RoundRobinName         = "roundrobin"
+	LeastConnName          = "leastconn"
+	WeightedRoundRobinName = "weightedroundrobin"
+	WeightedLeastConnName  = "weightedleastconn"
 )
 
-var store = make(map[string]Scheduler)
+var store = make(map[string]func() Scheduler)
 
-// scheduler
+// scheduler, servers are healthy backends of proxy and load contains their active connections and weights
 type Scheduler interface {
-	Schedule(client string, servers []string) string
+	Schedule(client string, servers []string, load *Load) string
 }
 
-// Get scheduler
-func Get(name string) Scheduler {
-	return store[name]
+// New scheduler instance, every proxy has own instance because schedulers can keep state between calls,
+// unknown name means default iphash scheduler
+func New(name string) Scheduler {
+	f, ok := store[name]
+	if !ok {
+		f = store[IPHashName]
+	}
+	return f()
+}
+
+// Exists returns true if scheduler with name is registered
+func Exists(name string) bool {
+	_, ok := store[name]
+	return ok
 }
 
 // Registration scheduler
-func Register(name string, handle Scheduler) {
-	store[name] = handle
+func Register(name string, factory func() Scheduler) {
+	store[name] = factory
 }
@@ -0,0 +1,145 @@
+package scheduler
+
+import (
+	"fmt"
+	"testing"
+)
+
+var testServers = []string{"a:1", "b:1", "c:1"}
+
+func testDistribution(s Scheduler, servers []string, load *Load, n int) map[string]int {
+	ret := make(map[string]int)
+	for i := 0; i < n; i++ {
+		ret[s.Schedule(fmt.Sprintf("10.0.0.%d:%d", i%250, 1000+i), servers, load)]++
+	}
+	return ret
+}
+
+func TestNew(t *testing.T) {
+	for _, name := range []string{IPHashName, RandomName, RoundRobinName, LeastConnName, WeightedRoundRobinName, WeightedLeastConnName} {
+		if !Exists(name) {
+			t.Errorf("scheduler %s is not registered", name)
+		}
+	}
+	if _, ok := New("unknown").(*IPHash); !ok {
+		t.Error("unknown scheduler should fall back to iphash")
+	}
+	// stateful schedulers are not shared between proxies
+	a, b := New(RoundRobinName), New(RoundRobinName)
+	if a == b {
+		t.Error("New returned shared instance")
+	}
+}
+
+func TestRoundRobin(t *testing.T) {
+	d := testDistribution(New(RoundRobinName), testServers, NewLoad(nil), 300)
+	for _, s := range testServers {
+		if d[s] != 100 {
+			t.Errorf("unexpected distribution: %v", d)
+		}
+	}
+}
+
+func TestWeightedRoundRobin(t *testing.T) {
+	load := NewLoad(map[string]int{"a:1": 5, "b:1": 1})
+	s := New(WeightedRoundRobinName)
+	d := testDistribution(s, testServers, load, 700)
+	if d["a:1"] != 500 || d["b:1"] != 100 || d["c:1"] != 100 {
+		t.Errorf("unexpected distribution: %v", d)
+	}
+	// smooth algorithm does not send burst to heaviest backend
+	seq := ""
+	for i := 0; i < 7; i++ {
+		seq += s.Schedule("", testServers, load)[:1]
+	}
+	run := 0
+	for i := range seq {
+		if seq[i] == 'a' {
+			run++
+		} else {
+			run = 0
+		}
+		if run > 3 {
+			t.Errorf("burst to heaviest backend: %s", seq)
+		}
+	}
+}
+
+func TestLeastConn(t *testing.T) {
+	load := NewLoad(nil)
+	s := New(LeastConnName)
+	// long connections are spread evenly
+	for i := 0; i < 30; i++ {
+		load.Inc(s.Schedule("", testServers, load))
+	}
+	for _, srv := range testServers {
+		if load.Active(srv) != 10 {
+			t.Errorf("unexpected active connections of %s: %d", srv, load.Active(srv))
+		}
+	}
+	// backend with closed connections gets new ones
+	for i := 0; i < 5; i++ {
+		load.Dec("b:1")
+	}
+	for i := 0; i < 5; i++ {
+		if srv := s.Schedule("", testServers, load); srv != "b:1" {
+			t.Errorf("expected least loaded backend b:1, got %s", srv)
+		} else {
+			load.Inc(srv)
+		}
+	}
+}
+
+func TestWeightedLeastConn(t *testing.T) {
+	load := NewLoad(map[string]int{"a:1": 2})
+	s := New(WeightedLeastConnName)
+	for i := 0; i < 40; i++ {
+		load.Inc(s.Schedule("", testServers, load))
+	}
+	if load.Active("a:1") != 20 || load.Active("b:1") != 10 || load.Active("c:1") != 10 {
+		t.Errorf("unexpected distribution: %d %d %d", load.Active("a:1"), load.Active("b:1"), load.Active("c:1"))
+	}
+}
+
+// one relayed peer generating most of traffic is pinned to one backend by iphash but not by load aware schedulers
+func TestSinglePeer(t *testing.T) {
+	for _, name := range []string{RoundRobinName, LeastConnName} {
+		load := NewLoad(nil)
+		s := New(name)
+		d := map[string]int{}
+		for i := 0; i < 30; i++ {
+			srv := s.Schedule("192.168.1.1:5000", testServers, load)
+			load.Inc(srv)
+			d[srv]++
+		}
+		if len(d) != 3 {
+			t.Errorf("%s: traffic of single peer is not spread: %v", name, d)
+		}
+	}
+	d := testDistribution(New(IPHashName), testServers, NewLoad(nil), 1)
+	if len(d) != 1 {
+		t.Errorf("iphash: %v", d)
+	}
+}
+
+func TestRandom(t *testing.T) {
+	d := testDistribution(New(RandomName), testServers, NewLoad(nil), 3000)
+	for _, s := range testServers {
+		if d[s] < 800 || d[s] > 1200 {
+			t.Errorf("unexpected distribution: %v", d)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	load := NewLoad(map[string]int{"a:1": 3, "b:1": 0})
+	if load.Weight("a:1") != 3 || load.Weight("b:1") != 1 || load.Weight("c:1") != 1 {
+		t.Error("unexpected weights")
+	}
+	load.Inc("a:1")
+	load.Dec("a:1")
+	load.Dec("a:1")
+	if load.Active("a:1") != 0 {
+		t.Errorf("active connections are negative: %d", load.Active("a:1"))
+	}
+}
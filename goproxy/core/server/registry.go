@@ -0,0 +1,70 @@
+package server
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// Registry of active sessions of listener, sessions are closed by CloseAll when listener is stopped
+type Registry struct {
+	lock   sync.Mutex
+	conns  map[io.Closer]struct{}
+	closed bool
+}
+
+// NewRegistry return a new empty registry
+func NewRegistry() *Registry {
+	t := new(Registry)
+	t.conns = make(map[io.Closer]struct{})
+	return t
+}
+
+// Add registers session, false is returned if registry is already closed and session must be closed by caller
+func (t *Registry) Add(c io.Closer) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closed {
+		return false
+	}
+	t.conns[c] = struct{}{}
+	return true
+}
+
+// Remove unregisters finished session
+func (t *Registry) Remove(c io.Closer) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.conns, c)
+}
+
+// Len returns count of active sessions
+func (t *Registry) Len() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return len(t.conns)
+}
+
+// Wait waits until all sessions are finished, false is returned if timeout expired first
+func (t *Registry) Wait(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for t.Len() > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return true
+}
+
+// CloseAll closes all active sessions, sessions added later are refused
+func (t *Registry) CloseAll() {
+	t.lock.Lock()
+	t.closed = true
+	conns := t.conns
+	t.conns = make(map[io.Closer]struct{})
+	t.lock.Unlock()
+	for c := range conns {
+		c.Close()
+	}
+}
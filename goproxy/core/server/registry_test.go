@@ -0,0 +1,43 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+type testCloser struct {
+	closed bool
+}
+
+func (c *testCloser) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	a, b := &testCloser{}, &testCloser{}
+	if !r.Add(a) || !r.Add(b) || r.Len() != 2 {
+		t.Fatalf("sessions are not registered: %d", r.Len())
+	}
+	r.Remove(a)
+	if r.Wait(100 * time.Millisecond) {
+		t.Error("wait finished with active session")
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		r.Remove(b)
+	}()
+	if !r.Wait(2 * time.Second) {
+		t.Error("wait did not finish after last session is removed")
+	}
+
+	r.Add(b)
+	r.CloseAll()
+	if a.closed || !b.closed || r.Len() != 0 {
+		t.Errorf("unexpected state after close: %v %v %d", a.closed, b.closed, r.Len())
+	}
+	if r.Add(a) {
+		t.Error("session is added to closed registry")
+	}
+}
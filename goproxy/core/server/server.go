@@ -1,11 +1,20 @@
 package server
 
-import "errors"
+import (
+	"errors"
+	"time"
+)
 
 // Server - Proxy server interface
 type Server interface {
 	Start()
+	// Stop closes listener and all active sessions
 	Stop()
+	// StopAccepting refuses new sessions and releases listening port if active sessions do not need it,
+	// active sessions keep running
+	StopAccepting()
+	// Drain stops accepting new sessions, waits until active sessions finish or timeout expires and stops server
+	Drain(timeout time.Duration)
 }
 
 // ErrNetClosing is returned when a network descriptor is used after
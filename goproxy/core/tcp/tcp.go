@@ -1,13 +1,19 @@
 package tcp
 
 import (
+	"errors"
 	"io"
-	"log"
 	"net"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/shieldoo/shieldoo-mesh/goproxy/config"
+	"github.com/shieldoo/shieldoo-mesh/goproxy/core/acl"
+	"github.com/shieldoo/shieldoo-mesh/goproxy/core/health"
+	"github.com/shieldoo/shieldoo-mesh/goproxy/core/limit"
+	"github.com/shieldoo/shieldoo-mesh/goproxy/core/proxyproto"
 	"github.com/shieldoo/shieldoo-mesh/goproxy/core/scheduler"
 	"github.com/shieldoo/shieldoo-mesh/goproxy/core/server"
 )
@@ -15,106 +21,299 @@ import (
 // TCP proxy
 type TCP struct {
 	config   *config.Config
+	health   *health.Checker
+	limiter  *limit.Limiter
+	sched    scheduler.Scheduler
+	load     *scheduler.Load
 	listener net.Listener
+	conns    *server.Registry
+	// protects listener, listener is not opened after it was closed
+	lock   sync.Mutex
+	closed bool
 }
 
 // New return a new tcp proxy instance
-func New(config *config.Config) *TCP {
+func New(config *config.Config, health *health.Checker, limiter *limit.Limiter) *TCP {
 	t := new(TCP)
 	t.config = config
+	t.health = health
+	t.limiter = limiter
+	t.sched = scheduler.New(config.Scheduler)
+	t.load = scheduler.NewLoad(config.Weights)
+	t.conns = server.NewRegistry()
 	return t
 }
 
 // Start listen and serve
 func (t *TCP) Start() {
 	var err error
+	var listener net.Listener
 	for i := 0; i < 16; i++ {
-		t.listener, err = net.Listen("tcp", t.config.Local)
+		listener, err = net.Listen("tcp", t.config.Local)
 		if err != nil {
-			log.Printf("TCP.Start attempt(%d) error: %v\n", i, err)
+			t.config.Logger.Warnf("TCP.Start attempt(%d) error: %v", i, err)
 			time.Sleep(500 * time.Millisecond)
 		} else {
 			break
 		}
 	}
 	if err != nil {
-		log.Printf("TCP.Start error: %v\n", err)
+		t.config.Logger.Errorf("TCP.Start error: %v", err)
 		return
 	}
 
-	defer t.Stop()
-	log.Printf("TCP.Start %v, backends: %v\n", t.config.Local, t.config.Servers)
+	t.lock.Lock()
+	if t.closed {
+		t.lock.Unlock()
+		listener.Close()
+		return
+	}
+	t.listener = listener
+	t.lock.Unlock()
+	defer listener.Close()
+	t.config.Logger.Infof("TCP.Start %v, backends: %v", t.config.Local, t.config.Servers)
 
 	for {
-		conn, err := t.listener.Accept()
+		conn, err := listener.Accept()
 		if err != nil {
 			if !strings.Contains(err.Error(), server.ErrNetClosing.Error()) {
-				log.Printf("TCP.Listener.accept error: %v\n", err)
+				t.config.Logger.Errorf("TCP.Listener.accept error: %v", err)
 			}
 			break
 		}
-		if t.config.Debug {
-			log.Printf("TCP Client is connected: %v => %v\n", conn.RemoteAddr(), conn.LocalAddr())
+		// limits are checked before goroutine is started, rejected client does not consume resources
+		if err := t.limiter.Acquire(limit.Source(conn.RemoteAddr())); err != nil {
+			t.config.Logger.Debugf("TCP Client is rejected: %v => %v: %v", conn.RemoteAddr(), conn.LocalAddr(), err)
+			conn.Close()
+			continue
 		}
+		if !t.conns.Add(conn) {
+			conn.Close()
+			t.limiter.Release(limit.Source(conn.RemoteAddr()))
+			continue
+		}
+		t.config.Logger.Debugf("TCP Client is connected: %v => %v", conn.RemoteAddr(), conn.LocalAddr())
 		go t.handle(conn)
 	}
 }
 
-// Stop stop serve
+// Stop stop serve and close active sessions
 func (t *TCP) Stop() {
-	log.Printf("TCP.Stop %v, backends: %v\n", t.config.Local, t.config.Servers)
-	lic, ok := t.listener.(*net.TCPListener)
-	if ok {
-		lic.Close()
+	t.config.Logger.Infof("TCP.Stop %v, backends: %v", t.config.Local, t.config.Servers)
+	t.closeListener()
+	t.conns.CloseAll()
+}
+
+// StopAccepting closes listener, port is released immediately and active sessions keep running
+func (t *TCP) StopAccepting() {
+	t.closeListener()
+}
+
+// Drain stop accepting and wait for active sessions until timeout
+func (t *TCP) Drain(timeout time.Duration) {
+	t.config.Logger.Infof("TCP.Drain %v, active sessions: %d", t.config.Local, t.conns.Len())
+	t.closeListener()
+	if !t.conns.Wait(timeout) {
+		t.config.Logger.Infof("TCP.Drain %v timeout, closing sessions: %d", t.config.Local, t.conns.Len())
+	}
+	t.Stop()
+}
+
+func (t *TCP) closeListener() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.closed = true
+	if t.listener != nil {
+		t.listener.Close()
 	}
 }
 
 func (t *TCP) handle(sconn net.Conn) {
+	source := limit.Source(sconn.RemoteAddr())
 	defer func() {
-		log.Printf("TCP Client is closed: %v => %v\n", sconn.RemoteAddr(), sconn.LocalAddr())
+		t.config.Logger.Debugf("TCP Client is closed: %v => %v", sconn.RemoteAddr(), sconn.LocalAddr())
 		sconn.Close()
+		t.conns.Remove(sconn)
+		t.limiter.Release(source)
 	}()
 
-	addr := scheduler.Get(t.config.Scheduler).Schedule(sconn.RemoteAddr().String(), t.config.Servers)
-	dconn, err := net.Dial("tcp", addr)
+	if err := acl.Check(t.config, sconn.RemoteAddr()); err != nil {
+		t.config.Logger.Infof("TCP Client is rejected: %v => %v: %v", sconn.RemoteAddr(), sconn.LocalAddr(), err)
+		t.config.Metrics.SessionRejected()
+		return
+	}
+	t.config.Metrics.SessionOpened()
+	defer t.config.Metrics.SessionClosed()
+	addr, dconn, err := t.dial(sconn.RemoteAddr().String())
 	if err != nil {
-		log.Printf("TCP connect to the server [%v] fail: %v\n", addr, err)
 		return
 	}
 	defer func() {
-		log.Printf("TCP The server is closed: %v => %v\n", dconn.LocalAddr(), addr)
+		t.config.Logger.Debugf("TCP The server is closed: %v => %v", dconn.LocalAddr(), addr)
 		dconn.Close()
+		t.load.Dec(addr)
 	}()
-	log.Printf("TCP The server is connected: %v => %v\n", dconn.LocalAddr(), addr)
+	t.config.Logger.Debugf("TCP The server is connected: %v => %v", dconn.LocalAddr(), addr)
+	if t.config.ProxyProtocol != 0 {
+		if err := t.writeProxyHeader(sconn, dconn); err != nil {
+			t.config.Logger.Warnf("TCP send PROXY protocol header to the server [%v] fail: %v", addr, err)
+			return
+		}
+	}
 
-	closeChan := make(chan struct{}, 1)
-	go func(sconn net.Conn, dconn net.Conn, closeChan chan struct{}) {
-		_, err := io.Copy(dconn, sconn)
+	s := &session{}
+	s.touch()
+	errc := make(chan error, 2)
+	go func() {
+		err := t.pipe(dconn, sconn, t.limiter.Reader(sconn, source), s, t.config.Metrics.BytesIn)
+		if err != nil && !strings.Contains(err.Error(), server.ErrNetClosing.Error()) && err != errIdle {
+			t.config.Logger.Debugf("TCP Past [%v] Send data failed: %v", addr, err)
+		}
+		errc <- err
+	}()
+	go func() {
+		err := t.pipe(sconn, dconn, t.limiter.Reader(dconn, source), s, t.config.Metrics.BytesOut)
+		if err != nil && !strings.Contains(err.Error(), server.ErrNetClosing.Error()) && err != errIdle {
+			t.config.Logger.Debugf("TCP From [%v] Receive data failed: %v", addr, err)
+		}
+		errc <- err
+	}()
+
+	// session is closed when both directions are finished, failed or idle direction closes it immediately
+	for i := 0; i < 2; i++ {
+		err := <-errc
+		if err == nil && i == 0 && t.config.HalfCloseTimeout > 0 {
+			// remaining direction is woken up to switch to timeout of half-closed session
+			atomic.StoreInt32(&s.halfClosed, 1)
+			deadline := time.Now().Add(t.idleTimeout(s) - s.idle())
+			sconn.SetReadDeadline(deadline)
+			dconn.SetReadDeadline(deadline)
+		}
 		if err != nil {
-			if err == io.EOF {
-				// Read after reading
-			} else if strings.Contains(err.Error(), server.ErrNetClosing.Error()) {
-				// log.Printf("TCP Past [%v] Send data failed: Connection has been closed %v\n", addr, err)
-			} else {
-				log.Printf("TCP Past [%v] Send data failed: %v\n", addr, err)
+			if err == errIdle {
+				t.config.Logger.Debugf("TCP Client is idle: %v => %v", sconn.RemoteAddr(), sconn.LocalAddr())
 			}
+			sconn.Close()
+			dconn.Close()
 		}
-		closeChan <- struct{}{}
-	}(sconn, dconn, closeChan)
+	}
+}
+
+// idleTimeout returns idle timeout of session, zero means no timeout, half-closed session uses
+// shorter of idle and half-close timeouts
+func (t *TCP) idleTimeout(s *session) time.Duration {
+	d := t.config.IdleTimeout
+	if atomic.LoadInt32(&s.halfClosed) != 0 && t.config.HalfCloseTimeout > 0 && (d <= 0 || t.config.HalfCloseTimeout < d) {
+		d = t.config.HalfCloseTimeout
+	}
+	return d
+}
+
+// session tracks activity of both directions for idle timeout
+type session struct {
+	// accessed atomically, unix nanoseconds of last data in any direction
+	active int64
+	// accessed atomically, set when one direction is finished
+	halfClosed int32
+}
 
-	go func(sconn net.Conn, dconn net.Conn, closeChan chan struct{}) {
-		_, err := io.Copy(sconn, dconn)
+func (s *session) touch() {
+	atomic.StoreInt64(&s.active, time.Now().UnixNano())
+}
+
+func (s *session) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&s.active)))
+}
+
+var errIdle = errors.New("session is idle")
+
+// pipe copies src to dst until EOF and then closes write side of dst, so half-closed session keeps
+// working in other direction, nil is returned for EOF, count is called with copied bytes
+func (t *TCP) pipe(dst net.Conn, src net.Conn, r io.Reader, s *session, count func(n int)) error {
+	buf := make([]byte, 32*1024)
+	for {
+		if d := t.idleTimeout(s); d > 0 {
+			src.SetReadDeadline(time.Now().Add(d - s.idle()))
+		}
+		n, err := r.Read(buf)
+		if n > 0 {
+			s.touch()
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				return werr
+			}
+			count(n)
+		}
+		if err == io.EOF {
+			// half-close timeout is counted from EOF
+			s.touch()
+			if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+				return cw.CloseWrite()
+			}
+			// write side cannot be closed alone, whole session is closed
+			return io.ErrClosedPipe
+		}
 		if err != nil {
-			if err == io.EOF {
-				// Read after reading
-			} else if strings.Contains(err.Error(), server.ErrNetClosing.Error()) {
-				// log.Printf("TCP From [%v] Receive data failed: Connection has been closed %v\n", ip, err)
-			} else {
-				log.Printf("TCP From [%v] Receive data failed: %v\n", addr, err)
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				// other direction can keep session alive, deadline is also set when session is half-closed
+				if d := t.idleTimeout(s); d <= 0 || s.idle() < d {
+					continue
+				}
+				return errIdle
 			}
+			return err
 		}
-		closeChan <- struct{}{}
-	}(sconn, dconn, closeChan)
+	}
+}
 
-	<-closeChan
+// dial connects healthy backend chosen by scheduler, failed backend is skipped and next one is tried
+func (t *TCP) dial(client string) (string, net.Conn, error) {
+	servers := t.health.Healthy(t.config.Servers)
+	for {
+		addr := t.sched.Schedule(client, servers, t.load)
+		// connection is counted before dial so concurrent clients see it
+		t.load.Inc(addr)
+		start := time.Now()
+		dconn, err := net.DialTimeout("tcp", addr, time.Millisecond*t.config.Timeout)
+		if err == nil {
+			t.config.Metrics.BackendDialed(addr, time.Since(start))
+			t.health.Success(addr)
+			return addr, dconn, nil
+		}
+		t.load.Dec(addr)
+		t.config.Logger.Warnf("TCP connect to the server [%v] fail: %v", addr, err)
+		t.config.Metrics.BackendFailed(addr, err)
+		t.health.Fail(addr, err)
+		servers = without(servers, addr)
+		if len(servers) == 0 {
+			return "", nil, err
+		}
+	}
+}
+
+func without(servers []string, server string) []string {
+	ret := make([]string, 0, len(servers))
+	for _, s := range servers {
+		if s != server {
+			ret = append(ret, s)
+		}
+	}
+	return ret
+}
+
+// writeProxyHeader sends PROXY protocol header with address and identity of client to backend
+func (t *TCP) writeProxyHeader(sconn net.Conn, dconn net.Conn) error {
+	var tlvs []proxyproto.TLV
+	if t.config.Identify != nil {
+		if id := t.config.Identify(sconn.RemoteAddr()); id != nil && id.Name != "" {
+			tlvs = append(tlvs, proxyproto.TLV{Type: proxyproto.TypeNebulaCertName, Value: []byte(id.Name)})
+		}
+	}
+	header, err := proxyproto.Header(t.config.ProxyProtocol, sconn.RemoteAddr(), sconn.LocalAddr(), tlvs)
+	if err != nil {
+		return err
+	}
+	dconn.SetWriteDeadline(time.Now().Add(time.Millisecond * t.config.Timeout))
+	_, err = dconn.Write(header)
+	dconn.SetWriteDeadline(time.Time{})
+	return err
 }
@@ -0,0 +1,552 @@
+package tcp
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shieldoo/shieldoo-mesh/goproxy/config"
+	"github.com/shieldoo/shieldoo-mesh/goproxy/core/health"
+	"github.com/shieldoo/shieldoo-mesh/goproxy/core/limit"
+	"github.com/shieldoo/shieldoo-mesh/goproxy/core/metrics"
+	"github.com/shieldoo/shieldoo-mesh/goproxy/core/proxyproto"
+)
+
+func testFreeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// testEchoBackend returns every received byte back to client
+func testEchoBackend(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return l
+}
+
+func TestTCPFailover(t *testing.T) {
+	backend := testEchoBackend(t)
+	defer backend.Close()
+	dead := testFreeAddr(t)
+
+	local := testFreeAddr(t)
+	// iphash scheduler picks second backend for 127.0.0.1
+	cfg, _ := config.New("tcp", local, backend.Addr().String()+","+dead)
+	cfg.HealthCheckInterval = 0
+	h := health.New(cfg)
+	p := New(cfg, h, limit.New(cfg.Limits))
+	go p.Start()
+	defer p.Stop()
+
+	for i := 0; i < 4; i++ {
+		var c net.Conn
+		var err error
+		for j := 0; j < 50; j++ {
+			if c, err = net.Dial("tcp", local); err == nil {
+				break
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.SetDeadline(time.Now().Add(2 * time.Second))
+		c.Write([]byte("ping"))
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "ping" {
+			t.Errorf("connection %d is not relayed to live backend: %q %v", i, buf, err)
+		}
+		c.Close()
+	}
+	if got := h.Healthy(cfg.Servers); len(got) != 1 || got[0] != backend.Addr().String() {
+		t.Errorf("dead backend is not marked down: %v", got)
+	}
+}
+
+func TestTCPProxyProtocol(t *testing.T) {
+	for _, version := range []int{1, 2} {
+		backend, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		received := make(chan []byte, 1)
+		go func() {
+			c, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+			c.SetReadDeadline(time.Now().Add(2 * time.Second))
+			buf := make([]byte, 1024)
+			var data []byte
+			for !bytes.HasSuffix(data, []byte("hello")) {
+				n, err := c.Read(buf)
+				if err != nil {
+					break
+				}
+				data = append(data, buf[:n]...)
+			}
+			received <- data
+		}()
+
+		local := testFreeAddr(t)
+		cfg, _ := config.New("tcp", local, backend.Addr().String())
+		cfg.ProxyProtocol = version
+		cfg.Identify = func(client net.Addr) *config.Identity { return &config.Identity{Name: "john@example.com"} }
+		p := New(cfg, health.New(cfg), limit.New(cfg.Limits))
+		go p.Start()
+
+		var c net.Conn
+		for j := 0; j < 50; j++ {
+			if c, err = net.Dial("tcp", local); err == nil {
+				break
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Write([]byte("hello"))
+		data := <-received
+		c.Close()
+		p.Stop()
+		backend.Close()
+
+		var expected []byte
+		if version == 1 {
+			expected = proxyproto.HeaderV1(c.LocalAddr(), c.RemoteAddr())
+		} else {
+			expected, _ = proxyproto.HeaderV2(c.LocalAddr(), c.RemoteAddr(), []proxyproto.TLV{{Type: proxyproto.TypeNebulaCertName, Value: []byte("john@example.com")}})
+		}
+		if !bytes.Equal(data, append(expected, []byte("hello")...)) {
+			t.Errorf("v%d: backend received %q", version, data)
+		}
+	}
+}
+
+func TestTCPRejected(t *testing.T) {
+	backend := testEchoBackend(t)
+	defer backend.Close()
+
+	local := testFreeAddr(t)
+	cfg, _ := config.New("tcp", local, backend.Addr().String())
+	cfg.AllowedGroups = []string{"admins"}
+	cfg.Identify = func(client net.Addr) *config.Identity {
+		return &config.Identity{Name: "john", Groups: []string{"users"}}
+	}
+	p := New(cfg, health.New(cfg), limit.New(cfg.Limits))
+	go p.Start()
+	defer p.Stop()
+
+	var c net.Conn
+	var err error
+	for j := 0; j < 50; j++ {
+		if c, err = net.Dial("tcp", local); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(2 * time.Second))
+	c.Write([]byte("ping"))
+	if n, err := c.Read(make([]byte, 4)); err == nil {
+		t.Errorf("rejected client received %d bytes", n)
+	}
+}
+
+func testDial(t *testing.T, local string) net.Conn {
+	var c net.Conn
+	var err error
+	for j := 0; j < 50; j++ {
+		if c, err = net.Dial("tcp", local); err == nil {
+			return c
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal(err)
+	return nil
+}
+
+func testPing(c net.Conn) error {
+	c.SetDeadline(time.Now().Add(2 * time.Second))
+	defer c.SetDeadline(time.Time{})
+	if _, err := c.Write([]byte("ping")); err != nil {
+		return err
+	}
+	buf := make([]byte, 4)
+	_, err := io.ReadFull(c, buf)
+	return err
+}
+
+func TestTCPDrain(t *testing.T) {
+	backend := testEchoBackend(t)
+	defer backend.Close()
+
+	local := testFreeAddr(t)
+	cfg, _ := config.New("tcp", local, backend.Addr().String())
+	p := New(cfg, health.New(cfg), limit.New(cfg.Limits))
+	go p.Start()
+
+	c := testDial(t, local)
+	defer c.Close()
+	if err := testPing(c); err != nil {
+		t.Fatal(err)
+	}
+	drained := make(chan struct{})
+	go func() {
+		p.Drain(5 * time.Second)
+		close(drained)
+	}()
+	// new connections are refused, active session still works
+	refused := false
+	for i := 0; i < 50 && !refused; i++ {
+		if nc, err := net.Dial("tcp", local); err != nil {
+			refused = true
+		} else {
+			nc.Close()
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+	if !refused {
+		t.Error("new connection is accepted during drain")
+	}
+	if err := testPing(c); err != nil {
+		t.Errorf("active session is broken by drain: %v", err)
+	}
+	c.Close()
+	select {
+	case <-drained:
+	case <-time.After(2 * time.Second):
+		t.Error("drain does not finish after last session is closed")
+	}
+}
+
+func TestTCPStopAcceptingReleasesPort(t *testing.T) {
+	backend := testEchoBackend(t)
+	defer backend.Close()
+
+	local := testFreeAddr(t)
+	cfg, _ := config.New("tcp", local, backend.Addr().String())
+	p := New(cfg, health.New(cfg), limit.New(cfg.Limits))
+	go p.Start()
+	defer p.Stop()
+
+	c := testDial(t, local)
+	defer c.Close()
+	if err := testPing(c); err != nil {
+		t.Fatal(err)
+	}
+	p.StopAccepting()
+	// replacement listener binds the port while old session is still running
+	n, err := net.Listen("tcp", local)
+	if err != nil {
+		t.Fatalf("port is not released: %v", err)
+	}
+	n.Close()
+	if err := testPing(c); err != nil {
+		t.Errorf("active session is broken: %v", err)
+	}
+}
+
+func TestTCPDrainTimeout(t *testing.T) {
+	backend := testEchoBackend(t)
+	defer backend.Close()
+
+	local := testFreeAddr(t)
+	cfg, _ := config.New("tcp", local, backend.Addr().String())
+	p := New(cfg, health.New(cfg), limit.New(cfg.Limits))
+	go p.Start()
+
+	c := testDial(t, local)
+	defer c.Close()
+	if err := testPing(c); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	p.Drain(200 * time.Millisecond)
+	if time.Since(start) > 2*time.Second {
+		t.Errorf("drain exceeded deadline: %v", time.Since(start))
+	}
+	if err := testPing(c); err == nil {
+		t.Error("session is not closed after drain deadline")
+	}
+}
+
+func TestTCPStopClosesSessions(t *testing.T) {
+	backend := testEchoBackend(t)
+	defer backend.Close()
+
+	local := testFreeAddr(t)
+	cfg, _ := config.New("tcp", local, backend.Addr().String())
+	l := limit.New(cfg.Limits)
+	p := New(cfg, health.New(cfg), l)
+	go p.Start()
+
+	c := testDial(t, local)
+	defer c.Close()
+	if err := testPing(c); err != nil {
+		t.Fatal(err)
+	}
+	p.Stop()
+	if err := testPing(c); err == nil {
+		t.Error("session is not closed by stop")
+	}
+	for i := 0; i < 50 && l.Metrics().Active > 0; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if m := l.Metrics(); m.Active != 0 {
+		t.Errorf("session is not released: %+v", m)
+	}
+}
+
+func TestTCPHalfClose(t *testing.T) {
+	// backend reads request until EOF and then sends response, like nc -q upload
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	go func() {
+		for {
+			c, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				data, _ := io.ReadAll(c)
+				c.Write([]byte("received " + string(data)))
+			}()
+		}
+	}()
+
+	local := testFreeAddr(t)
+	cfg, _ := config.New("tcp", local, backend.Addr().String())
+	p := New(cfg, health.New(cfg), limit.New(cfg.Limits))
+	go p.Start()
+	defer p.Stop()
+
+	c := testDial(t, local)
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(2 * time.Second))
+	c.Write([]byte("upload"))
+	if err := c.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := io.ReadAll(c)
+	if err != nil || string(resp) != "received upload" {
+		t.Errorf("response after half-close is lost: %q %v", resp, err)
+	}
+}
+
+func TestTCPHalfCloseByServer(t *testing.T) {
+	// backend sends banner and closes its write side, it still reads client data
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	received := make(chan string, 1)
+	go func() {
+		c, err := backend.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		c.Write([]byte("banner"))
+		c.(*net.TCPConn).CloseWrite()
+		data, _ := io.ReadAll(c)
+		received <- string(data)
+	}()
+
+	local := testFreeAddr(t)
+	cfg, _ := config.New("tcp", local, backend.Addr().String())
+	p := New(cfg, health.New(cfg), limit.New(cfg.Limits))
+	go p.Start()
+	defer p.Stop()
+
+	c := testDial(t, local)
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(2 * time.Second))
+	banner, err := io.ReadAll(c)
+	if err != nil || string(banner) != "banner" {
+		t.Fatalf("unexpected banner: %q %v", banner, err)
+	}
+	if _, err := c.Write([]byte("data after half-close")); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	select {
+	case data := <-received:
+		if data != "data after half-close" {
+			t.Errorf("unexpected data: %q", data)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("data after half-close is not delivered")
+	}
+}
+
+func TestTCPHalfCloseTimeout(t *testing.T) {
+	// backend reads request until EOF and never answers nor closes
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	go func() {
+		c, err := backend.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.ReadAll(c)
+		time.Sleep(5 * time.Second)
+	}()
+
+	local := testFreeAddr(t)
+	cfg, _ := config.New("tcp", local, backend.Addr().String())
+	// half-closed sessions are not limited by default, server may work long after client finished request
+	if cfg.IdleTimeout != 0 || cfg.HalfCloseTimeout != 0 {
+		t.Fatalf("unexpected default timeouts: %v %v", cfg.IdleTimeout, cfg.HalfCloseTimeout)
+	}
+	cfg.HalfCloseTimeout = 300 * time.Millisecond
+	p := New(cfg, health.New(cfg), limit.New(cfg.Limits))
+	go p.Start()
+	defer p.Stop()
+
+	c := testDial(t, local)
+	defer c.Close()
+	c.Write([]byte("upload"))
+	if err := c.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	start := time.Now()
+	if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("half-closed session is not closed: %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("half-closed session is closed late: %v", time.Since(start))
+	}
+	if !p.conns.Wait(time.Second) {
+		t.Errorf("half-closed session is not released: %d", p.conns.Len())
+	}
+}
+
+func TestTCPIdleTimeout(t *testing.T) {
+	backend := testEchoBackend(t)
+	defer backend.Close()
+
+	local := testFreeAddr(t)
+	cfg, _ := config.New("tcp", local, backend.Addr().String())
+	cfg.IdleTimeout = 300 * time.Millisecond
+	p := New(cfg, health.New(cfg), limit.New(cfg.Limits))
+	go p.Start()
+	defer p.Stop()
+
+	c := testDial(t, local)
+	defer c.Close()
+	// traffic keeps session alive longer than idle timeout
+	for i := 0; i < 6; i++ {
+		if err := testPing(c); err != nil {
+			t.Fatalf("active session is closed: %v", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	start := time.Now()
+	if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("idle session is not closed: %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("idle session is closed late: %v", time.Since(start))
+	}
+}
+
+// testLogger counts messages by level
+type testLogger struct {
+	lock   sync.Mutex
+	levels map[string]int
+}
+
+func (l *testLogger) log(level string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.levels[level]++
+}
+
+func (l *testLogger) count(level string) int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.levels[level]
+}
+
+func (l *testLogger) Debugf(format string, args ...interface{}) { l.log("debug") }
+func (l *testLogger) Infof(format string, args ...interface{})  { l.log("info") }
+func (l *testLogger) Warnf(format string, args ...interface{})  { l.log("warn") }
+func (l *testLogger) Errorf(format string, args ...interface{}) { l.log("error") }
+
+func TestTCPMetrics(t *testing.T) {
+	backend := testEchoBackend(t)
+	defer backend.Close()
+	dead := testFreeAddr(t)
+
+	local := testFreeAddr(t)
+	// iphash scheduler picks second backend for 127.0.0.1
+	cfg, _ := config.New("tcp", local, backend.Addr().String()+","+dead)
+	cfg.HealthCheckInterval = 0
+	logger := &testLogger{levels: make(map[string]int)}
+	m := metrics.New()
+	cfg.Logger = logger
+	cfg.Metrics = m
+	p := New(cfg, health.New(cfg), limit.New(cfg.Limits))
+	go p.Start()
+
+	c := testDial(t, local)
+	if err := testPing(c); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	for i := 0; i < 50 && m.Snapshot().Active > 0; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	p.Stop()
+
+	s := m.Snapshot()
+	if s.Sessions != 1 || s.Active != 0 || s.BytesIn != 4 || s.BytesOut != 4 || s.DialErrors != 1 {
+		t.Errorf("unexpected metrics: %+v", s)
+	}
+	for _, b := range s.Backends {
+		if b.Address == backend.Addr().String() && b.Dials != 1 {
+			t.Errorf("backend dial is not recorded: %+v", b)
+		}
+	}
+	// connection open and close are logged only as debug messages
+	if logger.count("debug") == 0 || logger.count("info") != 2 || logger.count("warn") != 2 {
+		t.Errorf("unexpected log messages: %v", logger.levels)
+	}
+}
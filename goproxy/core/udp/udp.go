@@ -1,187 +1,367 @@
 package udp
 
 import (
-	"log"
+	"errors"
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/shieldoo/shieldoo-mesh/goproxy/config"
+	"github.com/shieldoo/shieldoo-mesh/goproxy/core/acl"
+	"github.com/shieldoo/shieldoo-mesh/goproxy/core/health"
+	"github.com/shieldoo/shieldoo-mesh/goproxy/core/limit"
 	"github.com/shieldoo/shieldoo-mesh/goproxy/core/scheduler"
 	"github.com/shieldoo/shieldoo-mesh/goproxy/core/server"
 )
 
+// largest UDP payload, datagrams are never truncated
+const maxDatagramSize = 65535
+
+// buffers of flow readers are taken only for read of waiting datagram, idle flows hold no buffer
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, maxDatagramSize)
+		return &b
+	},
+}
+
 // UDP proxy
 type UDP struct {
-	config        *config.Config
-	listener      *net.UDPConn
-	connStore     *sync.Map
-	channelServer chan message
-	channelClient chan message
+	// accessed atomically, new flows are refused when set
+	draining    int32
+	config      *config.Config
+	health      *health.Checker
+	limiter     *limit.Limiter
+	sched       scheduler.Scheduler
+	load        *scheduler.Load
+	listener    *net.UDPConn
+	lock        sync.Mutex
+	flows       map[string]*flow
+	closed      bool
+	rejectStore *sync.Map
+	done        chan struct{}
+	once        sync.Once
+}
+
+// flow of one client to backend, upstream socket is read by own goroutine
+type flow struct {
+	// accessed atomically, unix nanoseconds of last packet in any direction
+	active int64
+	key    string
+	conn   *net.UDPConn
+	client *net.UDPAddr
+	source string
+	server string
+	once   sync.Once
 }
 
-// udp message
-type message struct {
-	Data []byte
-	Conn *net.UDPConn
-	Addr *net.UDPAddr
+func (f *flow) touch() {
+	atomic.StoreInt64(&f.active, time.Now().UnixNano())
 }
 
-type conn struct {
-	Conn   *net.UDPConn
-	Active time.Time
+func (f *flow) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&f.active)))
 }
 
+var errStopped = errors.New("listener is stopped")
+
 // New return a new udp proxy instance
-func New(config *config.Config) *UDP {
+func New(config *config.Config, health *health.Checker, limiter *limit.Limiter) *UDP {
 	t := new(UDP)
 	t.config = config
-	t.connStore = new(sync.Map)
-	t.channelServer = make(chan message, 1024)
-	t.channelClient = make(chan message, 1024)
+	t.health = health
+	t.limiter = limiter
+	t.sched = scheduler.New(config.Scheduler)
+	t.load = scheduler.NewLoad(config.Weights)
+	t.flows = make(map[string]*flow)
+	t.rejectStore = new(sync.Map)
+	t.done = make(chan struct{})
 	return t
 }
 
-const errmsgUdpStartError = "UDP.Start error: %v\n"
-const errmsgUdpPastSendDataFailed = "UDP Past [%v] Send data failed: %v\n"
+const errmsgUdpStartError = "UDP.Start error: %v"
+const errmsgUdpPastSendDataFailed = "UDP Past [%v] Send data failed: %v"
 
 // Start listen and serve
 func (t *UDP) Start() {
 	addr, err := net.ResolveUDPAddr("udp", t.config.Local)
 	if err != nil {
-		log.Printf(errmsgUdpStartError, err)
+		t.config.Logger.Errorf(errmsgUdpStartError, err)
 		return
 	}
+	var listener *net.UDPConn
 	for i := 0; i < 16; i++ {
-		t.listener, err = net.ListenUDP("udp", addr)
+		listener, err = net.ListenUDP("udp", addr)
 		if err != nil {
-			log.Printf("UDP.Start attempt(%d) error: %v\n", i, err)
-			time.Sleep(500 * time.Millisecond)
+			t.config.Logger.Warnf("UDP.Start attempt(%d) error: %v", i, err)
+			select {
+			case <-t.done:
+				return
+			case <-time.After(500 * time.Millisecond):
+			}
 		} else {
 			break
 		}
 	}
 	if err != nil {
-		log.Printf(errmsgUdpStartError, err)
+		t.config.Logger.Errorf(errmsgUdpStartError, err)
+		return
+	}
+	// listener can be stopped while port is still bound by previous listener
+	t.lock.Lock()
+	if t.closed {
+		t.lock.Unlock()
+		listener.Close()
 		return
 	}
-	log.Printf("UDP.Start %v, backends: %v\n", t.config.Local, t.config.Servers)
+	t.listener = listener
+	t.lock.Unlock()
+	t.config.Logger.Infof("UDP.Start %v, backends: %v", t.config.Local, t.config.Servers)
 
-	go t.handleServer()
-	go t.handleClient()
 	go t.gc()
 
+	// datagram is written to upstream before next one is read, one buffer is enough
+	data := make([]byte, maxDatagramSize)
 	for {
-		data := make([]byte, 4096)
 		n, remoteAddr, err := t.listener.ReadFromUDP(data)
 		if err != nil {
 			if !strings.Contains(err.Error(), server.ErrNetClosing.Error()) {
-				log.Printf("UDP.listener.Read error: %v\n", err)
+				t.config.Logger.Errorf("UDP.listener.Read error: %v", err)
 			}
 			break
 		}
-		if t.config.Debug {
-			_, ok := t.connStore.Load(remoteAddr.String())
-			if !ok {
-				log.Printf("UDP Client is connected: %v => %v\n", remoteAddr.String(), t.listener.LocalAddr())
-			}
-		}
-		t.channelServer <- message{
-			Data: data[:n],
-			Conn: t.listener,
-			Addr: remoteAddr,
-		}
+		t.handle(data[:n], remoteAddr)
 	}
 }
 
-// Stop stop serve
+// Stop stop serve and close active flows
 func (t *UDP) Stop() {
-	log.Printf("UDP.Stop %v, backends: %v\n", t.config.Local, t.config.Servers)
-	close(t.channelServer)
-	close(t.channelClient)
-	t.listener.Close()
-}
-
-func (t *UDP) handleServer() {
-	for msg := range t.channelServer {
-		var err error
-		var dconn *net.UDPConn
-		c, ok := t.connStore.Load(msg.Addr.String())
-		if ok {
-			dconn = c.(*conn).Conn
-			dconn.SetWriteDeadline(time.Now().Add(time.Millisecond * t.config.Timeout))
-			_, err = dconn.Write(msg.Data)
-			dconn.SetWriteDeadline(time.Time{})
-			if err != nil {
-				log.Printf(errmsgUdpPastSendDataFailed, dconn.RemoteAddr().String(), err)
-			} else {
-				t.connStore.Store(msg.Addr.String(), &conn{Conn: dconn, Active: time.Now()})
-				continue
-			}
+	t.config.Logger.Infof("UDP.Stop %v, backends: %v", t.config.Local, t.config.Servers)
+	t.lock.Lock()
+	t.closed = true
+	listener := t.listener
+	flows := make([]*flow, 0, len(t.flows))
+	for _, f := range t.flows {
+		flows = append(flows, f)
+	}
+	t.lock.Unlock()
+	t.once.Do(func() {
+		close(t.done)
+		if listener != nil {
+			listener.Close()
 		}
+	})
+	for _, f := range flows {
+		t.close(f)
+	}
+}
 
-		serAddr := scheduler.Get(t.config.Scheduler).Schedule(msg.Addr.String(), t.config.Servers)
-		udpAddr, err := net.ResolveUDPAddr("udp", serAddr)
-		dconn, err = net.DialUDP("udp", nil, udpAddr)
-		if err != nil {
-			log.Printf("UDP connect to the server [%v] fail: %v\n", serAddr, err)
-			break
+// replies of active flows are sent from listening socket so port is kept while draining, drain is short
+// because new listener on the same port binds within its start retries
+const maxDrainTimeout = 5 * time.Second
+
+// StopAccepting refuses new flows, port is kept for replies of active flows until drain finishes
+func (t *UDP) StopAccepting() {
+	atomic.StoreInt32(&t.draining, 1)
+}
+
+// Drain refuse new flows and wait for active flows until timeout, flows end when they are idle,
+// timeout is limited to maxDrainTimeout
+func (t *UDP) Drain(timeout time.Duration) {
+	t.config.Logger.Infof("UDP.Drain %v, active flows: %d", t.config.Local, t.count())
+	t.StopAccepting()
+	if timeout > maxDrainTimeout {
+		timeout = maxDrainTimeout
+	}
+	deadline := time.Now().Add(timeout)
+	for t.count() > 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if n := t.count(); n > 0 {
+		t.config.Logger.Infof("UDP.Drain %v timeout, closing flows: %d", t.config.Local, n)
+	}
+	t.Stop()
+}
+
+// count returns number of active flows
+func (t *UDP) count() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return len(t.flows)
+}
+
+// handle forwards datagram of client to its flow, new flow is created for unknown client
+func (t *UDP) handle(data []byte, client *net.UDPAddr) {
+	key := client.String()
+	source := limit.Source(client)
+	if !t.limiter.Allow(source, len(data)) {
+		return
+	}
+	t.lock.Lock()
+	f := t.flows[key]
+	t.lock.Unlock()
+	if f != nil {
+		if err := t.write(f, data); err == nil {
+			return
 		}
-		log.Printf("UDP The server is connected: %v => %v\n", dconn.LocalAddr(), serAddr)
+		// flow is connected again, possibly to other backend
+		t.close(f)
+	}
 
-		dconn.SetWriteDeadline(time.Now().Add(time.Millisecond * t.config.Timeout))
-		_, err = dconn.Write(msg.Data)
-		dconn.SetWriteDeadline(time.Time{})
-		if err != nil {
-			log.Printf(errmsgUdpPastSendDataFailed, dconn.RemoteAddr().String(), err)
-		} else {
-			t.connStore.Store(msg.Addr.String(), &conn{Conn: dconn, Active: time.Now()})
+	if atomic.LoadInt32(&t.draining) != 0 {
+		return
+	}
+	if err := acl.Check(t.config, client); err != nil {
+		// rejection is logged once per client until gc forgets it
+		if _, logged := t.rejectStore.LoadOrStore(key, time.Now()); !logged {
+			t.config.Logger.Infof("UDP Client is rejected: %v => %v: %v", client, t.config.Local, err)
+			t.config.Metrics.SessionRejected()
 		}
-		go func(msg message) {
-			for {
-				data := make([]byte, 4096)
-				n, _, err := dconn.ReadFromUDP(data)
-				if err != nil {
-					if !strings.Contains(err.Error(), server.ErrNetClosing.Error()) {
-						log.Printf("UDP From [%v] Receive data failed: %v\n", dconn.RemoteAddr().String(), err)
-					}
-					break
-				}
-				t.channelClient <- message{
-					Data: data[:n],
-					Conn: msg.Conn,
-					Addr: msg.Addr,
+		return
+	}
+	if err := t.limiter.Acquire(source); err != nil {
+		t.config.Logger.Debugf("UDP Client is rejected: %v => %v: %v", client, t.config.Local, err)
+		return
+	}
+	f, err := t.open(key, client, source)
+	if err != nil {
+		// failed backend affects only this client, listener keeps serving
+		t.limiter.Release(source)
+		return
+	}
+	t.config.Logger.Debugf("UDP Client is connected: %v => %v", client, t.listener.LocalAddr())
+	// flow is kept also after failed write so it is released when idle
+	t.write(f, data)
+	go t.relay(f)
+}
+
+// open connects backend chosen by scheduler and registers flow
+func (t *UDP) open(key string, client *net.UDPAddr, source string) (*flow, error) {
+	serAddr := t.sched.Schedule(key, t.health.Healthy(t.config.Servers), t.load)
+	udpAddr, err := net.ResolveUDPAddr("udp", serAddr)
+	if err != nil {
+		t.config.Logger.Warnf("UDP connect to the server [%v] fail: %v", serAddr, err)
+		t.config.Metrics.BackendFailed(serAddr, err)
+		t.health.Fail(serAddr, err)
+		return nil, err
+	}
+	dconn, err := net.DialUDP("udp", nil, udpAddr)
+	if err != nil {
+		t.config.Logger.Warnf("UDP connect to the server [%v] fail: %v", serAddr, err)
+		t.config.Metrics.BackendFailed(serAddr, err)
+		t.health.Fail(serAddr, err)
+		return nil, err
+	}
+	f := &flow{key: key, conn: dconn, client: client, source: source, server: serAddr}
+	f.touch()
+	t.load.Inc(serAddr)
+	t.lock.Lock()
+	if t.closed {
+		t.lock.Unlock()
+		dconn.Close()
+		t.load.Dec(serAddr)
+		return nil, errStopped
+	}
+	t.flows[key] = f
+	t.lock.Unlock()
+	// UDP backend has no handshake, latency of connect is not measured
+	t.config.Metrics.SessionOpened()
+	t.config.Logger.Debugf("UDP The server is connected: %v => %v", dconn.LocalAddr(), serAddr)
+	return f, nil
+}
+
+func (t *UDP) write(f *flow, data []byte) error {
+	f.touch()
+	f.conn.SetWriteDeadline(time.Now().Add(time.Millisecond * t.config.Timeout))
+	_, err := f.conn.Write(data)
+	f.conn.SetWriteDeadline(time.Time{})
+	if err != nil {
+		t.config.Logger.Debugf(errmsgUdpPastSendDataFailed, f.server, err)
+		return err
+	}
+	t.config.Metrics.BytesIn(len(data))
+	return nil
+}
+
+// relay sends datagrams of backend back to client until flow is idle or closed
+func (t *UDP) relay(f *flow) {
+	defer t.close(f)
+	for {
+		f.conn.SetReadDeadline(time.Now().Add(t.idleTimeout() - f.idle()))
+		var buf *[]byte
+		var n int
+		err := waitReadable(f.conn)
+		if err == nil {
+			buf = bufferPool.Get().(*[]byte)
+			n, err = f.conn.Read(*buf)
+		}
+		if err != nil {
+			if buf != nil {
+				bufferPool.Put(buf)
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				// datagrams of client keep flow alive too
+				if f.idle() < t.idleTimeout() {
+					continue
 				}
+				t.config.Logger.Debugf("UDP The server is released: %v => %v", f.conn.LocalAddr(), f.server)
+			} else if !strings.Contains(err.Error(), server.ErrNetClosing.Error()) {
+				// backend port is closed, next datagram of client opens flow to healthy backend
+				t.config.Logger.Warnf("UDP From [%v] Receive data failed: %v", f.server, err)
+				t.config.Metrics.BackendFailed(f.server, err)
+				t.health.Fail(f.server, err)
 			}
-		}(msg)
+			return
+		}
+		f.touch()
+		if t.limiter.Allow(f.source, n) {
+			if _, err := t.listener.WriteToUDP((*buf)[:n], f.client); err != nil {
+				t.config.Logger.Debugf(errmsgUdpPastSendDataFailed, f.client, err)
+			} else {
+				t.config.Metrics.BytesOut(n)
+			}
+		}
+		bufferPool.Put(buf)
 	}
 }
 
-func (t *UDP) handleClient() {
-	for msg := range t.channelClient {
-		_, err := msg.Conn.WriteToUDP(msg.Data, msg.Addr)
-		if err != nil {
-			log.Printf(errmsgUdpPastSendDataFailed, msg.Addr.String(), err)
+// close closes flow and frees its resources, it can be called more times
+func (t *UDP) close(f *flow) {
+	f.once.Do(func() {
+		t.lock.Lock()
+		if t.flows[f.key] == f {
+			delete(t.flows, f.key)
 		}
+		t.lock.Unlock()
+		f.conn.Close()
+		t.load.Dec(f.server)
+		t.limiter.Release(f.source)
+		t.config.Metrics.SessionClosed()
+	})
+}
+
+func (t *UDP) idleTimeout() time.Duration {
+	if t.config.IdleTimeout <= 0 {
+		return config.DefaultUDPIdleTimeout
 	}
+	return t.config.IdleTimeout
 }
 
+// gc forgets rejected clients so their rejection is logged again
 func (t *UDP) gc() {
+	ticker := time.NewTicker(time.Second * 10)
+	defer ticker.Stop()
 	for {
-		time.Sleep(time.Second * 10)
-		t.connStore.Range(func(key, val interface{}) bool {
-			conn, ok := val.(*conn)
-			if !ok {
-				t.connStore.Delete(key)
-				return false
-			}
-			if conn.Active.Add(time.Second * 30).Before(time.Now()) {
-				if t.config.Debug {
-					log.Printf("UDP The server is released: %v => %v\n", conn.Conn.LocalAddr().String(), conn.Conn.RemoteAddr().String())
-				}
-				conn.Conn.Close()
-				t.connStore.Delete(key)
+		select {
+		case <-ticker.C:
+		case <-t.done:
+			return
+		}
+		t.rejectStore.Range(func(key, val interface{}) bool {
+			if val.(time.Time).Add(time.Second * 30).Before(time.Now()) {
+				t.rejectStore.Delete(key)
 			}
 			return true
 		})
@@ -0,0 +1,389 @@
+package udp
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/shieldoo/shieldoo-mesh/goproxy/config"
+	"github.com/shieldoo/shieldoo-mesh/goproxy/core/health"
+	"github.com/shieldoo/shieldoo-mesh/goproxy/core/limit"
+	"github.com/shieldoo/shieldoo-mesh/goproxy/core/metrics"
+	"github.com/shieldoo/shieldoo-mesh/goproxy/core/scheduler"
+)
+
+func testFreeAddr(t *testing.T) string {
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	return c.LocalAddr().String()
+}
+
+// testEchoBackend returns every received datagram back to sender
+func testEchoBackend(t *testing.T) net.PacketConn {
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, addr, err := c.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			c.WriteTo(buf[:n], addr)
+		}
+	}()
+	return c
+}
+
+// testPing returns true if datagram is relayed to backend and back
+func testPing(c net.Conn, timeout time.Duration) bool {
+	c.SetDeadline(time.Now().Add(timeout))
+	if _, err := c.Write([]byte("ping")); err != nil {
+		return false
+	}
+	buf := make([]byte, 16)
+	n, err := c.Read(buf)
+	return err == nil && string(buf[:n]) == "ping"
+}
+
+func testClient(t *testing.T, local string) net.Conn {
+	c, err := net.Dial("udp", local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		if testPing(c, 100*time.Millisecond) {
+			return c
+		}
+		// read fails immediately while proxy is not listening
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("proxy does not relay datagrams")
+	return nil
+}
+
+func TestUDPDrain(t *testing.T) {
+	backend := testEchoBackend(t)
+	defer backend.Close()
+
+	local := testFreeAddr(t)
+	cfg, _ := config.New("udp", local, backend.LocalAddr().String())
+	l := limit.New(cfg.Limits)
+	p := New(cfg, health.New(cfg), l)
+	go p.Start()
+
+	c := testClient(t, local)
+	defer c.Close()
+	drained := make(chan struct{})
+	go func() {
+		p.Drain(500 * time.Millisecond)
+		close(drained)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if !testPing(c, time.Second) {
+		t.Error("active flow is broken by drain")
+	}
+	n, err := net.Dial("udp", local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+	if testPing(n, 200*time.Millisecond) {
+		t.Error("new flow is accepted during drain")
+	}
+	select {
+	case <-drained:
+	case <-time.After(3 * time.Second):
+		t.Fatal("drain exceeded deadline")
+	}
+	if testPing(c, 200*time.Millisecond) {
+		t.Error("flow is not closed after drain deadline")
+	}
+	if m := l.Metrics(); m.Active != 0 {
+		t.Errorf("flows are not released: %+v", m)
+	}
+}
+
+func TestUDPDrainTimeoutLimit(t *testing.T) {
+	backend := testEchoBackend(t)
+	defer backend.Close()
+
+	local := testFreeAddr(t)
+	cfg, _ := config.New("udp", local, backend.LocalAddr().String())
+	p := New(cfg, health.New(cfg), limit.New(cfg.Limits))
+	go p.Start()
+
+	c := testClient(t, local)
+	defer c.Close()
+	// active flow would keep port for whole idle timeout, replacement listener could not bind
+	start := time.Now()
+	p.Drain(time.Minute)
+	if d := time.Since(start); d < maxDrainTimeout || d > maxDrainTimeout+2*time.Second {
+		t.Errorf("drain is not limited: %v", d)
+	}
+}
+
+func TestUDPStopClosesFlows(t *testing.T) {
+	backend := testEchoBackend(t)
+	defer backend.Close()
+
+	local := testFreeAddr(t)
+	cfg, _ := config.New("udp", local, backend.LocalAddr().String())
+	l := limit.New(cfg.Limits)
+	p := New(cfg, health.New(cfg), l)
+	go p.Start()
+
+	c := testClient(t, local)
+	defer c.Close()
+	p.Stop()
+	if p.count() != 0 {
+		t.Errorf("flows are not closed: %d", p.count())
+	}
+	if m := l.Metrics(); m.Active != 0 {
+		t.Errorf("flows are not released: %+v", m)
+	}
+	if testPing(c, 200*time.Millisecond) {
+		t.Error("datagram is relayed after stop")
+	}
+}
+
+func TestUDPLoad(t *testing.T) {
+	backend := testEchoBackend(t)
+	defer backend.Close()
+
+	local := testFreeAddr(t)
+	cfg, _ := config.New("udp", local, backend.LocalAddr().String())
+	l := limit.New(cfg.Limits)
+	p := New(cfg, health.New(cfg), l)
+	go p.Start()
+	defer p.Stop()
+	testClient(t, local).Close()
+
+	const clients = 50
+	const packets = 100
+	errs := make(chan error, clients)
+	for i := 0; i < clients; i++ {
+		go func(i int) {
+			c, err := net.Dial("udp", local)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer c.Close()
+			buf := make([]byte, 64)
+			for j := 0; j < packets; j++ {
+				msg := fmt.Sprintf("client %d packet %d", i, j)
+				// datagram can be lost under load, it is sent again
+				var err error
+				for retry := 0; retry < 5; retry++ {
+					c.SetDeadline(time.Now().Add(500 * time.Millisecond))
+					if _, err = c.Write([]byte(msg)); err != nil {
+						continue
+					}
+					var n int
+					if n, err = c.Read(buf); err == nil && string(buf[:n]) != msg {
+						// late reply of previous retry
+						n, err = c.Read(buf)
+					}
+					if err == nil && string(buf[:n]) == msg {
+						break
+					}
+				}
+				if err != nil {
+					errs <- fmt.Errorf("client %d: %v", i, err)
+					return
+				}
+			}
+			errs <- nil
+		}(i)
+	}
+	for i := 0; i < clients; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+	// flow of testClient is still open
+	if n := p.count(); n != clients+1 {
+		t.Errorf("unexpected flows: %d", n)
+	}
+}
+
+func TestUDPLargeDatagram(t *testing.T) {
+	backend := testEchoBackend(t)
+	defer backend.Close()
+
+	local := testFreeAddr(t)
+	cfg, _ := config.New("udp", local, backend.LocalAddr().String())
+	p := New(cfg, health.New(cfg), limit.New(cfg.Limits))
+	go p.Start()
+	defer p.Stop()
+
+	c := testClient(t, local)
+	defer c.Close()
+	msg := bytes.Repeat([]byte("x"), 8000)
+	c.SetDeadline(time.Now().Add(2 * time.Second))
+	c.Write(msg)
+	buf := make([]byte, 16000)
+	n, err := c.Read(buf)
+	if err != nil || !bytes.Equal(buf[:n], msg) {
+		t.Errorf("datagram is truncated: %d %v", n, err)
+	}
+}
+
+func TestUDPIdleTimeout(t *testing.T) {
+	backend := testEchoBackend(t)
+	defer backend.Close()
+
+	local := testFreeAddr(t)
+	cfg, _ := config.New("udp", local, backend.LocalAddr().String())
+	cfg.IdleTimeout = 300 * time.Millisecond
+	l := limit.New(cfg.Limits)
+	p := New(cfg, health.New(cfg), l)
+	go p.Start()
+	defer p.Stop()
+
+	c := testClient(t, local)
+	defer c.Close()
+	// datagrams keep flow alive
+	for i := 0; i < 5; i++ {
+		time.Sleep(100 * time.Millisecond)
+		if !testPing(c, time.Second) {
+			t.Fatal("active flow is broken")
+		}
+	}
+	if p.count() != 1 {
+		t.Fatal("active flow is closed")
+	}
+	for i := 0; i < 50 && p.count() > 0; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if p.count() != 0 || l.Metrics().Active != 0 {
+		t.Errorf("idle flow is not released: %d %+v", p.count(), l.Metrics())
+	}
+	if !testPing(c, time.Second) {
+		t.Error("flow is not opened again")
+	}
+}
+
+func TestUDPBackendFailure(t *testing.T) {
+	backend := testEchoBackend(t)
+	defer backend.Close()
+
+	local := testFreeAddr(t)
+	// first flow goes to invalid backend, listener keeps serving other flows
+	cfg, _ := config.New("udp", local, "127.0.0.1:invalid,"+backend.LocalAddr().String())
+	cfg.Scheduler = scheduler.RoundRobinName
+	p := New(cfg, health.New(cfg), limit.New(cfg.Limits))
+	go p.Start()
+	defer p.Stop()
+
+	for i := 0; i < 3; i++ {
+		c := testClient(t, local)
+		c.Close()
+	}
+}
+
+func TestUDPMetrics(t *testing.T) {
+	backend := testEchoBackend(t)
+	defer backend.Close()
+
+	local := testFreeAddr(t)
+	cfg, _ := config.New("udp", local, backend.LocalAddr().String())
+	m := metrics.New()
+	cfg.Metrics = m
+	p := New(cfg, health.New(cfg), limit.New(cfg.Limits))
+	go p.Start()
+
+	c := testClient(t, local)
+	defer c.Close()
+	before := m.Snapshot()
+	if !testPing(c, time.Second) {
+		t.Fatal("datagram is not relayed")
+	}
+	p.Stop()
+
+	s := m.Snapshot()
+	if s.Sessions != 1 || s.Active != 0 || s.BytesIn-before.BytesIn != 4 || s.BytesOut-before.BytesOut != 4 {
+		t.Errorf("unexpected metrics: %+v", s)
+	}
+}
+
+func TestUDPIdleFlowsMemory(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("flows hold read buffer while they wait for backend")
+	}
+	backend := testEchoBackend(t)
+	defer backend.Close()
+
+	local := testFreeAddr(t)
+	cfg, _ := config.New("udp", local, backend.LocalAddr().String())
+	p := New(cfg, health.New(cfg), limit.New(cfg.Limits))
+	go p.Start()
+	defer p.Stop()
+	testClient(t, local).Close()
+
+	var before runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	// clients with random source port per query (e.g. DNS) leave many idle flows
+	const flows = 1000
+	for i := 0; i < flows; i++ {
+		c, err := net.Dial("udp", local)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// client is kept open so its port is not reused by next client
+		defer c.Close()
+		if !testPing(c, time.Second) {
+			t.Fatalf("flow %d is not relayed", i)
+		}
+	}
+	if n := p.count(); n < flows {
+		t.Fatalf("flows are closed before idle timeout: %d", n)
+	}
+	var after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	// read buffer of every flow would take 64MB
+	if grow := int64(after.HeapInuse) - int64(before.HeapInuse); grow > 16<<20 {
+		t.Errorf("idle flows hold too much memory: %d bytes", grow)
+	}
+}
+
+func TestUDPStopBeforeBind(t *testing.T) {
+	// port is bound by other listener, new listener retries bind
+	busy, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := busy.LocalAddr().String()
+	cfg, _ := config.New("udp", local, "127.0.0.1:1")
+	p := New(cfg, health.New(cfg), limit.New(cfg.Limits))
+	started := make(chan struct{})
+	go func() {
+		p.Start()
+		close(started)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	p.Stop()
+	busy.Close()
+	select {
+	case <-started:
+	case <-time.After(2 * time.Second):
+		t.Fatal("stopped listener keeps retrying bind")
+	}
+	// port is not leaked by stopped listener
+	c, err := net.ListenPacket("udp", local)
+	if err != nil {
+		t.Fatalf("port is leaked: %v", err)
+	}
+	c.Close()
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package udp
+
+import "net"
+
+// waitReadable returns immediately, flow holds read buffer while it waits for backend
+func waitReadable(c *net.UDPConn) error {
+	return nil
+}
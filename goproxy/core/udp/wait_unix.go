@@ -0,0 +1,41 @@
+//go:build unix
+
+package udp
+
+import (
+	"net"
+	"os"
+	"syscall"
+)
+
+// waitReadable blocks until datagram is waiting in socket or read deadline expires, datagram is kept
+// in socket, so flow does not need read buffer while it waits for backend
+func waitReadable(c *net.UDPConn) error {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var peekErr error
+	err = rc.Read(func(fd uintptr) bool {
+		var b [1]byte
+		for {
+			// socket is non-blocking, peek does not consume datagram
+			_, _, e := syscall.Recvfrom(int(fd), b[:], syscall.MSG_PEEK)
+			switch e {
+			case syscall.EINTR:
+				continue
+			case syscall.EAGAIN:
+				return false
+			case nil:
+			default:
+				// pending socket error (e.g. closed port of backend) is consumed by peek
+				peekErr = os.NewSyscallError("recvfrom", e)
+			}
+			return true
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return peekErr
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+const LOGREDACT_MASK = "[REDACTED]"
+
+// patterns of secrets which are replaced in every log message
+var logredactPatterns = []struct {
+	re   *regexp.Regexp
+	repl string
+}{
+	// private keys in PEM format, also with escaped newlines in JSON
+	{regexp.MustCompile(`-----BEGIN [A-Z0-9 ]*PRIVATE KEY-----[\s\S]*?-----END [A-Z0-9 ]*PRIVATE KEY-----`), LOGREDACT_MASK},
+	// JWT
+	{regexp.MustCompile(`eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`), LOGREDACT_MASK},
+	// value of Authorization header
+	{regexp.MustCompile(`(?i)\b(basic|bearer) +[A-Za-z0-9._~+/-]+=*`), "$1 " + LOGREDACT_MASK},
+	// JSON values of secret fields
+	{regexp.MustCompile(`(?i)("[a-z_]*(?:password|secret|token|jwt|key)[a-z_]*"\s*:\s*)"(?:[^"\\]|\\.)*"`), `$1"` + LOGREDACT_MASK + `"`},
+	// password in URL
+	{regexp.MustCompile(`(://[^/\s:@]+:)[^/\s@]+@`), "$1" + LOGREDACT_MASK + "@"},
+}
+
+// secrets known at runtime (device secret, websocket credentials), they are replaced even if no pattern matches
+var logredactSecrets = map[string]bool{}
+var logredactLock sync.RWMutex
+
+// LogRedactRegister adds secret which must never appear in logs
+func LogRedactRegister(secret string) {
+	// short values would mask common words
+	if len(secret) < 6 {
+		return
+	}
+	logredactLock.Lock()
+	defer logredactLock.Unlock()
+	logredactSecrets[secret] = true
+}
+
+// LogRedact replaces credentials, secrets and tokens in log text
+func LogRedact(s string) string {
+	logredactLock.RLock()
+	for secret := range logredactSecrets {
+		s = strings.ReplaceAll(s, secret, LOGREDACT_MASK)
+	}
+	logredactLock.RUnlock()
+	for _, p := range logredactPatterns {
+		s = p.re.ReplaceAllString(s, p.repl)
+	}
+	return s
+}
+
+// logredactHook redacts message and fields of log entry before it is written
+type logredactHook struct{}
+
+func (h *logredactHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *logredactHook) Fire(e *logrus.Entry) error {
+	e.Message = LogRedact(e.Message)
+	for k, v := range e.Data {
+		switch v := v.(type) {
+		case string:
+			e.Data[k] = LogRedact(v)
+		case error:
+			e.Data[k] = LogRedact(v.Error())
+		case fmt.Stringer:
+			e.Data[k] = LogRedact(v.String())
+		}
+	}
+	return nil
+}
+
+// LogRedactInstall adds redaction to logger
+func LogRedactInstall(l *logrus.Logger) {
+	l.AddHook(&logredactHook{})
+}
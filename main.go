@@ -31,7 +31,7 @@ func help(err string, out io.Writer) {
 	fmt.Fprintf(out, "Usage of %s <global flags>:\n", os.Args[0])
 	fmt.Fprintln(out, "  Global flags:")
 	fmt.Fprintln(out, "    -debug: Run in debug mode with more detailed logging")
-	fmt.Fprintln(out, "    -nofwcontrol: Disable control windows firewall rules")
+	fmt.Fprintln(out, "    -nofwcontrol: Disable control of host firewall rules (windows firewall, nftables, iptables)")
 	fmt.Fprintln(out, "    -version: Prints the version")
 	fmt.Fprintln(out, "    -h, -help: Prints this help message")
 	fmt.Fprintln(out, "    -log: Log to file in ./config directory")
@@ -43,6 +43,9 @@ func help(err string, out io.Writer) {
 func main() {
 	// initialize logrus
 	log = logrus.New()
+	// secrets must not reach logs, also logs of packages using standard logger
+	LogRedactInstall(log)
+	LogRedactInstall(logrus.StandardLogger())
 
 	flag.Usage = func() {
 		help("", os.Stderr)
@@ -51,7 +54,7 @@ func main() {
 
 	runFlag := flag.Bool("run", false, "Run in CLI mode.")
 	debugFlag := flag.Bool("debug", false, "Run in debug mode with more detailed logging.")
-	noFwFlag := flag.Bool("nofwcontrol", false, "Disable control Windows firewall.")
+	noFwFlag := flag.Bool("nofwcontrol", false, "Disable control of host firewall.")
 	desktopFlag := flag.Bool("desktop", false, "Run in desktop service mode for interact with tray app.")
 	serviceFlag := flag.String("service", "", "Control the system service.")
 	printVersion := flag.Bool("version", false, "Print version")
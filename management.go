@@ -10,6 +10,7 @@ import (
 	"net/http"
 	"runtime"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/matishsiao/goInfo"
@@ -17,49 +18,111 @@ import (
 
 var gtelLogin OAuthLoginResponse
 
+// login is used by telemetry, os updater and wstunnel in parallel, lock protects only login state,
+// network call is done outside of it so stop of service is not blocked by hanging login
+var gtelLoginLock sync.Mutex
+
+// logins are serialized so parallel callers do not login more times
+var gtelLoginRunLock sync.Mutex
+
+// incremented on reset, result of login started before reset is dropped
+var gtelLoginGeneration int
+
+// timeout of login to management server
+const TELEMETRY_LOGINTIMEOUT = 30 * time.Second
+
+// telemetryToken returns JWT of device, login is repeated before token expires or when refresh is requested
+func telemetryToken(refresh bool) (string, error) {
+	if refresh {
+		telemetryLoginInvalidate()
+	}
+	if err := telemetryLogin(); err != nil {
+		return "", err
+	}
+	gtelLoginLock.Lock()
+	defer gtelLoginLock.Unlock()
+	return gtelLogin.JWTToken, nil
+}
+
+// telemetryLoginInvalidate forces new login, e.g. when server rejected token
+func telemetryLoginInvalidate() {
+	gtelLoginLock.Lock()
+	defer gtelLoginLock.Unlock()
+	gtelLogin.ValidTo = time.Now().UTC().Add(-1000 * time.Hour)
+}
+
+// telemetryLoginReset forgets login, running login does not store its result
+func telemetryLoginReset() {
+	gtelLoginLock.Lock()
+	defer gtelLoginLock.Unlock()
+	gtelLogin = OAuthLoginResponse{}
+	gtelLoginGeneration++
+}
+
+// telemetryLoginValid returns generation of login state and whether login is still valid
+func telemetryLoginValid() (int, bool) {
+	gtelLoginLock.Lock()
+	defer gtelLoginLock.Unlock()
+	return gtelLoginGeneration, !gtelLogin.ValidTo.UTC().Local().Add(-300 * time.Second).Before(time.Now().UTC())
+}
+
 func telemetryLogin() error {
-	if gtelLogin.ValidTo.UTC().Local().Add(-300 * time.Second).Before(time.Now().UTC()) {
-		gi, _ := goInfo.GetInfo()
-		uri := myconfig.Uri + "api/oauth/authorize"
-		log.Info("Login  to management server: ", uri)
-		timst := time.Now().UTC().Unix()
-		keymaterial := strconv.FormatInt(timst, 10) + "|" + myconfig.Secret
-		hash := sha256.Sum256([]byte(keymaterial))
-		var jsonReq []byte
-		req := OAuthLoginRequest{
-			AccessID:      myconfig.AccessId,
-			Timestamp:     timst,
-			Key:           base64.URLEncoding.EncodeToString(hash[:]),
-			ClientID:      myconfig.RPCClientID,
-			ClientOS:      runtime.GOOS + ", " + gi.OS + ", " + gi.Core,
-			ClientInfo:    gi.Hostname,
-			ClientVersion: APPVERSION,
-		}
-		jsonReq, _ = json.Marshal(req)
-		log.Debug("Login message: ", string(jsonReq))
-		response, err := http.Post(uri, "application/json; charset=utf-8", bytes.NewBuffer(jsonReq))
-		if err != nil {
-			log.Error("Login error - post: ", err)
-			time.Sleep(1000 * time.Millisecond)
-			return err
-		}
-		log.Debug("Login http status: ", response.Status)
-		if response.StatusCode != 200 {
-			return errors.New("http error")
-		}
-		bodyBytes, err := ioutil.ReadAll(response.Body)
-		if err != nil {
-			log.Error("Login error - post/read: ", err)
-			return err
-		}
-		log.Debug("login response bytes: ", string(bodyBytes))
-		err = json.Unmarshal(bodyBytes, &gtelLogin)
-		if err != nil {
-			log.Error("Login error - post/unmarshal: ", err)
-			log.Error("Login error - post/unmarshal - body: ", string(bodyBytes))
-		}
+	gtelLoginRunLock.Lock()
+	defer gtelLoginRunLock.Unlock()
+	LogRedactRegister(myconfig.Secret)
+	generation, valid := telemetryLoginValid()
+	if valid {
+		return nil
+	}
+	gi, _ := goInfo.GetInfo()
+	uri := myconfig.Uri + "api/oauth/authorize"
+	log.Info("Login  to management server: ", uri)
+	timst := time.Now().UTC().Unix()
+	keymaterial := strconv.FormatInt(timst, 10) + "|" + myconfig.Secret
+	hash := sha256.Sum256([]byte(keymaterial))
+	var jsonReq []byte
+	req := OAuthLoginRequest{
+		AccessID:      myconfig.AccessId,
+		Timestamp:     timst,
+		Key:           base64.URLEncoding.EncodeToString(hash[:]),
+		ClientID:      myconfig.RPCClientID,
+		ClientOS:      runtime.GOOS + ", " + gi.OS + ", " + gi.Core,
+		ClientInfo:    gi.Hostname,
+		ClientVersion: APPVERSION,
+	}
+	jsonReq, _ = json.Marshal(req)
+	log.Debug("Login message: ", string(jsonReq))
+	client := &http.Client{Timeout: TELEMETRY_LOGINTIMEOUT}
+	response, err := client.Post(uri, "application/json; charset=utf-8", bytes.NewBuffer(jsonReq))
+	if err != nil {
+		log.Error("Login error - post: ", err)
+		time.Sleep(1000 * time.Millisecond)
+		return err
+	}
+	defer response.Body.Close()
+	log.Debug("Login http status: ", response.Status)
+	if response.StatusCode != 200 {
+		return errors.New("http error")
+	}
+	bodyBytes, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		log.Error("Login error - post/read: ", err)
 		return err
 	}
+	log.Debug("login response bytes: ", string(bodyBytes))
+	var login OAuthLoginResponse
+	err = json.Unmarshal(bodyBytes, &login)
+	if err != nil {
+		log.Error("Login error - post/unmarshal: ", err)
+		log.Error("Login error - post/unmarshal - body: ", string(bodyBytes))
+		return err
+	}
+	gtelLoginLock.Lock()
+	defer gtelLoginLock.Unlock()
+	if generation != gtelLoginGeneration {
+		return errors.New("login was reset")
+	}
+	gtelLogin = login
 	return nil
 }
 
@@ -80,7 +143,7 @@ func telemetryCollectLogData() string {
 	select {
 	case l := <-logdata:
 		if l != "" {
-			tmplog += l + "\n"
+			tmplog += LogRedact(l) + "\n"
 		}
 	case <-time.After(time.Duration(myconfig.SendInterval) * 1000 * time.Millisecond):
 	}
@@ -89,7 +152,7 @@ func telemetryCollectLogData() string {
 		select {
 		case l := <-logdata:
 			if l != "" {
-				tmplog += l + "\n"
+				tmplog += LogRedact(l) + "\n"
 			}
 		case <-time.After(100 * time.Millisecond):
 			logreading = false
@@ -122,9 +185,11 @@ func telemetrySend() (ret bool) {
 
 	ret = false
 	// sned telemetry
-	if e := telemetryLogin(); e == nil {
+	if token, e := telemetryToken(false); e == nil {
 		uri := myconfig.Uri + "api/management/message"
 		log.Debug("Sending telemetry to: ", uri)
+		state, _ := connstate.State()
+		events := connstate.Unsent()
 		request := ManagementRequest{
 			AccessID:      myconfig.AccessId,
 			ClientID:      myconfig.RPCClientID,
@@ -132,14 +197,17 @@ func telemetrySend() (ret bool) {
 			DnsHash:       dnsconf.DnsHash,
 			Timestamp:     time.Now().UTC(),
 			LogData:       tmplog,
-			OverWebSocket: myconfig.RestrictedNetwork,
-			IsConnected:   NetutilsPing(lighthouseIP),
+			OverWebSocket: svcRestrictedNetwork.Load(),
+			IsConnected:   NetprobeConnected(),
+			State:         state.String(),
+			StateEvents:   events,
+			Peers:         PeerstatsList(false),
 		}
 		jsonReq, _ := json.Marshal(request)
 		log.Debug("http req: ", string(jsonReq))
 
 		req, _ := http.NewRequest("POST", uri, bytes.NewBuffer(jsonReq))
-		req.Header.Set("Authorization", "Bearer "+gtelLogin.JWTToken)
+		req.Header.Set("Authorization", "Bearer "+token)
 		req.Header.Add("Accept", "application/json; charset=utf-8")
 		client := &http.Client{}
 		response, err := client.Do(req)
@@ -149,11 +217,15 @@ func telemetrySend() (ret bool) {
 
 		log.Debug("http resp: ", response.Status)
 		if response.StatusCode == 401 {
-			gtelLogin.ValidTo = time.Now().UTC().Add(-1000 * time.Hour)
+			telemetryLoginInvalidate()
 			panic(errors.New("unauthorized call to management API (401)"))
 		} else if response.StatusCode != 200 {
 			panic(errors.New("status code from management API != 200: " + response.Status))
 		}
+		// state events were delivered
+		if len(events) > 0 {
+			connstate.Ack(events[len(events)-1].Seq)
+		}
 		bodyBytes, err := ioutil.ReadAll(response.Body)
 		if err != nil {
 			panic(err)
@@ -175,9 +247,8 @@ func telemetrySend() (ret bool) {
 		}
 		// resolve DNS
 		newIPs := ServiceCheckServiceDNSIPs()
-		if ServiceCheckServiceDNSIPsChanged(newIPs) {
+		if ServiceCheckUpdateServiceDNSIPs(newIPs) {
 			log.Info("DNS IP change detected, new IPs: ", newIPs)
-			ServicecheckServiceDNSIPsData = newIPs
 			ret = true
 		}
 	}
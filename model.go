@@ -3,22 +3,47 @@ package main
 import "time"
 
 type NebulaClientYamlConfig struct {
-	AccessId                  int    `yaml:"accessid"`
-	PublicIP                  string `yaml:"publicip"`
-	Uri                       string `yaml:"uri"`
-	Secret                    string `yaml:"secret"`
-	Debug                     bool   `yaml:"debug"`
-	SendInterval              int    `yaml:"sendinterval"`
-	LocalUDPPort              int    `yaml:"localudpport"`
-	RunAsDeskServiceRPC       bool   `yaml:"-"`
-	RestrictedNetwork         bool   `yaml:"-"`
-	LighthouseRoute           bool   `yaml:"-"`
-	RPCClientID               string `yaml:"-"`
-	WindowsFW                 bool   `yaml:"-"`                         //windows firewall
-	AutoUpdate                bool   `yaml:"-"`                         // autoupdate enabled
-	AutoUpdateIntervalMinutes int64  `yaml:"autoupdateintervalminutes"` // autoupdate interval
-	AutoUpdateChannel         string `yaml:"autoupdatechannel"`         // autoupdate channel
-	DisableHostsEdit          bool   `yaml:"disablehostsedit"`          // disable hosts file edit
+	AccessId                  int                     `yaml:"accessid"`
+	PublicIP                  string                  `yaml:"publicip"`
+	Uri                       string                  `yaml:"uri"`
+	Secret                    string                  `yaml:"secret"`
+	Debug                     bool                    `yaml:"debug"`
+	SendInterval              int                     `yaml:"sendinterval"`
+	LocalUDPPort              int                     `yaml:"localudpport"`
+	RunAsDeskServiceRPC       bool                    `yaml:"-"`
+	LighthouseRoute           bool                    `yaml:"-"`
+	KillSwitch                bool                    `yaml:"-"` // block traffic outside of tunnel in full-tunnel mode
+	RPCClientID               string                  `yaml:"-"`
+	WindowsFW                 bool                    `yaml:"-"`                         // host firewall control (netsh, nftables, iptables)
+	AutoUpdate                bool                    `yaml:"-"`                         // autoupdate enabled
+	AutoUpdateIntervalMinutes int64                   `yaml:"autoupdateintervalminutes"` // autoupdate interval
+	AutoUpdateChannel         string                  `yaml:"autoupdatechannel"`         // autoupdate channel
+	DisableHostsEdit          bool                    `yaml:"disablehostsedit"`          // disable hosts file edit
+	FirewallBlockListeners    bool                    `yaml:"firewallblocklisteners"`    // block non-mesh traffic to appliance listener ports
+	ConnectivityProbe         string                  `yaml:"connectivityprobe"`         // comma separated probes: icmp, udp, http, nebula
+	ConnectivityProbeURL      string                  `yaml:"connectivityprobeurl"`      // URL for http probe, {lighthouse} is replaced by lighthouse IP
+	CaptivePortalURL          string                  `yaml:"captiveportalurl"`          // known-content URL for captive portal detection
+	CaptivePortalContent      string                  `yaml:"captiveportalcontent"`      // expected content of captive portal URL, empty means 204 No Content
+	RestrictedNetworkPolicy   RestrictedNetworkPolicy `yaml:"restrictednetworkpolicy"`   // defaults for policy, values sent by management server take precedence
+}
+
+// RestrictedNetworkPolicy controls switching between UDP and websocket tunnel, zero values mean defaults,
+// options are pointers so explicit false from management server overrides local config
+type RestrictedNetworkPolicy struct {
+	Mode                     string  `json:"mode" yaml:"mode"`                                         // auto, force-udp, force-websocket
+	MaxRetry                 int     `json:"maxretry" yaml:"maxretry"`                                 // failed probes before test of websocket tunnel
+	SwitchBack               string  `json:"switchback" yaml:"switchback"`                             // idle (no active tunnels), always, never
+	SwitchBackRetry          int     `json:"switchbackretry" yaml:"switchbackretry"`                   // probes in restricted mode before test of UDP
+	PingIntervalMs           int     `json:"pingintervalms" yaml:"pingintervalms"`                     // probe interval
+	PingIntervalMaxMs        int     `json:"pingintervalmaxms" yaml:"pingintervalmaxms"`               // max probe interval while connected
+	TunnelIdleTimeoutMinutes float64 `json:"tunnelidletimeoutminutes" yaml:"tunnelidletimeoutminutes"` // tunnel without traffic is inactive
+	WSReadInactivitySeconds  float64 `json:"wsreadinactivityseconds" yaml:"wsreadinactivityseconds"`   // websocket without read is timed out
+	WSMaxTimeouts            int     `json:"wsmaxtimeouts" yaml:"wsmaxtimeouts"`                       // websocket timeouts before reconnect
+	WSFramed                 *bool   `json:"wsframed" yaml:"wsframed"`                                 // batch datagrams into framed websocket messages if server supports it
+	WSCompression            *bool   `json:"wscompression" yaml:"wscompression"`                       // permessage-deflate compression if server supports it
+	WSPingIntervalSeconds    float64 `json:"wspingintervalseconds" yaml:"wspingintervalseconds"`       // websocket keepalive ping interval
+	WSPongTimeoutSeconds     float64 `json:"wspongtimeoutseconds" yaml:"wspongtimeoutseconds"`         // websocket without pong is dead after ping interval plus this timeout
+	WSBearerAuth             *bool   `json:"wsbearerauth" yaml:"wsbearerauth"`                         // authenticate websocket by device JWT instead of shared username and password
 }
 
 type NebulaLocalYamlConfig struct {
@@ -43,14 +68,17 @@ type OAuthLoginResponse struct {
 }
 
 type ManagementRequest struct {
-	AccessID      int       `json:"access_id"`
-	ClientID      string    `json:"clientid"`
-	ConfigHash    string    `json:"confighash"`
-	DnsHash       string    `json:"dnshash"`
-	Timestamp     time.Time `json:"timestamp"`
-	LogData       string    `json:"log_data"`
-	IsConnected   bool      `json:"is_connected"`
-	OverWebSocket bool      `json:"over_websocket"`
+	AccessID      int              `json:"access_id"`
+	ClientID      string           `json:"clientid"`
+	ConfigHash    string           `json:"confighash"`
+	DnsHash       string           `json:"dnshash"`
+	Timestamp     time.Time        `json:"timestamp"`
+	LogData       string           `json:"log_data"`
+	IsConnected   bool             `json:"is_connected"`
+	OverWebSocket bool             `json:"over_websocket"`
+	State         string           `json:"state"`
+	StateEvents   []ConnStateEvent `json:"state_events,omitempty"`
+	Peers         []PeerStats      `json:"peers,omitempty"`
 }
 
 type ManagementOSAutoupdateRequest struct {
@@ -87,6 +115,7 @@ type ManagementResponseConfig struct {
 	ApplianceListeners        []ManagementResponseListener         `json:"listeners"`
 	NebulaCIDR                string                               `json:"nebulacidr"`
 	OSAutoupdatePolicy        ManagementResponseOSAutoupdatePolicy `json:"osautoupdatepolicy"`
+	RestrictedNetworkPolicy   RestrictedNetworkPolicy              `json:"restrictednetworkpolicy"`
 }
 
 type ManagementResponseOSAutoupdatePolicy struct {
@@ -101,7 +130,51 @@ type ManagementResponseListener struct {
 	Port        int    `json:"port"`
 	Protocol    string `json:"protocol"`
 	ForwardPort int    `json:"forwardport"`
-	ForwardHost string `json:"forwardhost"`
+	ForwardHost string `json:"forwardhost"` // comma separated backends, host or host:port
+	// path of HTTP health check of backends, TCP connect is used if empty
+	HealthCheckPath string `json:"healthcheckpath"`
+	// interval of active health checks, zero means default (checks run only with more backends), negative disables them
+	HealthCheckIntervalSeconds int `json:"healthcheckinterval"`
+	// iphash (default), random, roundrobin, leastconn, weightedroundrobin, weightedleastconn
+	Scheduler string `json:"scheduler"`
+	// weights of backends in order of forward hosts, missing weight is 1
+	Weights []int `json:"weights"`
+	// version of PROXY protocol header sent to TCP backends (1 or 2), 0 disables it
+	ProxyProtocol int `json:"proxyprotocol"`
+	// peers allowed by nebula certificate name or group, all peers passing nebula firewall are allowed if both are empty
+	AllowedNames  []string `json:"allowednames"`
+	AllowedGroups []string `json:"allowedgroups"`
+	// limits of listener and of every peer, zero values mean unlimited
+	Limits ManagementResponseListenerLimits `json:"limits"`
+	// routes of http and https listener, forward host of listener is default route
+	Routes []ManagementResponseListenerRoute `json:"routes"`
+	// PEM certificate and key of https listener
+	TLSCert string `json:"tlscert"`
+	TLSKey  string `json:"tlskey"`
+	// seconds active sessions may finish when listener is reconfigured, zero means default (30s), negative closes them immediately,
+	// UDP listener keeps its port while draining so its drain is limited to 5s
+	DrainTimeoutSeconds int `json:"draintimeout"`
+	// seconds after idle UDP flow or TCP session is closed, zero means default (30s for UDP, never for TCP)
+	IdleTimeoutSeconds int `json:"idletimeout"`
+	// seconds after TCP session closed by one side is closed without data in other direction,
+	// zero means that idle timeout applies
+	HalfCloseTimeoutSeconds int `json:"halfclosetimeout"`
+}
+
+type ManagementResponseListenerRoute struct {
+	Host        string `json:"host"`        // empty host matches any host
+	PathPrefix  string `json:"pathprefix"`  // empty prefix matches any path
+	ForwardPort int    `json:"forwardport"` // forward port of listener is used if zero
+	ForwardHost string `json:"forwardhost"` // comma separated backends, host or host:port
+}
+
+type ManagementResponseListenerLimits struct {
+	MaxConnections          int     `json:"maxconnections"`          // concurrent TCP connections or UDP flows
+	MaxConnectionsPerSource int     `json:"maxconnectionspersource"` // concurrent connections of one peer
+	ConnectionRate          float64 `json:"connectionrate"`          // new connections per second
+	ConnectionRatePerSource float64 `json:"connectionratepersource"` // new connections of one peer per second
+	Bandwidth               int64   `json:"bandwidth"`               // bytes per second in both directions
+	BandwidthPerSource      int64   `json:"bandwidthpersource"`      // bytes per second of one peer
 }
 
 type ManagementResponse struct {
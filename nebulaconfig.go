@@ -131,10 +131,10 @@ func NebulaConfigCreate(configdata string, punchback bool, isrestrictednetwork b
 
 	// if there is enabled LighthouseRoute add there routes via lighthouse
 	if myconfig.LighthouseRoute {
-		if len(ServicecheckServiceDNSIPsData) > 0 {
+		if serviceIPs := ServiceCheckGetServiceDNSIPs(); len(serviceIPs) > 0 {
 			// generate route list
-			log.Debug("ServicecheckServiceDNSIPsData: ", ServicecheckServiceDNSIPsData)
-			routeList := NetutilsGenerateRoutes(ServicecheckServiceDNSIPsData)
+			log.Debug("service IPs: ", serviceIPs)
+			routeList := NetutilsGenerateRoutes(serviceIPs)
 			// add routes to lighthouse
 			for _, v := range routeList {
 				c.Tun.UnsafeRoutes = append(c.Tun.UnsafeRoutes, NebulaYamlConfigUnsafeRoutes{Route: v, Via: lhInternalIP})
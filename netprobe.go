@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/slackhq/nebula/iputil"
+)
+
+const (
+	NETPROBE_ICMP   = "icmp"
+	NETPROBE_UDP    = "udp"
+	NETPROBE_HTTP   = "http"
+	NETPROBE_NEBULA = "nebula"
+
+	// default strategy keeps ICMP ping to lighthouse, nebula hostmap check does not prove that
+	// lighthouse answers, so it has to be enabled explicitly (e.g. in unprivileged containers)
+	NETPROBE_DEFAULT = NETPROBE_ICMP
+)
+
+// NetProbe checks connectivity to lighthouse
+type NetProbe interface {
+	Name() string
+	Probe() bool
+}
+
+// ICMP ping to lighthouse over overlay network, requires raw sockets
+type netprobeICMP struct{}
+
+func (p *netprobeICMP) Name() string {
+	return NETPROBE_ICMP
+}
+
+func (p *netprobeICMP) Probe() bool {
+	if lighthouseIP == "" {
+		return false
+	}
+	return NetutilsPing(lighthouseIP)
+}
+
+// UDP echo to lighthouse public address, tests underlay reachability of lighthouse
+type netprobeUDP struct{}
+
+func (p *netprobeUDP) Name() string {
+	return NETPROBE_UDP
+}
+
+func (p *netprobeUDP) Probe() bool {
+	return servicecheckUDPCheckLighthouse()
+}
+
+// HTTP request over overlay network, any HTTP response means that overlay works
+type netprobeHTTP struct {
+	url string
+}
+
+func (p *netprobeHTTP) Name() string {
+	return NETPROBE_HTTP
+}
+
+func (p *netprobeHTTP) Probe() bool {
+	if p.url == "" || lighthouseIP == "" {
+		log.Debug("netprobe http - url or lighthouse IP is not configured")
+		return false
+	}
+	url := strings.ReplaceAll(p.url, "{lighthouse}", lighthouseIP)
+	client := http.Client{Timeout: 2 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		log.Debug("netprobe http - error: ", err)
+		return false
+	}
+	resp.Body.Close()
+	return true
+}
+
+// check of established tunnel to lighthouse in nebula hostmap, no network access is needed;
+// nebula does not expose time of last received packet, so tunnel may be already dead until
+// nebula removes it from hostmap
+type netprobeNebula struct{}
+
+func (p *netprobeNebula) Name() string {
+	return NETPROBE_NEBULA
+}
+
+func (p *netprobeNebula) Probe() bool {
+	if lighthouseIP == "" || svcProcess == nil || svcProcess.nebula == nil {
+		return false
+	}
+	ip := netutilsCidrFromStr(lighthouseIP).To4()
+	if ip == nil {
+		return false
+	}
+	h := svcProcess.nebula.GetHostInfoByVpnIp(iputil.Ip2VpnIp(ip), false)
+	if h == nil {
+		return false
+	}
+	// remote index is known only after finished handshake
+	return h.RemoteIndex != 0 && (h.CurrentRemote != nil || len(h.CurrentRelaysToMe) > 0)
+}
+
+// NetprobeCreate creates probes from comma separated strategy, unknown names are skipped
+func NetprobeCreate(strategy string, url string) []NetProbe {
+	var ret []NetProbe
+	for _, n := range strings.Split(strategy, ",") {
+		switch strings.TrimSpace(strings.ToLower(n)) {
+		case NETPROBE_ICMP:
+			ret = append(ret, &netprobeICMP{})
+		case NETPROBE_UDP:
+			ret = append(ret, &netprobeUDP{})
+		case NETPROBE_HTTP:
+			ret = append(ret, &netprobeHTTP{url: url})
+		case NETPROBE_NEBULA:
+			ret = append(ret, &netprobeNebula{})
+		case "":
+		default:
+			log.Error("netprobe - unknown probe: ", n)
+		}
+	}
+	return ret
+}
+
+// NetprobeRun returns true if any of probes succeeds, probes are run in order
+func NetprobeRun(probes []NetProbe) bool {
+	for _, p := range probes {
+		if p.Probe() {
+			log.Debug("netprobe - success: ", p.Name())
+			return true
+		}
+		log.Debug("netprobe - failed: ", p.Name())
+	}
+	return false
+}
+
+// NetprobeConnected checks connectivity by configured strategy
+func NetprobeConnected() bool {
+	return NetprobeRun(NetprobeCreate(myconfig.ConnectivityProbe, myconfig.ConnectivityProbeURL))
+}
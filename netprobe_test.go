@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+type testProbe struct {
+	name   string
+	result bool
+	called int
+}
+
+func (p *testProbe) Name() string {
+	return p.name
+}
+
+func (p *testProbe) Probe() bool {
+	p.called++
+	return p.result
+}
+
+func TestNetprobeCreate(t *testing.T) {
+	log = logrus.New()
+	probes := NetprobeCreate(" ICMP, nebula,unknown,,http", "http://{lighthouse}/health")
+	names := []string{}
+	for _, p := range probes {
+		names = append(names, p.Name())
+	}
+	expected := []string{NETPROBE_ICMP, NETPROBE_NEBULA, NETPROBE_HTTP}
+	if len(names) != len(expected) {
+		t.Fatalf("expected probes %v, got %v", expected, names)
+	}
+	for i := range expected {
+		if names[i] != expected[i] {
+			t.Errorf("expected probes %v, got %v", expected, names)
+		}
+	}
+	// hostmap check is not trusted by default
+	if d := NetprobeCreate(NETPROBE_DEFAULT, ""); len(d) != 1 || d[0].Name() != NETPROBE_ICMP {
+		t.Errorf("default strategy has to use only ICMP probe")
+	}
+	if len(NetprobeCreate("", "")) != 0 {
+		t.Errorf("empty strategy has to create no probes")
+	}
+}
+
+func TestNetprobeRun(t *testing.T) {
+	log = logrus.New()
+	p1 := &testProbe{name: "p1", result: false}
+	p2 := &testProbe{name: "p2", result: true}
+	p3 := &testProbe{name: "p3", result: true}
+	if !NetprobeRun([]NetProbe{p1, p2, p3}) {
+		t.Errorf("expected success when any probe succeeds")
+	}
+	if p1.called != 1 || p2.called != 1 || p3.called != 0 {
+		t.Errorf("probes have to run in order until first success, called: %d %d %d", p1.called, p2.called, p3.called)
+	}
+	if NetprobeRun([]NetProbe{p1}) {
+		t.Errorf("expected failure when all probes fail")
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"net"
 	"sort"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-ping/ping"
@@ -12,27 +13,64 @@ import (
 )
 
 func NetutilsPing(ip string) bool {
+	// raw sockets are not available in unprivileged containers, datagram ICMP sockets are used then
+	if atomic.LoadInt32(&netutilsPingUnprivileged) != 0 {
+		return netutilsPing(ip, false)
+	}
+	if netutilsPing(ip, true) {
+		return true
+	}
+	if atomic.LoadInt32(&netutilsPingUnprivileged) != 0 {
+		return netutilsPing(ip, false)
+	}
+	return false
+}
+
+// netutilsPingUnprivileged is set when privileged ping cannot open raw socket, accessed atomically
+// because pings run in parallel
+var netutilsPingUnprivileged int32
+
+func netutilsPing(ip string, privileged bool) bool {
+	stats, err := netutilsPingStats(ip, 2, privileged)
+	if err != nil {
+		return false
+	}
+	return stats.PacketsRecv > 0
+}
+
+// NetutilsPingStats pings IP and returns statistics with RTT and packet loss
+func NetutilsPingStats(ip string, count int) (*ping.Statistics, error) {
+	if atomic.LoadInt32(&netutilsPingUnprivileged) != 0 {
+		return netutilsPingStats(ip, count, false)
+	}
+	stats, err := netutilsPingStats(ip, count, true)
+	if err != nil && atomic.LoadInt32(&netutilsPingUnprivileged) != 0 {
+		return netutilsPingStats(ip, count, false)
+	}
+	return stats, err
+}
+
+func netutilsPingStats(ip string, count int, privileged bool) (*ping.Statistics, error) {
 	pinger, err := ping.NewPinger(ip)
 	if err != nil {
 		log.Debug("ping error: ", err)
-		return false
-	} else {
-		pinger.Count = 2
-		pinger.Timeout = time.Millisecond * 500
-		pinger.Interval = time.Millisecond * 500
-		pinger.SetPrivileged(true)
-		err = pinger.Run() // Blocks until finished.
-		if err != nil {
-			return false
-		} else {
-			stats := pinger.Statistics()
-			if stats.PacketsRecv > 0 {
-				return true
-			} else {
-				return false
-			}
+		return nil, err
+	}
+	pinger.Count = count
+	pinger.Timeout = time.Millisecond * 500
+	if count > 2 {
+		pinger.Timeout = time.Millisecond * time.Duration(500*(count-1))
+	}
+	pinger.Interval = time.Millisecond * 500
+	pinger.SetPrivileged(privileged)
+	err = pinger.Run() // Blocks until finished.
+	if err != nil {
+		if privileged && strings.Contains(err.Error(), "operation not permitted") {
+			atomic.StoreInt32(&netutilsPingUnprivileged, 1)
 		}
+		return nil, err
 	}
+	return pinger.Statistics(), nil
 }
 
 func NetutilsGWDiscover() string {
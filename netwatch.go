@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// quiet period after last network event before change is handled
+const NETWATCH_DEBOUNCE = 2 * time.Second
+
+const (
+	NETWATCH_ROUTE = "route"
+	NETWATCH_ADDR  = "addr"
+	NETWATCH_LINK  = "link"
+)
+
+// NetwatchEvent is network change reported by OS
+type NetwatchEvent struct {
+	Kind   string
+	Detail string
+}
+
+func (e NetwatchEvent) String() string {
+	return fmt.Sprintf("%s(%s)", e.Kind, e.Detail)
+}
+
+// NetwatchSource delivers network change events until quit is closed
+type NetwatchSource interface {
+	Run(events chan<- NetwatchEvent, quit <-chan struct{}) error
+}
+
+// debounced network changes consumed by ServiceCheckPinger
+var servicecheckNetworkChanged = make(chan []NetwatchEvent, 1)
+
+// netwatchSend returns false if watcher is stopped while event waits for receiver
+func netwatchSend(events chan<- NetwatchEvent, quit <-chan struct{}, e NetwatchEvent) bool {
+	select {
+	case events <- e:
+		return true
+	case <-quit:
+		return false
+	}
+}
+
+// netwatchDebounce collects events until there is no new event for quiet period,
+// handler is called once for whole burst of events
+func netwatchDebounce(events <-chan NetwatchEvent, quiet time.Duration, quit <-chan struct{}, handler func([]NetwatchEvent)) {
+	var pending []NetwatchEvent
+	var timer <-chan time.Time
+	for {
+		select {
+		case <-quit:
+			return
+		case e := <-events:
+			pending = append(pending, e)
+			timer = time.After(quiet)
+		case <-timer:
+			handler(pending)
+			pending = nil
+			timer = nil
+		}
+	}
+}
+
+// NetwatchStart runs source and reports debounced changes to servicecheck, blocks until quit is closed
+func NetwatchStart(src NetwatchSource, quit <-chan struct{}) {
+	if src == nil {
+		log.Debug("netwatch - network change detection is not supported")
+		return
+	}
+	log.Info("netwatch - started")
+	events := make(chan NetwatchEvent, 64)
+	go func() {
+		if err := src.Run(events, quit); err != nil {
+			log.Error("netwatch - cannot subscribe to network changes: ", err)
+		}
+	}()
+	netwatchDebounce(events, NETWATCH_DEBOUNCE, quit, func(e []NetwatchEvent) {
+		log.Info("netwatch - network change detected: ", e)
+		select {
+		case servicecheckNetworkChanged <- e:
+		default:
+			// change is already waiting for processing
+		}
+	})
+	log.Info("netwatch - stopped")
+}
+
+// netwatchIgnoredDevice returns name of nebula tun device, its changes are caused by us
+func netwatchIgnoredDevice() string {
+	if svcProcess == nil || svcProcess.ncfg == nil {
+		return ""
+	}
+	return svcProcess.ncfg.GetString("tun.dev", "")
+}
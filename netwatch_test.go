@@ -0,0 +1,102 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// netwatchFakeSource replays prepared events
+type netwatchFakeSource struct {
+	events []NetwatchEvent
+	delay  time.Duration
+}
+
+func (f *netwatchFakeSource) Run(events chan<- NetwatchEvent, quit <-chan struct{}) error {
+	for _, e := range f.events {
+		if !netwatchSend(events, quit, e) {
+			return nil
+		}
+		time.Sleep(f.delay)
+	}
+	return nil
+}
+
+func TestNetwatchDebounce(t *testing.T) {
+	events := make(chan NetwatchEvent, 16)
+	quit := make(chan struct{})
+	defer close(quit)
+	handled := make(chan []NetwatchEvent, 16)
+	go netwatchDebounce(events, 50*time.Millisecond, quit, func(e []NetwatchEvent) {
+		handled <- e
+	})
+
+	src := &netwatchFakeSource{
+		events: []NetwatchEvent{
+			{Kind: NETWATCH_LINK, Detail: "wlan0 0"},
+			{Kind: NETWATCH_ROUTE, Detail: "del default via 192.168.1.1"},
+			{Kind: NETWATCH_ADDR, Detail: "new 10.0.0.5/24"},
+		},
+		delay: 5 * time.Millisecond,
+	}
+	go src.Run(events, quit)
+
+	select {
+	case e := <-handled:
+		if len(e) != 3 {
+			t.Errorf("expected burst of 3 events handled at once, got %v", e)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("debounced events were not handled")
+	}
+	select {
+	case e := <-handled:
+		t.Errorf("unexpected second handler call: %v", e)
+	case <-time.After(150 * time.Millisecond):
+	}
+}
+
+func TestNetwatchStart(t *testing.T) {
+	log = logrus.New()
+	// drain stale notification
+	select {
+	case <-servicecheckNetworkChanged:
+	default:
+	}
+	quit := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		NetwatchStart(&netwatchFakeSource{events: []NetwatchEvent{{Kind: NETWATCH_ROUTE, Detail: "new default"}}}, quit)
+		close(done)
+	}()
+	select {
+	case e := <-servicecheckNetworkChanged:
+		if len(e) != 1 || e[0].Kind != NETWATCH_ROUTE {
+			t.Errorf("unexpected events: %v", e)
+		}
+	case <-time.After(NETWATCH_DEBOUNCE + 2*time.Second):
+		t.Fatal("network change was not reported")
+	}
+	close(quit)
+	<-done
+}
+
+func TestNetwatchSendQuit(t *testing.T) {
+	// nobody reads events after watcher is stopped
+	events := make(chan NetwatchEvent)
+	quit := make(chan struct{})
+	done := make(chan bool)
+	go func() {
+		done <- netwatchSend(events, quit, NetwatchEvent{Kind: NETWATCH_LINK})
+	}()
+	close(quit)
+	select {
+	case sent := <-done:
+		if sent {
+			t.Error("event is sent without receiver")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("send blocks after quit")
+	}
+}
@@ -0,0 +1,116 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// netwatchNetlink watches default gateway, address and link state changes
+type netwatchNetlink struct {
+	linkFlags map[int]net.Flags
+}
+
+func netwatchCreateSource() NetwatchSource {
+	return &netwatchNetlink{linkFlags: make(map[int]net.Flags)}
+}
+
+func (n *netwatchNetlink) ignoredLink(index int) bool {
+	dev := netwatchIgnoredDevice()
+	l, err := netlink.LinkByIndex(index)
+	if err != nil {
+		// link is already gone, it is still interesting
+		return false
+	}
+	name := l.Attrs().Name
+	return name == "lo" || (dev != "" && name == dev)
+}
+
+func (n *netwatchNetlink) Run(events chan<- NetwatchEvent, quit <-chan struct{}) error {
+	routes := make(chan netlink.RouteUpdate, 16)
+	addrs := make(chan netlink.AddrUpdate, 16)
+	links := make(chan netlink.LinkUpdate, 16)
+	errCb := func(err error) {
+		log.Debug("netwatch - netlink error: ", err)
+	}
+	if err := netlink.RouteSubscribeWithOptions(routes, quit, netlink.RouteSubscribeOptions{ErrorCallback: errCb}); err != nil {
+		return err
+	}
+	if err := netlink.AddrSubscribeWithOptions(addrs, quit, netlink.AddrSubscribeOptions{ErrorCallback: errCb}); err != nil {
+		return err
+	}
+	if err := netlink.LinkSubscribeWithOptions(links, quit, netlink.LinkSubscribeOptions{ErrorCallback: errCb, ListExisting: true}); err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-quit:
+			return nil
+		case r, ok := <-routes:
+			if !ok {
+				return fmt.Errorf("route subscription closed")
+			}
+			// only default gateway changes are interesting
+			if r.Dst != nil {
+				if ones, _ := r.Dst.Mask.Size(); ones != 0 {
+					continue
+				}
+			}
+			if n.ignoredLink(r.LinkIndex) {
+				continue
+			}
+			action := "del"
+			if r.Type == unix.RTM_NEWROUTE {
+				action = "new"
+			}
+			if !netwatchSend(events, quit, NetwatchEvent{Kind: NETWATCH_ROUTE, Detail: fmt.Sprintf("%s default via %v", action, r.Gw)}) {
+				return nil
+			}
+		case a, ok := <-addrs:
+			if !ok {
+				return fmt.Errorf("addr subscription closed")
+			}
+			if a.LinkAddress.IP.IsLinkLocalUnicast() || n.ignoredLink(a.LinkIndex) {
+				continue
+			}
+			action := "del"
+			if a.NewAddr {
+				action = "new"
+			}
+			if !netwatchSend(events, quit, NetwatchEvent{Kind: NETWATCH_ADDR, Detail: fmt.Sprintf("%s %s", action, a.LinkAddress.String())}) {
+				return nil
+			}
+		case l, ok := <-links:
+			if !ok {
+				return fmt.Errorf("link subscription closed")
+			}
+			attrs := l.Attrs()
+			dev := netwatchIgnoredDevice()
+			if attrs.Name == "lo" || (dev != "" && attrs.Name == dev) {
+				continue
+			}
+			// report only up/down changes, initial listing only fills known state
+			flags := attrs.Flags & (net.FlagUp | net.FlagRunning)
+			prev, known := n.linkFlags[attrs.Index]
+			n.linkFlags[attrs.Index] = flags
+			if l.Header.Type == unix.RTM_DELLINK {
+				delete(n.linkFlags, attrs.Index)
+			}
+			if known && prev == flags && l.Header.Type != unix.RTM_DELLINK {
+				continue
+			}
+			if !known && l.Header.Type == unix.RTM_NEWLINK && l.Header.Seq != 0 {
+				// existing link from initial listing
+				continue
+			}
+			if !netwatchSend(events, quit, NetwatchEvent{Kind: NETWATCH_LINK, Detail: fmt.Sprintf("%s %v", attrs.Name, flags)}) {
+				return nil
+			}
+		}
+	}
+}
@@ -0,0 +1,9 @@
+//go:build windows
+// +build windows
+
+package main
+
+func netwatchCreateSource() NetwatchSource {
+	// there is no event based detection, ServiceCheckPinger detects wake-up from sleep by timer
+	return nil
+}
@@ -52,21 +52,21 @@ func osUpdateProcess() {
 	// check for updates
 	updReq := osUpdateRun()
 	// send to server
-	if e := telemetryLogin(); e == nil {
+	if token, e := telemetryToken(false); e == nil {
 		uri := myconfig.Uri + "api/management/autoupdate"
 		log.Debug("Sending autoupdate to: ", uri)
 		jsonReq, _ := json.Marshal(updReq)
 		log.Debug("http req: ", string(jsonReq))
 
 		req, _ := http.NewRequest("POST", uri, bytes.NewBuffer(jsonReq))
-		req.Header.Set("Authorization", "Bearer "+gtelLogin.JWTToken)
+		req.Header.Set("Authorization", "Bearer "+token)
 		req.Header.Add("Accept", "application/json; charset=utf-8")
 		client := &http.Client{}
 		response, err := client.Do(req)
 		if err == nil {
 			log.Debug("http resp: ", response.Status)
 			if response.StatusCode == 401 {
-				gtelLogin.ValidTo = time.Now().UTC().Add(-1000 * time.Hour)
+				telemetryLoginInvalidate()
 			} else if response.StatusCode != 200 {
 				log.Error("status code from management API != 200: ", response.Status)
 			}
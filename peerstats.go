@@ -0,0 +1,291 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/slackhq/nebula"
+)
+
+// peer metrics are read passively from hostmap, RTT is measured by ICMP probes on schedule and when it is
+// requested by client, only peers with recent traffic are probed, so probes do not keep idle tunnels alive
+const (
+	// interval of peer metrics collection
+	PEERSTATS_INTERVAL = 30 * time.Second
+	// number of samples in rolling history per peer
+	PEERSTATS_MAXSAMPLES int = 10
+	// number of ICMP probes per peer and probe request
+	PEERSTATS_PINGCOUNT int = 3
+	// number of peers probed in parallel
+	PEERSTATS_PARALLEL int = 8
+	// minimal interval between probes requested by client
+	PEERSTATS_PROBEINTERVAL = 30 * time.Second
+	// interval of scheduled probes
+	PEERSTATS_PROBESCHEDULE = 2 * time.Minute
+	// max number of peers probed in one run, peers with most traffic are probed first
+	PEERSTATS_MAXPROBES int = 32
+)
+
+// PeerStatsSample is one measurement of tunnel to peer
+type PeerStatsSample struct {
+	Timestamp      time.Time `json:"timestamp"`
+	RTTMs          float64   `json:"rtt_ms"`
+	PacketLoss     float64   `json:"packet_loss"`
+	MessageCounter uint64    `json:"message_counter"`
+	Relayed        bool      `json:"relayed"`
+}
+
+// PeerStats describes tunnel to peer with short rolling history of samples
+type PeerStats struct {
+	VpnIP      string   `json:"vpn_ip"`
+	Name       string   `json:"name"`
+	RemoteAddr string   `json:"remote_addr"`
+	Relayed    bool     `json:"relayed"`
+	Relays     []string `json:"relays,omitempty"`
+	// nebula does not expose handshake time, this is time of first collection which saw new tunnel
+	HandshakeSeenAt time.Time         `json:"handshake_seen_at"`
+	LocalIndex      uint32            `json:"-"`
+	MessageCounter  uint64            `json:"message_counter"`
+	RTTMs           float64           `json:"rtt_ms"`
+	PacketLoss      float64           `json:"packet_loss"`
+	ProbedAt        time.Time         `json:"probed_at"` // time of last RTT measurement, zero if peer was not probed
+	LastSeen        time.Time         `json:"last_seen"`
+	History         []PeerStatsSample `json:"history,omitempty"`
+	// messages of current tunnel sent by probes, they are not user traffic
+	ProbeMessages uint64 `json:"-"`
+	// message counters of last and previous collection without probe messages
+	userCounter     uint64
+	previousCounter uint64
+}
+
+var peerstatsLock sync.Mutex
+var peerstatsData = make(map[string]*PeerStats)
+
+// time of last probe, probe is running when peerstatsProbing is set
+var peerstatsLastProbe time.Time
+var peerstatsProbing bool
+
+// peerstatsUpdateHost merges hostmap entry into collected stats
+func peerstatsUpdateHost(h *nebula.ControlHostInfo, now time.Time) *PeerStats {
+	vpnip := h.VpnIp.String()
+	p, ok := peerstatsData[vpnip]
+	if !ok {
+		p = &PeerStats{VpnIP: vpnip}
+		peerstatsData[vpnip] = p
+	}
+	// new local index means new handshake, message counter of new tunnel starts again
+	if !ok || p.LocalIndex != h.LocalIndex {
+		p.HandshakeSeenAt = now
+		p.LocalIndex = h.LocalIndex
+		p.ProbeMessages = 0
+		p.userCounter = 0
+	}
+	p.previousCounter = p.userCounter
+	if h.Cert != nil {
+		p.Name = h.Cert.Details.Name
+	}
+	p.RemoteAddr = ""
+	if h.CurrentRemote != nil {
+		p.RemoteAddr = h.CurrentRemote.String()
+	}
+	p.Relays = []string{}
+	for _, r := range h.CurrentRelaysToMe {
+		p.Relays = append(p.Relays, r.String())
+	}
+	p.Relayed = h.CurrentRemote == nil && len(p.Relays) > 0
+	p.MessageCounter = h.MessageCounter
+	p.userCounter = p.userMessages()
+	p.LastSeen = now
+	return p
+}
+
+// userMessages returns message counter of tunnel without messages of probes
+func (p *PeerStats) userMessages() uint64 {
+	if p.ProbeMessages > p.MessageCounter {
+		return 0
+	}
+	return p.MessageCounter - p.ProbeMessages
+}
+
+// PeerstatsUserMessages returns message counter of tunnel without messages of probes, it is used
+// by idle detection of tunnels
+func PeerstatsUserMessages(h *nebula.ControlHostInfo) uint64 {
+	peerstatsLock.Lock()
+	defer peerstatsLock.Unlock()
+	p, ok := peerstatsData[h.VpnIp.String()]
+	if !ok || p.LocalIndex != h.LocalIndex || p.ProbeMessages > h.MessageCounter {
+		return h.MessageCounter
+	}
+	return h.MessageCounter - p.ProbeMessages
+}
+
+// peerstatsProbe measures RTT over overlay to peer, it returns number of sent probes too
+func peerstatsProbe(vpnip string) (rtt float64, loss float64, sent int) {
+	stats, err := NetutilsPingStats(vpnip, PEERSTATS_PINGCOUNT)
+	if err != nil {
+		log.Debug("peerstats - cannot probe peer ", vpnip, ": ", err)
+		return 0, 100, 0
+	}
+	return float64(stats.AvgRtt.Microseconds()) / 1000, stats.PacketLoss, stats.PacketsSent
+}
+
+// peerstatsCollect reads hostmap from nebula, it does not send any traffic
+func peerstatsCollect() {
+	if svcProcess == nil || svcProcess.nebula == nil {
+		peerstatsReset()
+		return
+	}
+	now := time.Now().UTC()
+	hosts := svcProcess.nebula.ListHostmapHosts(false)
+
+	peerstatsLock.Lock()
+	defer peerstatsLock.Unlock()
+	seen := make(map[string]bool)
+	for i := range hosts {
+		p := peerstatsUpdateHost(&hosts[i], now)
+		seen[p.VpnIP] = true
+		p.History = append(p.History, PeerStatsSample{
+			Timestamp:      now,
+			RTTMs:          p.RTTMs,
+			PacketLoss:     p.PacketLoss,
+			MessageCounter: p.MessageCounter,
+			Relayed:        p.Relayed,
+		})
+		if len(p.History) > PEERSTATS_MAXSAMPLES {
+			p.History = p.History[len(p.History)-PEERSTATS_MAXSAMPLES:]
+		}
+	}
+	// forget closed tunnels
+	for k := range peerstatsData {
+		if !seen[k] {
+			delete(peerstatsData, k)
+		}
+	}
+}
+
+// peerstatsProbeTargets returns peers with user traffic since previous collection, lighthouse is skipped,
+// at most PEERSTATS_MAXPROBES peers with most traffic are returned
+func peerstatsProbeTargets() []string {
+	var active []*PeerStats
+	for k, p := range peerstatsData {
+		if k != lighthouseIP && p.userCounter != p.previousCounter {
+			active = append(active, p)
+		}
+	}
+	sort.Slice(active, func(i, j int) bool {
+		return active[i].userCounter-active[i].previousCounter > active[j].userCounter-active[j].previousCounter
+	})
+	if len(active) > PEERSTATS_MAXPROBES {
+		active = active[:PEERSTATS_MAXPROBES]
+	}
+	ips := []string{}
+	for _, p := range active {
+		ips = append(ips, p.VpnIP)
+	}
+	return ips
+}
+
+// PeerstatsProbeRequest starts probes of active peers in background, probes are limited
+// to one run per PEERSTATS_PROBEINTERVAL, results are returned by next PeerstatsList
+func PeerstatsProbeRequest() {
+	peerstatsProbeStart(PEERSTATS_PROBEINTERVAL)
+}
+
+// peerstatsProbeStart starts probes if there was no probe for interval
+func peerstatsProbeStart(interval time.Duration) {
+	peerstatsLock.Lock()
+	if peerstatsProbing || time.Since(peerstatsLastProbe) < interval {
+		peerstatsLock.Unlock()
+		return
+	}
+	peerstatsProbing = true
+	peerstatsLastProbe = time.Now()
+	ips := peerstatsProbeTargets()
+	peerstatsLock.Unlock()
+	go peerstatsProbeAll(ips)
+}
+
+// peerstatsProbeAll probes peers without lock, probes are blocking
+func peerstatsProbeAll(ips []string) {
+	defer func() {
+		peerstatsLock.Lock()
+		peerstatsProbing = false
+		peerstatsLock.Unlock()
+	}()
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, PEERSTATS_PARALLEL)
+	for _, ip := range ips {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(ip string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			rtt, loss, sent := peerstatsProbe(ip)
+			peerstatsLock.Lock()
+			defer peerstatsLock.Unlock()
+			if p, ok := peerstatsData[ip]; ok {
+				p.RTTMs = rtt
+				p.PacketLoss = loss
+				p.ProbeMessages += uint64(sent)
+				p.ProbedAt = time.Now().UTC()
+			}
+		}(ip)
+	}
+	wg.Wait()
+}
+
+func peerstatsReset() {
+	peerstatsLock.Lock()
+	defer peerstatsLock.Unlock()
+	peerstatsData = make(map[string]*PeerStats)
+}
+
+// PeerstatsList returns copy of collected stats sorted by VPN IP
+func PeerstatsList(withHistory bool) []PeerStats {
+	peerstatsLock.Lock()
+	defer peerstatsLock.Unlock()
+	ret := []PeerStats{}
+	for _, p := range peerstatsData {
+		c := *p
+		c.Relays = append([]string{}, p.Relays...)
+		c.History = nil
+		if withHistory {
+			c.History = append([]PeerStatsSample{}, p.History...)
+		}
+		ret = append(ret, c)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return netutilsCidrCompare(netutilsCidrFromStr(ret[i].VpnIP).To16(), netutilsCidrFromStr(ret[j].VpnIP).To16()) < 0
+	})
+	return ret
+}
+
+// PeerstatsStart collects peer metrics until quit is closed
+func PeerstatsStart(quit <-chan struct{}) {
+	log.Debug("peerstats - started")
+	// first collection runs immediately
+	next := time.After(0)
+	for {
+		select {
+		case <-quit:
+			peerstatsReset()
+			log.Debug("peerstats - stopped")
+			return
+		case <-next:
+			next = time.After(PEERSTATS_INTERVAL)
+			peerstatsCollect()
+			// RTT of active peers is refreshed on schedule, result is stored by next collection
+			peerstatsProbeStart(PEERSTATS_PROBESCHEDULE)
+			if globalDebugFlag {
+				for _, p := range PeerstatsList(false) {
+					log.Debug(fmt.Sprintf("peerstats - %s (%s) remote: %s relayed: %v rtt: %.1fms loss: %.0f%%",
+						p.VpnIP, p.Name, p.RemoteAddr, p.Relayed, p.RTTMs, p.PacketLoss))
+				}
+			}
+		}
+	}
+}
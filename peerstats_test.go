@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/udp"
+)
+
+func TestPeerstatsUpdateHost(t *testing.T) {
+	peerstatsReset()
+	now := time.Now().UTC()
+	h := nebula.ControlHostInfo{
+		VpnIp:          net.ParseIP("100.64.0.10").To4(),
+		LocalIndex:     1,
+		MessageCounter: 10,
+		CurrentRemote:  udp.NewAddr(net.ParseIP("1.2.3.4"), 4242),
+	}
+	p := peerstatsUpdateHost(&h, now)
+	if p.Relayed || p.RemoteAddr != "1.2.3.4:4242" || !p.HandshakeSeenAt.Equal(now) {
+		t.Errorf("unexpected direct peer stats: %+v", p)
+	}
+
+	// same tunnel, now relayed through lighthouse
+	later := now.Add(time.Minute)
+	h.CurrentRemote = nil
+	h.CurrentRelaysToMe = []iputil.VpnIp{iputil.Ip2VpnIp(net.ParseIP("100.64.0.1").To4())}
+	h.MessageCounter = 20
+	p = peerstatsUpdateHost(&h, later)
+	if !p.Relayed || p.Relays[0] != "100.64.0.1" || p.MessageCounter != 20 {
+		t.Errorf("unexpected relayed peer stats: %+v", p)
+	}
+	if !p.HandshakeSeenAt.Equal(now) {
+		t.Errorf("handshake time has to be kept for the same tunnel")
+	}
+
+	// new local index means new handshake
+	h.LocalIndex = 2
+	p = peerstatsUpdateHost(&h, later)
+	if !p.HandshakeSeenAt.Equal(later) {
+		t.Errorf("handshake time has to be updated for new tunnel")
+	}
+	if l := PeerstatsList(true); len(l) != 1 || l[0].VpnIP != "100.64.0.10" {
+		t.Errorf("unexpected peer list: %+v", l)
+	}
+}
+
+func TestPeerstatsProbeMessagesAreNotTraffic(t *testing.T) {
+	peerstatsReset()
+	defer peerstatsReset()
+	now := time.Now().UTC()
+	h := nebula.ControlHostInfo{
+		VpnIp:          net.ParseIP("100.64.0.10").To4(),
+		LocalIndex:     1,
+		MessageCounter: 10,
+	}
+	peerstatsLock.Lock()
+	peerstatsUpdateHost(&h, now)
+	peerstatsUpdateHost(&h, now)
+	if ips := peerstatsProbeTargets(); len(ips) != 0 {
+		t.Errorf("idle peer is probed: %v", ips)
+	}
+	// probe sent 3 messages, counter moved only by probes
+	peerstatsData["100.64.0.10"].ProbeMessages += 3
+	peerstatsLock.Unlock()
+	h.MessageCounter = 13
+	if c := PeerstatsUserMessages(&h); c != 10 {
+		t.Errorf("probe messages are counted as traffic: %d", c)
+	}
+	peerstatsLock.Lock()
+	peerstatsUpdateHost(&h, now)
+	if ips := peerstatsProbeTargets(); len(ips) != 0 {
+		t.Errorf("peer with probe traffic only is probed: %v", ips)
+	}
+	// user traffic
+	h.MessageCounter = 20
+	peerstatsUpdateHost(&h, now)
+	if ips := peerstatsProbeTargets(); len(ips) != 1 {
+		t.Errorf("active peer is not probed: %v", ips)
+	}
+	peerstatsLock.Unlock()
+
+	// new tunnel starts counting again
+	h.LocalIndex = 2
+	h.MessageCounter = 2
+	if c := PeerstatsUserMessages(&h); c != 2 {
+		t.Errorf("probe messages of old tunnel are subtracted: %d", c)
+	}
+}
+
+func TestPeerstatsProbeTargetsLimit(t *testing.T) {
+	peerstatsReset()
+	defer peerstatsReset()
+	now := time.Now().UTC()
+	peerstatsLock.Lock()
+	defer peerstatsLock.Unlock()
+	for i := 0; i < PEERSTATS_MAXPROBES+10; i++ {
+		h := nebula.ControlHostInfo{
+			VpnIp:          net.IPv4(100, 64, 1, byte(i+1)).To4(),
+			LocalIndex:     1,
+			MessageCounter: uint64(i + 1),
+		}
+		peerstatsUpdateHost(&h, now)
+	}
+	ips := peerstatsProbeTargets()
+	if len(ips) != PEERSTATS_MAXPROBES {
+		t.Fatalf("expected %d probed peers, got %d", PEERSTATS_MAXPROBES, len(ips))
+	}
+	// peer with most traffic goes first
+	if ips[0] != fmt.Sprintf("100.64.1.%d", PEERSTATS_MAXPROBES+10) {
+		t.Errorf("peers are not ordered by traffic: %v", ips)
+	}
+}
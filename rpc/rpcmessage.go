@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"errors"
 	"net"
+	"time"
 )
 
 // packend send to unix socket or pipe has this format
@@ -24,6 +25,8 @@ const (
 	RPCCOMMANDSTOP     RpcCommandType = 2
 	RPCCOMMANDSTATUS   RpcCommandType = 3
 	RPCCOMMANDRESPONSE RpcCommandType = 4
+	RPCCOMMANDHISTORY  RpcCommandType = 5
+	RPCCOMMANDPEERS    RpcCommandType = 6
 )
 
 const (
@@ -38,6 +41,7 @@ type RpcCommandStart struct {
 	HeartbeatInterval int    `json:"heartbeatinterval"`
 	RestrictedNetwork bool   `json:"restrictednetwork"`
 	LighthouseRoute   bool   `json:"lighthouseroute"`
+	KillSwitch        bool   `json:"killswitch"`
 	ClientID          string `json:"clientid"`
 }
 
@@ -49,17 +53,106 @@ type RpcCommandStatus struct {
 	Version string `json:"version"`
 }
 
+type RpcCommandHistory struct {
+	Version string `json:"version"`
+}
+
+type RpcStateEvent struct {
+	Timestamp time.Time `json:"timestamp"`
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	Reason    string    `json:"reason"`
+}
+
+type RpcCommandPeers struct {
+	Version string `json:"version"`
+}
+
+type RpcPeerSample struct {
+	Timestamp      time.Time `json:"timestamp"`
+	RTTMs          float64   `json:"rttms"`
+	PacketLoss     float64   `json:"packetloss"`
+	MessageCounter uint64    `json:"messagecounter"`
+	Relayed        bool      `json:"relayed"`
+}
+
+type RpcPeerInfo struct {
+	VpnIP           string          `json:"vpnip"`
+	Name            string          `json:"name"`
+	RemoteAddr      string          `json:"remoteaddr"`
+	Relayed         bool            `json:"relayed"`
+	Relays          []string        `json:"relays"`
+	HandshakeSeenAt time.Time       `json:"handshakeseenat"` // first collection which saw tunnel, not exact handshake time
+	MessageCounter  uint64          `json:"messagecounter"`
+	RTTMs           float64         `json:"rttms"`
+	PacketLoss      float64         `json:"packetloss"`
+	History         []RpcPeerSample `json:"history"`
+}
+
+type RpcTunnelPeer struct {
+	LocalAddr string  `json:"localaddr"`
+	Connected bool    `json:"connected"`
+	Framed    bool    `json:"framed"`
+	Transport string  `json:"transport"`
+	RTTMs     float64 `json:"rttms"`
+}
+
+// websocket tunnel used in restricted network
+type RpcTunnelStats struct {
+	RTTMs       float64         `json:"rttms"`
+	Reconnects  uint64          `json:"reconnects"`
+	BytesIn     uint64          `json:"bytesin"`
+	BytesOut    uint64          `json:"bytesout"`
+	LastError   string          `json:"lasterror"`
+	LastErrorAt time.Time       `json:"lasterrorat"`
+	Peers       []RpcTunnelPeer `json:"peers"`
+}
+
+type RpcListenerBackend struct {
+	Address      string  `json:"address"`
+	Dials        uint64  `json:"dials"`
+	DialErrors   uint64  `json:"dialerrors"`
+	AvgLatencyMs float64 `json:"avglatencyms"`
+	MaxLatencyMs float64 `json:"maxlatencyms"`
+}
+
+// appliance listener forwarding traffic of peers to backends
+type RpcListenerStats struct {
+	Listen         string               `json:"listen"`
+	Protocol       string               `json:"protocol"`
+	Sessions       uint64               `json:"sessions"`
+	Active         int64                `json:"active"`
+	Rejected       uint64               `json:"rejected"`      // refused by access control
+	RejectedLimit  uint64               `json:"rejectedlimit"` // refused by connection or rate limit
+	DroppedPackets uint64               `json:"droppedpackets"`
+	ThrottledMs    float64              `json:"throttledms"`
+	BytesIn        uint64               `json:"bytesin"`
+	BytesOut       uint64               `json:"bytesout"`
+	DialErrors     uint64               `json:"dialerrors"`
+	Backends       []RpcListenerBackend `json:"backends"`
+}
+
 type RpcCommandResponse struct {
-	Version           string `json:"version"`
-	Status            string `json:"status"`
-	AccessId          int    `json:"accessid"`
-	IsConnected       bool   `json:"isconnected"`
-	IsRunning         bool   `json:"isrunning"`
-	Uri               string `json:"uri"`
-	RestrictedNetwork bool   `json:"restrictednetwork"`
-	LighthouseRoute   bool   `json:"lighthouseroute"`
-	TunnelExists      bool   `json:"tunnelexists"`
-	Lighthouse        string `json:"lighthouse"`
+	Version           string             `json:"version"`
+	Status            string             `json:"status"`
+	AccessId          int                `json:"accessid"`
+	IsConnected       bool               `json:"isconnected"`
+	IsRunning         bool               `json:"isrunning"`
+	Uri               string             `json:"uri"`
+	RestrictedNetwork bool               `json:"restrictednetwork"`
+	LighthouseRoute   bool               `json:"lighthouseroute"`
+	TunnelExists      bool               `json:"tunnelexists"`
+	Lighthouse        string             `json:"lighthouse"`
+	KillSwitch        bool               `json:"killswitch"`
+	CaptivePortal     bool               `json:"captiveportal"`
+	CaptivePortalURL  string             `json:"captiveportalurl"`
+	State             string             `json:"state"`
+	StateSince        time.Time          `json:"statesince"`
+	Truncated         bool               `json:"truncated,omitempty"` // history, peers or listeners were shortened to fit into message
+	History           []RpcStateEvent    `json:"history,omitempty"`
+	Peers             []RpcPeerInfo      `json:"peers,omitempty"`
+	WSTunnel          *RpcTunnelStats    `json:"wstunnel,omitempty"`
+	Listeners         []RpcListenerStats `json:"listeners,omitempty"`
 }
 
 // Parse message header, get message type and content length
@@ -109,14 +202,39 @@ func rpcInterfaceToType(msg interface{}) RpcCommandType {
 	if _, isEntity := msg.(*RpcCommandStatus); isEntity {
 		return RPCCOMMANDSTATUS
 	}
+	if _, isEntity := msg.(*RpcCommandHistory); isEntity {
+		return RPCCOMMANDHISTORY
+	}
+	if _, isEntity := msg.(*RpcCommandPeers); isEntity {
+		return RPCCOMMANDPEERS
+	}
 	if _, isEntity := msg.(*RpcCommandResponse); isEntity {
 		return RPCCOMMANDRESPONSE
 	}
 	return RPCCOMMANDUNKNOWN
 }
 
-func RpcCreateMessage(msg interface{}) []byte {
+// RPC_MAXMESSAGESIZE is max size of message content, length of content is 16-bit field in header
+const RPC_MAXMESSAGESIZE int = 0xFFFF
+
+// ErrRpcMessageTooLarge is returned when content does not fit into 16-bit length of header
+var ErrRpcMessageTooLarge = errors.New("rpc message is too large")
+
+// RpcMessageSize returns size of message content
+func RpcMessageSize(msg interface{}) int {
 	m, _ := json.Marshal(msg)
+	return len(m)
+}
+
+func RpcCreateMessage(msg interface{}) ([]byte, error) {
+	m, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	// length would wrap around and client would read garbage
+	if len(m) > RPC_MAXMESSAGESIZE {
+		return nil, ErrRpcMessageTooLarge
+	}
 	var ret []byte
 	r := make([]byte, 2)
 	binary.BigEndian.PutUint16(r, uint16(rpcInterfaceToType(msg)))
@@ -124,11 +242,14 @@ func RpcCreateMessage(msg interface{}) []byte {
 	binary.BigEndian.PutUint16(r, uint16(len(m)))
 	ret = append(ret, r...)
 	ret = append(ret, m...)
-	return ret
+	return ret, nil
 }
 
 func RpcSendMessage(conn net.Conn, msg interface{}) error {
-	buf := RpcCreateMessage(msg)
+	buf, err := RpcCreateMessage(msg)
+	if err != nil {
+		return err
+	}
 	return RpcSendData(conn, buf)
 }
 
@@ -2,19 +2,29 @@ package main
 
 import (
 	"fmt"
+	"net"
 	"os"
 	"os/exec"
+	"reflect"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	proxyconf "github.com/shieldoo/shieldoo-mesh/goproxy/config"
 	proxy "github.com/shieldoo/shieldoo-mesh/goproxy/core"
+	"github.com/shieldoo/shieldoo-mesh/goproxy/core/limit"
+	"github.com/shieldoo/shieldoo-mesh/goproxy/core/metrics"
+	"github.com/shieldoo/shieldoo-mesh/goproxy/core/scheduler"
 	wstunnel "github.com/shieldoo/shieldoo-mesh/wstunnel"
 
 	"github.com/sirupsen/logrus"
 	"github.com/slackhq/nebula"
 	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/iputil"
 )
 
 type ChannelWriter struct {
@@ -40,33 +50,215 @@ func (p *ChannelWriter) Write(data []byte) (n int, err error) {
 }
 
 type SvcProxyRoute struct {
-	Port        int
-	Protocol    string
-	ForwardPort int
-	ForwardHost string
-	Proxy       *proxy.Proxy
+	Port                       int
+	Protocol                   string
+	ForwardPort                int
+	ForwardHost                string
+	HealthCheckPath            string
+	HealthCheckIntervalSeconds int
+	Scheduler                  string
+	Weights                    []int
+	ProxyProtocol              int
+	AllowedNames               []string
+	AllowedGroups              []string
+	Limits                     ManagementResponseListenerLimits
+	Routes                     []ManagementResponseListenerRoute
+	TLSCert                    string
+	TLSKey                     string
+	DrainTimeoutSeconds        int
+	IdleTimeoutSeconds         int
+	HalfCloseTimeoutSeconds    int
+	Proxy                      *proxy.Proxy
+	Metrics                    *metrics.Collector
+}
+
+// running workers for status rpc, workers themselves are owned by config loop
+var svcWorkersStatsLock sync.Mutex
+var svcWorkersStatsList = make(map[*proxy.Proxy]*metrics.Collector)
+
+type SvcWorkerStats struct {
+	Listen   string
+	Protocol string
+	Metrics  metrics.Snapshot
+	Limits   limit.Metrics
+}
+
+// svcWorkersStats returns metrics of running workers sorted by listen address
+func svcWorkersStats() []SvcWorkerStats {
+	svcWorkersStatsLock.Lock()
+	defer svcWorkersStatsLock.Unlock()
+	ret := []SvcWorkerStats{}
+	for p, m := range svcWorkersStatsList {
+		ret = append(ret, SvcWorkerStats{
+			Listen:   p.Config.Local,
+			Protocol: p.Config.Protocol,
+			Metrics:  m.Snapshot(),
+			Limits:   p.LimitMetrics(),
+		})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Listen != ret[j].Listen {
+			return ret[i].Listen < ret[j].Listen
+		}
+		return ret[i].Protocol < ret[j].Protocol
+	})
+	return ret
+}
+
+func svcWorkersStatsRemove(p *proxy.Proxy) {
+	svcWorkersStatsLock.Lock()
+	defer svcWorkersStatsLock.Unlock()
+	delete(svcWorkersStatsList, p)
 }
 
 func (r *SvcProxyRoute) Stop() {
 	log.Debug("stoppping worker: ", r)
 	r.Proxy.Stop()
+	svcWorkersStatsRemove(r.Proxy)
+}
+
+// Drain stops accepting on worker and returns, active sessions are drained in background until drain timeout
+func (r *SvcProxyRoute) Drain() {
+	log.Debug("draining worker: ", r)
+	r.Proxy.Drain()
+	svcWorkersStatsRemove(r.Proxy)
 }
 
-func (r *SvcProxyRoute) Start(ip string) error {
+// Start starts worker on ip, identity of clients is read from hostmap of ctrl
+func (r *SvcProxyRoute) Start(ip string, ctrl *nebula.Control) error {
 	log.Debug("starting worker "+ip+": ", r)
-	srvs := fmt.Sprintf("%s:%d", r.ForwardHost, r.ForwardPort)
+	srvs := svcProxyBackends(r.ForwardHost, r.ForwardPort)
 	listen := fmt.Sprintf("%s:%d", ip, r.Port)
-	config, err := proxyconf.New(r.Protocol, listen, srvs)
+	config, err := proxyconf.New(r.Protocol, listen, strings.Join(srvs, ","))
 	if err != nil {
 		log.Error("cannot start worker: ", err)
+		return err
+	}
+	if r.Scheduler != "" {
+		if scheduler.Exists(r.Scheduler) {
+			config.Scheduler = r.Scheduler
+		} else {
+			log.Error("unknown scheduler of worker, using default: ", r.Scheduler)
+		}
+	}
+	if config.IsHTTP() {
+		for _, rt := range r.Routes {
+			port := rt.ForwardPort
+			if port == 0 {
+				port = r.ForwardPort
+			}
+			if err := config.AddRoute(rt.Host, rt.PathPrefix, strings.Join(svcProxyBackends(rt.ForwardHost, port), ",")); err != nil {
+				log.Error("cannot start worker: ", err)
+				return err
+			}
+		}
+		if len(config.Routes) == 0 {
+			log.Error("cannot start worker: no route of ", r.Protocol, " worker")
+			return fmt.Errorf("no route of %s worker", r.Protocol)
+		}
+		config.TLSCert = r.TLSCert
+		config.TLSKey = r.TLSKey
+	} else if len(r.Routes) > 0 {
+		log.Error("routes are not supported on ", r.Protocol, " worker")
+	}
+	config.Identify = svcPeerIdentity(ctrl)
+	config.AllowedNames = r.AllowedNames
+	config.AllowedGroups = r.AllowedGroups
+	config.Limits = proxyconf.Limits{
+		MaxConnections:          r.Limits.MaxConnections,
+		MaxConnectionsPerSource: r.Limits.MaxConnectionsPerSource,
+		ConnectionRate:          r.Limits.ConnectionRate,
+		ConnectionRatePerSource: r.Limits.ConnectionRatePerSource,
+		Bandwidth:               r.Limits.Bandwidth,
+		BandwidthPerSource:      r.Limits.BandwidthPerSource,
+	}
+	if r.ProxyProtocol != 0 {
+		if r.Protocol == "tcp" && (r.ProxyProtocol == 1 || r.ProxyProtocol == 2) {
+			config.ProxyProtocol = r.ProxyProtocol
+		} else {
+			log.Error("PROXY protocol version ", r.ProxyProtocol, " is not supported on ", r.Protocol, " worker")
+		}
+	}
+	config.Weights = make(map[string]int)
+	for i, w := range r.Weights {
+		if i < len(srvs) && w > 0 {
+			config.Weights[srvs[i]] = w
+		}
+	}
+	config.HealthCheckPath = r.HealthCheckPath
+	if r.IdleTimeoutSeconds > 0 {
+		config.IdleTimeout = time.Duration(r.IdleTimeoutSeconds) * time.Second
+	}
+	if r.HalfCloseTimeoutSeconds > 0 {
+		config.HalfCloseTimeout = time.Duration(r.HalfCloseTimeoutSeconds) * time.Second
+	}
+	if r.DrainTimeoutSeconds > 0 {
+		config.DrainTimeout = time.Duration(r.DrainTimeoutSeconds) * time.Second
+	} else if r.DrainTimeoutSeconds < 0 {
+		config.DrainTimeout = 0
+	}
+	if r.HealthCheckIntervalSeconds > 0 {
+		config.HealthCheckInterval = time.Duration(r.HealthCheckIntervalSeconds) * time.Second
+	} else if r.HealthCheckIntervalSeconds < 0 {
+		config.HealthCheckInterval = 0
 	}
+	config.Logger = log.WithField("listener", r.Protocol+"/"+listen)
+	r.Metrics = metrics.New()
+	config.Metrics = r.Metrics
 	r.Proxy = proxy.New(config)
+	svcWorkersStatsLock.Lock()
+	svcWorkersStatsList[r.Proxy] = r.Metrics
+	svcWorkersStatsLock.Unlock()
 	go r.Proxy.Start()
 	return nil
 }
 
+// svcProxyBackends returns backends of proxy from comma separated hosts, forward port is used for hosts without port
+func svcProxyBackends(hosts string, port int) []string {
+	var ret []string
+	for _, h := range strings.Split(hosts, ",") {
+		h = strings.TrimSpace(h)
+		if h == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(h); err != nil {
+			h = net.JoinHostPort(strings.Trim(h, "[]"), strconv.Itoa(port))
+		}
+		ret = append(ret, h)
+	}
+	return ret
+}
+
 func (r *SvcProxyRoute) IsEqualToModel(m *ManagementResponseListener) bool {
-	return r.ForwardHost == m.ForwardHost && r.ForwardPort == m.ForwardPort && r.Port == m.Port && r.Protocol == m.Protocol
+	return r.ForwardHost == m.ForwardHost && r.ForwardPort == m.ForwardPort && r.Port == m.Port && r.Protocol == m.Protocol &&
+		r.HealthCheckPath == m.HealthCheckPath && r.HealthCheckIntervalSeconds == m.HealthCheckIntervalSeconds &&
+		r.Scheduler == m.Scheduler && reflect.DeepEqual(r.Weights, m.Weights) && r.ProxyProtocol == m.ProxyProtocol &&
+		reflect.DeepEqual(r.AllowedNames, m.AllowedNames) && reflect.DeepEqual(r.AllowedGroups, m.AllowedGroups) &&
+		r.Limits == m.Limits && reflect.DeepEqual(r.Routes, m.Routes) && r.TLSCert == m.TLSCert && r.TLSKey == m.TLSKey &&
+		r.DrainTimeoutSeconds == m.DrainTimeoutSeconds && r.IdleTimeoutSeconds == m.IdleTimeoutSeconds &&
+		r.HalfCloseTimeoutSeconds == m.HalfCloseTimeoutSeconds
+}
+
+// svcPeerIdentity returns identity function of worker, it reads nebula certificate of peer from hostmap of ctrl,
+// nil is returned if tunnel is not known
+func svcPeerIdentity(ctrl *nebula.Control) func(addr net.Addr) *proxyconf.Identity {
+	return func(addr net.Addr) *proxyconf.Identity {
+		var ip net.IP
+		switch a := addr.(type) {
+		case *net.TCPAddr:
+			ip = a.IP.To4()
+		case *net.UDPAddr:
+			ip = a.IP.To4()
+		}
+		if ip == nil || ctrl == nil {
+			return nil
+		}
+		h := ctrl.GetHostInfoByVpnIp(iputil.Ip2VpnIp(ip), false)
+		if h == nil || h.Cert == nil {
+			return nil
+		}
+		return &proxyconf.Identity{Name: h.Cert.Details.Name, Groups: h.Cert.Details.Groups}
+	}
 }
 
 func (r *SvcProxyRoute) IsInModel(m *[]ManagementResponseListener) bool {
@@ -143,13 +335,18 @@ func (r *SvcNetworkCard) Stop() {
 
 var svcProcess *SvcNetworkCard = nil
 var svcWsTunnel wstunnel.WSTunnel
-var svcIsInitialized bool = false
 
-func svcCleanupWorkers(process *SvcNetworkCard, cfg *ManagementResponseConfig, cleanupall bool) {
+func svcCleanupWorkers(process *SvcNetworkCard, cfg *ManagementResponseConfig, cleanupall bool, drain bool) {
 	var w []SvcProxyRoute
 	for _, r := range process.Workers {
 		if cleanupall || (cfg != nil && !r.IsInModel(&cfg.ApplianceListeners)) {
-			r.Stop()
+			if drain {
+				// TCP and HTTP ports are released immediately, UDP port is released after short drain
+				// and new worker retries to bind it
+				r.Drain()
+			} else {
+				r.Stop()
+			}
 		} else {
 			w = append(w, r)
 		}
@@ -161,24 +358,25 @@ func svcCleanupProcesses(cfg *NebulaLocalYamlConfig) {
 	if svcProcess != nil {
 		if svcProcess.AccessID != cfg.ConfigData.AccessID /* accessID changed */ ||
 			svcProcess.IPAddress != cfg.ConfigData.ConfigData.IPAddress /* IP address of tun/tap changed */ ||
-			svcProcess.RestrictiveNetworks != myconfig.RestrictedNetwork /* if restrictive network changed */ ||
+			svcProcess.RestrictiveNetworks != svcRestrictedNetwork.Load() /* if restrictive network changed */ ||
 			svcProcess.RoutesHash != ServiceCheckServiceDNSIPsHash() /* if routes changed */ {
 			// there is change in config which will recreate network adapter
 			svcStopProcess()
-			// cleanup changes to windows firewall
+			// cleanup changes to host firewall
 			if myconfig.WindowsFW {
-				svcFirewallCleanup()
+				svcFirewallReset()
 			}
 		}
 	}
 }
 
+// svcStopProcess stops nebula and all workers, active sessions of workers are closed because they cannot outlive tunnel
 func svcStopProcess() {
 	log.Debug("stopping service ..")
 	// stop standard nebula layer
 	if svcProcess != nil {
 		log.Debug("stopping service: ", svcProcess.IPAddress)
-		svcCleanupWorkers(svcProcess, nil, true)
+		svcCleanupWorkers(svcProcess, nil, true, false)
 		svcProcess.Stop()
 		svcProcess = nil
 		runtime.GC()
@@ -188,7 +386,7 @@ func svcStopProcess() {
 func svcCancelableWait(periodSeconds int) {
 	log.Debug("svcCancelableWait() waiting for ", periodSeconds, " seconds")
 	for i := 0; i < periodSeconds*10; i++ {
-		if svcconnCancel {
+		if svcconnCancel.Load() {
 			break
 		}
 		time.Sleep(100 * time.Millisecond)
@@ -201,7 +399,7 @@ func svcNewProcess(c *ManagementResponseConfig, enableWinLog bool) (SvcNetworkCa
 		ConfigHash:          c.ConfigData.Hash,
 		IPAddress:           c.ConfigData.IPAddress,
 		PunchBack:           c.NebulaPunchBack,
-		RestrictiveNetworks: myconfig.RestrictedNetwork,
+		RestrictiveNetworks: svcRestrictedNetwork.Load(),
 		RoutesHash:          ServiceCheckServiceDNSIPsHash(),
 	}
 
@@ -214,7 +412,7 @@ func svcNewProcess(c *ManagementResponseConfig, enableWinLog bool) (SvcNetworkCa
 	cfgtext, lhIP, err := NebulaConfigCreate(
 		c.ConfigData.Data,
 		ret.PunchBack,
-		myconfig.RestrictedNetwork)
+		svcRestrictedNetwork.Load())
 	if err != nil {
 		return ret, err
 	}
@@ -223,6 +421,7 @@ func svcNewProcess(c *ManagementResponseConfig, enableWinLog bool) (SvcNetworkCa
 	ret.log.canwrite = false
 	ret.nl = logrus.New()
 	ret.nl.Out = &ret.log
+	LogRedactInstall(ret.nl)
 	if enableWinLog {
 		HookLogger(ret.nl)
 	}
@@ -247,7 +446,7 @@ func svcNewProcess(c *ManagementResponseConfig, enableWinLog bool) (SvcNetworkCa
 			ret.nebula = ctrl
 			break
 		}
-		if err != nil && (i == maxNebulaRetries || svcconnCancel) {
+		if err != nil && (i == maxNebulaRetries || svcconnCancel.Load()) {
 			log.Error("failed to start nebula: ", err)
 			return ret, err
 		}
@@ -269,12 +468,6 @@ func svcNewProcess(c *ManagementResponseConfig, enableWinLog bool) (SvcNetworkCa
 	log.Debug("start nebula with ip ", ret.IPAddress)
 	ret.nebula.Start()
 
-	// configure windows firewall
-	if myconfig.WindowsFW && len(c.NebulaCIDR) > 0 {
-		log.Debug("configuring windows firewall for cidr: ", c.NebulaCIDR)
-		svcFirewallSetup(c.NebulaCIDR)
-	}
-
 	// wait for a while to create TUN/TAP
 	time.Sleep(500 * time.Millisecond)
 	return ret, nil
@@ -293,18 +486,32 @@ func svcUpdateWorkers(netw *ManagementResponseConfig, proc *SvcNetworkCard) bool
 	var ret bool = true
 
 	//stop workers where we have change
-	svcCleanupWorkers(proc, netw, false)
+	svcCleanupWorkers(proc, netw, false, true)
 
 	// start new workers
 	for _, w := range netw.ApplianceListeners {
 		if svcFindWorker(&w, proc) == nil {
 			worker := SvcProxyRoute{
-				Port:        w.Port,
-				Protocol:    w.Protocol,
-				ForwardPort: w.ForwardPort,
-				ForwardHost: w.ForwardHost,
+				Port:                       w.Port,
+				Protocol:                   w.Protocol,
+				ForwardPort:                w.ForwardPort,
+				ForwardHost:                w.ForwardHost,
+				HealthCheckPath:            w.HealthCheckPath,
+				HealthCheckIntervalSeconds: w.HealthCheckIntervalSeconds,
+				Scheduler:                  w.Scheduler,
+				Weights:                    w.Weights,
+				ProxyProtocol:              w.ProxyProtocol,
+				AllowedNames:               w.AllowedNames,
+				AllowedGroups:              w.AllowedGroups,
+				Limits:                     w.Limits,
+				Routes:                     w.Routes,
+				TLSCert:                    w.TLSCert,
+				TLSKey:                     w.TLSKey,
+				DrainTimeoutSeconds:        w.DrainTimeoutSeconds,
+				IdleTimeoutSeconds:         w.IdleTimeoutSeconds,
+				HalfCloseTimeoutSeconds:    w.HalfCloseTimeoutSeconds,
 			}
-			if worker.Start(proc.IPAddress) != nil {
+			if worker.Start(proc.IPAddress, proc.nebula) != nil {
 				ret = false
 			} else {
 				proc.Workers = append(proc.Workers, worker)
@@ -336,7 +543,7 @@ func svcUpdateProcesses(cfg *NebulaLocalYamlConfig, enableWinLog bool) bool {
 				cfgtext, lhIP, err := NebulaConfigCreate(
 					cfg.ConfigData.ConfigData.Data,
 					svcProcess.PunchBack,
-					myconfig.RestrictedNetwork)
+					svcRestrictedNetwork.Load())
 				if err != nil {
 					log.Error("failed to create config: ", err)
 					return false
@@ -357,6 +564,10 @@ func svcUpdateProcesses(cfg *NebulaLocalYamlConfig, enableWinLog bool) bool {
 		if !svcUpdateWorkers(cfg.ConfigData, svcProcess) {
 			return false
 		}
+		// configure host firewall for mesh traffic and listeners
+		svcFirewallUpdate(cfg.ConfigData, svcProcess)
+		// block traffic outside of tunnel in full-tunnel mode
+		svcKillSwitchUpdate(svcProcess)
 	}
 	return true
 }
@@ -373,15 +584,33 @@ func configureServices(enableWinLog bool) bool {
 	return ret
 }
 
-var svcconnCancel bool = false
-var svcconnIsRunning bool = false
-var svcconnStopped chan bool
+// connection loop confirms stop requested by SvcConnectionStop
+var svcconnStopped = make(chan bool)
+
+// connection flags are shared by connection loop, pinger and rpc handlers
+var svcconnCancel atomic.Bool
+var svcconnIsRunning atomic.Bool
+var svcIsInitialized atomic.Bool
+
+// tunnel is established over websocket in restricted network
+var svcRestrictedNetwork atomic.Bool
 
 func svcConnectWstunnel(accessid int, upn string) {
 	log.Debug("svcConnectWstunnel - starting wstunnel")
+	// timeouts are applied also to running tunnel when policy changes
+	p := ServiceCheckPolicy()
+	svcWsTunnel.SetTimeouts(p.WSReadInactivitySeconds, p.WSMaxTimeouts)
+	svcWsTunnel.SetFraming(servicecheckPolicyFlag(p.WSFramed), servicecheckPolicyFlag(p.WSCompression))
+	svcWsTunnel.SetKeepalive(time.Duration(p.WSPingIntervalSeconds*float64(time.Second)), time.Duration(p.WSPongTimeoutSeconds*float64(time.Second)))
+	bearer := servicecheckPolicyFlag(p.WSBearerAuth)
+	if bearer {
+		svcWsTunnel.SetTokenSource(telemetryToken)
+	} else {
+		svcWsTunnel.SetTokenSource(nil)
+	}
 	if !svcWsTunnel.IsRunning() {
 		_usr, _pwd, _wss := WSTunnelCredentials()
-		if _usr == "" || _pwd == "" || _wss == "" {
+		if _wss == "" || (!bearer && (_usr == "" || _pwd == "")) {
 			log.Error("wstunnel address or credentials is not provided, cannot start")
 			return
 		}
@@ -399,25 +628,36 @@ func svcDisconnectWstunnel() {
 
 func SvcConnectionStart(enableWinLog bool) {
 	log.Debug("svcconnection starting ..")
-	if svcconnIsRunning {
+	// only one connection loop is running
+	if !svcconnIsRunning.CompareAndSwap(false, true) {
 		return
 	}
 	log.Debug("svcconnection starting ....")
-	svcconnCancel = false
-	svcconnStopped = make(chan bool)
+	svcconnCancel.Store(false)
 	// insert into log channel empty string to initialize immediate sending after startup
 	logdata <- ""
-	svcconnIsRunning = true
+	connstateTransition(CONNSTATE_CONFIGURING, "connection started")
+	// cleanup host firewall rules left by previously crashed instance
+	if myconfig.WindowsFW {
+		svcFirewallReset()
+		if !svcKillSwitchRequested() {
+			svcKillSwitchReset()
+		}
+	}
 	for {
 		// run telemetry and config
 		log.Debug("waiting for next telemetry send ..")
 		if telemetrySend() ||
-			!svcIsInitialized {
+			!svcIsInitialized.Load() {
 			if localconf.Loaded {
-				if myconfig.RestrictedNetwork {
+				// network mode forced by policy is used without waiting for failed probes
+				if r, forced := servicecheckPolicyForcedMode(ServiceCheckPolicy()); forced {
+					svcRestrictedNetwork.Store(r)
+				}
+				if svcRestrictedNetwork.Load() {
 					svcConnectWstunnel(localconf.ConfigData.AccessID, localconf.ConfigData.UPN)
 				}
-				if !myconfig.RestrictedNetwork {
+				if !svcRestrictedNetwork.Load() {
 					svcDisconnectWstunnel()
 				}
 				//dns
@@ -425,10 +665,20 @@ func SvcConnectionStart(enableWinLog bool) {
 					loadDNS()
 				}
 				// need restart or its first time
-				svcIsInitialized = configureServices(enableWinLog)
+				if !svcIsInitialized.Load() {
+					connstateTransition(CONNSTATE_CONFIGURING, "initializing services")
+				} else {
+					connstateTransition(CONNSTATE_CONFIGURING, "configuration changed")
+				}
+				svcIsInitialized.Store(configureServices(enableWinLog))
+				if svcIsInitialized.Load() {
+					connstateTransition(CONNSTATE_CONNECTING, "services configured")
+				} else {
+					connstate.Event("services configuration failed")
+				}
 			}
 		}
-		if svcconnCancel {
+		if svcconnCancel.Load() {
 			// stop services
 			svcStopProcess()
 			// send stop signal
@@ -436,27 +686,25 @@ func SvcConnectionStart(enableWinLog bool) {
 			break
 		}
 	}
-	svcconnIsRunning = false
+	svcconnIsRunning.Store(false)
 }
 
 func SvcConnectionStop() {
 	log.Debug("svcconnection stopping ..")
-	if svcconnCancel || !svcconnIsRunning {
+	// stop is requested only once
+	if !svcconnIsRunning.Load() || !svcconnCancel.CompareAndSwap(false, true) {
 		return
 	}
 	log.Debug("svcconnection stopping ....")
-
-	svcconnCancel = true
+	connstateTransition(CONNSTATE_STOPPING, "connection stop requested")
 	// invoke break of waiting loop in telemtrySend
 	logdata <- ""
 
 	// wait for stop nebula connections
-	if svcconnStopped != nil {
-		<-svcconnStopped
-	}
+	<-svcconnStopped
 	// stoppping wstunnel if exists
 	svcDisconnectWstunnel()
-	svcconnCancel = false
+	svcconnCancel.Store(false)
 
 	// cleanup configs
 	removeLocalConf()
@@ -464,13 +712,16 @@ func SvcConnectionStop() {
 	// cleanup DNS
 	SvcCleanupDNS()
 
-	// cleanup windows firewall
+	// cleanup host firewall, kill switch is released only there because user explicitly disconnects
 	if myconfig.WindowsFW {
-		svcFirewallCleanup()
+		svcFirewallReset()
+		svcKillSwitchReset()
 	}
 
 	// cleanup service IPs
-	ServicecheckServiceDNSIPsData = []string{}
+	ServiceCheckUpdateServiceDNSIPs([]string{})
+
+	connstateTransition(CONNSTATE_STOPPED, "connection stopped")
 }
 
 func SvcCleanupDNS() {
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSvcProxyBackends(t *testing.T) {
+	tests := map[string]string{
+		"10.0.0.1":               "10.0.0.1:5432",
+		"db1, db2":               "db1:5432,db2:5432",
+		"db1:6432,db2":           "db1:6432,db2:5432",
+		"fd00::1,[fd00::2]:6432": "[fd00::1]:5432,[fd00::2]:6432",
+		"db1,,":                  "db1:5432",
+	}
+	for in, expected := range tests {
+		if got := strings.Join(svcProxyBackends(in, 5432), ","); got != expected {
+			t.Errorf("svcProxyBackends(%q) = %q, expected %q", in, got, expected)
+		}
+	}
+}
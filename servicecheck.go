@@ -8,11 +8,15 @@ import (
 	"net/http"
 	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// default number of failed probes before switch to restricted network
 const SERVICECHECK_MAXRETRY_RESTRICTEDNET int = 16
 
+// defaults of RestrictedNetworkPolicy
 const (
 	// default servicecheck ping interval
 	SVCCHECKPINGINTERVAL int = 1000
@@ -20,21 +24,32 @@ const (
 	SVCCHECKPTUNNELIDDLETIMEOUTMINUTES float64 = 10
 )
 
+// UDP checks of lighthouse after network change, all of them have to fail before switch to restricted network,
+// single check fails often while new network settles
+const (
+	SVCCHECKNETCHANGERETRIES int           = 3
+	SVCCHECKNETCHANGESETTLE  time.Duration = time.Second
+)
+
 type ServiceCheckTunnelMessageCounter struct {
 	MessageCounter uint64
 	LastChange     time.Time
 }
 
-var servicecheckPingerSuccess bool = false
+// results of last ping, they are read by rpc handlers
+var servicecheckPingerSuccess atomic.Bool
+var ServicecheckExistingTunnels atomic.Bool
 var servicecheckPingerNextRunTimeinterval int = SVCCHECKPINGINTERVAL
 var servicecheckPingerQuit chan bool
 var servicecheckTestRestrictedNetworkCounter int = 0
 var servicecheckTunnelArray = make(map[string]ServiceCheckTunnelMessageCounter)
-var ServicecheckExistingTunnels bool = false
-var ServicecheckServiceDNSIPsData []string
+
+// resolved IPs of service, they are updated by config loop and pinger
+var servicecheckServiceDNSIPsLock sync.Mutex
+var servicecheckServiceDNSIPsData []string
 
 func ServiceCheckGetPingerSuccess() bool {
-	return servicecheckPingerSuccess
+	return servicecheckPingerSuccess.Load()
 }
 
 func servicecheckAddUniqueIP(ip []string, arr *[]string) {
@@ -53,26 +68,28 @@ func servicecheckAddUniqueIP(ip []string, arr *[]string) {
 }
 
 func ServiceCheckServiceDNSIPsHash() string {
-	if myconfig.LighthouseRoute {
-		return ""
-	}
-	// sort IPs and calculate sha256 hash
-	sort.Strings(ServicecheckServiceDNSIPsData)
-	return fmt.Sprintf("%x", sha256.Sum256([]byte(strings.Join(ServicecheckServiceDNSIPsData, ""))))
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(strings.Join(ServiceCheckGetServiceDNSIPs(), ""))))
 }
 
-func ServiceCheckServiceDNSIPsChanged(newIPs []string) bool {
-	if len(ServicecheckServiceDNSIPsData) != len(newIPs) {
-		return true
-	}
-	sort.Strings(ServicecheckServiceDNSIPsData)
-	sort.Strings(newIPs)
-	for i, v := range ServicecheckServiceDNSIPsData {
-		if v != newIPs[i] {
-			return true
-		}
+// ServiceCheckGetServiceDNSIPs returns sorted copy of resolved IPs of service
+func ServiceCheckGetServiceDNSIPs() []string {
+	servicecheckServiceDNSIPsLock.Lock()
+	defer servicecheckServiceDNSIPsLock.Unlock()
+	return append([]string{}, servicecheckServiceDNSIPsData...)
+}
+
+// ServiceCheckUpdateServiceDNSIPs stores resolved IPs of service and returns true if they changed
+func ServiceCheckUpdateServiceDNSIPs(newIPs []string) bool {
+	ips := append([]string{}, newIPs...)
+	sort.Strings(ips)
+	servicecheckServiceDNSIPsLock.Lock()
+	defer servicecheckServiceDNSIPsLock.Unlock()
+	changed := len(servicecheckServiceDNSIPsData) != len(ips)
+	for i := 0; !changed && i < len(ips); i++ {
+		changed = servicecheckServiceDNSIPsData[i] != ips[i]
 	}
-	return false
+	servicecheckServiceDNSIPsData = ips
+	return changed
 }
 
 func ServiceCheckServiceDNSIPs() (ips []string) {
@@ -115,16 +132,34 @@ func ServiceCheckServiceDNSIPs() (ips []string) {
 
 func servicecheckSwitchToRestrictedNetwork() {
 	log.Debug("servicecheckSwitchToRestrictedNetwork ..")
-	if !localconf.Loaded || myconfig.RestrictedNetwork {
+	if !localconf.Loaded || svcRestrictedNetwork.Load() {
+		return
+	}
+	policy := ServiceCheckPolicy()
+	if policy.Mode == SERVICECHECK_MODE_FORCEUDP {
+		return
+	}
+	// captive portal blocks both UDP and websocket, or it answers health check by itself
+	if servicecheckTestCaptivePortal() {
+		log.Info("check restricted network - holding off switch to restricted network until captive portal is cleared")
 		return
 	}
 	// create credentials for restricted network
 	_usr, _pwd, _wss := WSTunnelCredentials()
-	if _usr == "" || _pwd == "" || _wss == "" {
+	bearer := servicecheckPolicyFlag(policy.WSBearerAuth)
+	if _wss == "" || (!bearer && (_usr == "" || _pwd == "")) {
 		log.Error("wstunnel address or credentials is not provided, cannot start")
 		return
 	}
-	auth := base64.StdEncoding.EncodeToString([]byte(_usr + ":" + _pwd))
+	auth := "Basic " + base64.StdEncoding.EncodeToString([]byte(_usr+":"+_pwd))
+	if bearer {
+		token, err := telemetryToken(false)
+		if err != nil {
+			log.Error("check restricted network - cannot get token: ", err)
+			return
+		}
+		auth = "Bearer " + token
+	}
 	_wss = strings.Replace(_wss, "wss://", "https://", 1)
 	url := fmt.Sprintf("%s/api/health", _wss)
 	log.Debug("check restricted network url: ", url)
@@ -134,7 +169,7 @@ func servicecheckSwitchToRestrictedNetwork() {
 		log.Error("check restricted network request: ", err)
 		return
 	}
-	req.Header.Add("Authorization", "Basic "+auth)
+	req.Header.Add("Authorization", auth)
 	client := http.Client{Timeout: 5 * time.Second}
 	// send request
 	resp, err := client.Do(req)
@@ -147,9 +182,15 @@ func servicecheckSwitchToRestrictedNetwork() {
 		return
 	}
 	// we can connect to restricted network, switch to it
-	log.Info("check restricted network - switching to restricted network")
-	myconfig.RestrictedNetwork = true
-	svcIsInitialized = false
+	servicecheckSetRestrictedNetwork(true, "switching to restricted network")
+}
+
+// servicecheckSetRestrictedNetwork changes network mode and forces reconfiguration
+func servicecheckSetRestrictedNetwork(restricted bool, reason string) {
+	log.Info("check restricted network - ", reason)
+	connstate.Event(reason)
+	svcRestrictedNetwork.Store(restricted)
+	svcIsInitialized.Store(false)
 	// insert into log channel empty string to initialize immediate sending after startup
 	logdata <- ""
 	// cleanup active tunnels
@@ -206,16 +247,18 @@ func servicecheckTestActiveNebulaTunnels() bool {
 	for _, v := range list {
 		vpnip := v.VpnIp.String()
 		if vpnip != lighthouseIP {
+			// messages of peer probes are not user traffic
+			counter := PeerstatsUserMessages(&v)
 			if t, ok := servicecheckTunnelArray[vpnip]; ok {
-				if t.MessageCounter != v.MessageCounter {
+				if t.MessageCounter != counter {
 					servicecheckTunnelArray[vpnip] = ServiceCheckTunnelMessageCounter{
-						MessageCounter: v.MessageCounter,
+						MessageCounter: counter,
 						LastChange:     time.Now().UTC(),
 					}
 				}
 			} else {
 				servicecheckTunnelArray[vpnip] = ServiceCheckTunnelMessageCounter{
-					MessageCounter: v.MessageCounter,
+					MessageCounter: counter,
 					LastChange:     time.Now().UTC(),
 				}
 			}
@@ -223,9 +266,10 @@ func servicecheckTestActiveNebulaTunnels() bool {
 	}
 	log.Debug("servicecheckTestActiveNebulaTunnels - list: ", fmt.Sprintf("%+v", servicecheckTunnelArray))
 	// check active tunnels
+	idle := ServiceCheckPolicy().TunnelIdleTimeoutMinutes
 	ret := false
 	for k, v := range servicecheckTunnelArray {
-		if time.Now().UTC().Sub(v.LastChange).Minutes() <= SVCCHECKPTUNNELIDDLETIMEOUTMINUTES {
+		if time.Now().UTC().Sub(v.LastChange).Minutes() <= idle {
 			log.Debug("servicecheckTestActiveNebulaTunnels - tunnel to ", k, " is active")
 			ret = true
 		} else {
@@ -237,24 +281,22 @@ func servicecheckTestActiveNebulaTunnels() bool {
 
 func servicecheckSwitchBackFromRestrictedNetwork() {
 	log.Debug("servicecheckSwitchBackFromRestrictedNetwork ..")
-	if !localconf.Loaded || !myconfig.RestrictedNetwork {
+	if !localconf.Loaded || !svcRestrictedNetwork.Load() {
+		return
+	}
+	p := ServiceCheckPolicy()
+	if p.Mode == SERVICECHECK_MODE_FORCEWEBSOCKET || p.SwitchBack == SERVICECHECK_SWITCHBACK_NEVER {
 		return
 	}
 	// if there is any open established tunnel, do not switch back (except to lighthouse)
-	if servicecheckTestActiveNebulaTunnels() {
+	if p.SwitchBack == SERVICECHECK_SWITCHBACK_IDLE && servicecheckTestActiveNebulaTunnels() {
 		return
 	}
 
 	// send testing UDP packet to lighthouse
 	if servicecheckUDPCheckLighthouse() {
 		// if there is any response, switch back to normal network (because UDP works again)
-		log.Info("check restricted network - switching back to normal network")
-		myconfig.RestrictedNetwork = false
-		svcIsInitialized = false
-		// insert into log channel empty string to initialize immediate sending after startup
-		logdata <- ""
-		// cleanup active tunnels
-		servicecheckTunnelArray = make(map[string]ServiceCheckTunnelMessageCounter)
+		servicecheckSetRestrictedNetwork(false, "switching back to normal network")
 	}
 }
 
@@ -263,7 +305,7 @@ func servicecheckTestRestrictedNetwork() {
 	if !localconf.Loaded {
 		return
 	}
-	if myconfig.RestrictedNetwork {
+	if svcRestrictedNetwork.Load() {
 		servicecheckSwitchBackFromRestrictedNetwork()
 	} else {
 		servicecheckSwitchToRestrictedNetwork()
@@ -280,12 +322,63 @@ func servicecheckHandleWakeUp() {
 	}
 	// force exchange IP configuration with lighthouse
 	log.Info("servicecheck - wake-up from sleep - force exchange IP configuration with lighthouse")
+	connstate.Event("wake-up from sleep")
 	svcProcess.nebula.RebindUDPServer()
 }
 
+// servicecheckHandleNetworkChange reacts to network change reported by OS (gateway, address or link change)
+func servicecheckHandleNetworkChange() {
+	log.Debug("servicecheckHandleNetworkChange ..")
+	if !localconf.Loaded {
+		return
+	}
+	if svcProcess != nil && svcProcess.nebula != nil {
+		log.Info("servicecheck - network change - force exchange IP configuration with lighthouse")
+		svcProcess.nebula.RebindUDPServer()
+	}
+	// DNS can resolve to different IPs in new network
+	newIPs := ServiceCheckServiceDNSIPs()
+	if ServiceCheckUpdateServiceDNSIPs(newIPs) {
+		log.Info("servicecheck - network change - DNS IP change detected, new IPs: ", newIPs)
+		svcIsInitialized.Store(false)
+		// insert into log channel empty string to initialize immediate reconfiguration
+		logdata <- ""
+	}
+	// re-test restricted network immediately instead of waiting for failed pings
+	p := ServiceCheckPolicy()
+	servicecheckPingerNextRunTimeinterval = p.PingIntervalMs
+	if _, forced := servicecheckPolicyForcedMode(p); forced {
+		return
+	}
+	if svcRestrictedNetwork.Load() {
+		servicecheckSwitchBackFromRestrictedNetwork()
+	} else if !servicecheckNetworkChangeUDPCheck() {
+		servicecheckSwitchToRestrictedNetwork()
+	}
+}
+
+// servicecheckNetworkChangeUDPCheck returns true if any of repeated UDP checks of lighthouse succeeds
+func servicecheckNetworkChangeUDPCheck() bool {
+	for i := 0; i < SVCCHECKNETCHANGERETRIES; i++ {
+		if i > 0 {
+			time.Sleep(SVCCHECKNETCHANGESETTLE)
+		}
+		if servicecheckUDPCheckLighthouse() {
+			return true
+		}
+	}
+	log.Info("servicecheck - network change - lighthouse does not respond over UDP")
+	return false
+}
+
 func ServiceCheckPinger() {
 	servicecheckPingerQuit = make(chan bool)
 	log.Info("servicecheck - ping started")
+	// background workers are running with pinger
+	workersQuit := make(chan struct{})
+	defer close(workersQuit)
+	go NetwatchStart(netwatchCreateSource(), workersQuit)
+	go PeerstatsStart(workersQuit)
 	servicecheckTestRestrictedNetworkCounter = 0
 	// cleanup active tunnels
 	servicecheckTunnelArray = make(map[string]ServiceCheckTunnelMessageCounter)
@@ -295,35 +388,52 @@ func ServiceCheckPinger() {
 		case <-servicecheckPingerQuit:
 			log.Debug("servicecheck - quitting ping ..")
 			servicecheckPingerQuit = nil
-			servicecheckPingerSuccess = false
+			servicecheckPingerSuccess.Store(false)
+			servicecheckCaptivePortalSet(false, "")
 			return
+		case e := <-servicecheckNetworkChanged:
+			connstate.Event(fmt.Sprintf("network change: %v", e))
+			servicecheckHandleNetworkChange()
 		case <-time.After(time.Duration(servicecheckPingerNextRunTimeinterval) * time.Millisecond):
 			// check if system was in sleep mode
 			if time.Now().UTC().Sub(currentTime).Milliseconds() >= int64(2*servicecheckPingerNextRunTimeinterval) {
 				servicecheckHandleWakeUp()
 			}
 			// check if tunnels are active
-			ServicecheckExistingTunnels = servicecheckTestActiveNebulaTunnels()
+			ServicecheckExistingTunnels.Store(servicecheckTestActiveNebulaTunnels())
 			// ping loop
-			servicecheckPingerSuccess = NetutilsPing(lighthouseIP)
-			// check if we need to switch to restricted network or back
-			if localconf.Loaded &&
-				((!myconfig.RestrictedNetwork && !servicecheckPingerSuccess) ||
-					(myconfig.RestrictedNetwork && servicecheckPingerSuccess)) {
-				servicecheckTestRestrictedNetworkCounter++
-				if servicecheckTestRestrictedNetworkCounter >= SERVICECHECK_MAXRETRY_RESTRICTEDNET {
-					servicecheckTestRestrictedNetworkCounter = 0
-					servicecheckTestRestrictedNetwork()
+			servicecheckPingerSuccess.Store(NetprobeConnected())
+			connstateUpdateConnectivity(servicecheckPingerSuccess.Load(), svcRestrictedNetwork.Load())
+			// hold off switching of network mode until captive portal is cleared
+			if active, _ := ServiceCheckGetCaptivePortal(); active {
+				servicecheckTestRestrictedNetworkCounter = 0
+				if !servicecheckPingerSuccess.Load() {
+					// portal check blocks pinger, it is repeated less often than ping
+					if time.Now().Before(servicecheckCaptivePortalNextCheck) {
+						continue
+					}
+					servicecheckCaptivePortalNextCheck = time.Now().Add(CAPTIVEPORTAL_CHECKINTERVAL)
+					if servicecheckTestCaptivePortal() {
+						continue
+					}
 				}
-			} else {
+				// portal is gone, react like on any other network change
+				servicecheckCaptivePortalSet(false, "")
+				servicecheckHandleNetworkChange()
+			}
+			// check if we need to switch to restricted network or back
+			decision := servicecheckEvaluate(ServiceCheckPolicy(), svcRestrictedNetwork.Load(), servicecheckPingerSuccess.Load())
+			if !localconf.Loaded {
 				servicecheckTestRestrictedNetworkCounter = 0
+				decision = SERVICECHECK_KEEP
 			}
-			if !servicecheckPingerSuccess {
-				servicecheckPingerNextRunTimeinterval = SVCCHECKPINGINTERVAL
-			} else {
-				if servicecheckPingerNextRunTimeinterval < SVCCHECKPINGINTERVAL*10 {
-					servicecheckPingerNextRunTimeinterval += SVCCHECKPINGINTERVAL
-				}
+			switch decision {
+			case SERVICECHECK_TEST:
+				servicecheckTestRestrictedNetwork()
+			case SERVICECHECK_FORCE_RESTRICTED:
+				servicecheckSetRestrictedNetwork(true, "switching to restricted network forced by policy")
+			case SERVICECHECK_FORCE_NORMAL:
+				servicecheckSetRestrictedNetwork(false, "switching back to normal network forced by policy")
 			}
 		}
 	}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestServiceCheckUpdateServiceDNSIPs(t *testing.T) {
+	defer ServiceCheckUpdateServiceDNSIPs([]string{})
+	ServiceCheckUpdateServiceDNSIPs([]string{})
+	if !ServiceCheckUpdateServiceDNSIPs([]string{"2.2.2.2", "1.1.1.1"}) {
+		t.Error("new IPs are not detected")
+	}
+	// order of resolved IPs does not matter
+	if ServiceCheckUpdateServiceDNSIPs([]string{"1.1.1.1", "2.2.2.2"}) {
+		t.Error("same IPs are detected as change")
+	}
+	hash := ServiceCheckServiceDNSIPsHash()
+	if !ServiceCheckUpdateServiceDNSIPs([]string{"1.1.1.1"}) || hash == ServiceCheckServiceDNSIPsHash() {
+		t.Error("removed IP is not detected")
+	}
+
+	// config loop and pinger update IPs concurrently
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				ServiceCheckUpdateServiceDNSIPs([]string{"3.3.3.3", "1.1.1.1"})
+				ServiceCheckServiceDNSIPsHash()
+				ServiceCheckGetServiceDNSIPs()
+			}
+		}()
+	}
+	wg.Wait()
+	if ips := ServiceCheckGetServiceDNSIPs(); len(ips) != 2 || ips[0] != "1.1.1.1" {
+		t.Errorf("unexpected IPs: %v", ips)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/shieldoo/shieldoo-mesh/wstunnel"
+)
+
+const (
+	// switch to websocket tunnel when UDP does not work and back when UDP works again
+	SERVICECHECK_MODE_AUTO = "auto"
+	// never use websocket tunnel
+	SERVICECHECK_MODE_FORCEUDP = "force-udp"
+	// always use websocket tunnel
+	SERVICECHECK_MODE_FORCEWEBSOCKET = "force-websocket"
+
+	// switch back to UDP only if there are no active tunnels
+	SERVICECHECK_SWITCHBACK_IDLE = "idle"
+	// switch back to UDP as soon as it works, active tunnels are re-established
+	SERVICECHECK_SWITCHBACK_ALWAYS = "always"
+	// stay on websocket tunnel until restart of connection
+	SERVICECHECK_SWITCHBACK_NEVER = "never"
+)
+
+type servicecheckDecision int
+
+const (
+	// nothing to do
+	SERVICECHECK_KEEP servicecheckDecision = iota
+	// test if other mode works and switch to it
+	SERVICECHECK_TEST
+	// switch to websocket tunnel without test
+	SERVICECHECK_FORCE_RESTRICTED
+	// switch to UDP without test
+	SERVICECHECK_FORCE_NORMAL
+)
+
+// servicecheckPolicyMerge takes non-zero values and set options from override
+func servicecheckPolicyMerge(base RestrictedNetworkPolicy, override RestrictedNetworkPolicy) RestrictedNetworkPolicy {
+	if override.Mode != "" {
+		base.Mode = override.Mode
+	}
+	if override.MaxRetry != 0 {
+		base.MaxRetry = override.MaxRetry
+	}
+	if override.SwitchBack != "" {
+		base.SwitchBack = override.SwitchBack
+	}
+	if override.SwitchBackRetry != 0 {
+		base.SwitchBackRetry = override.SwitchBackRetry
+	}
+	if override.PingIntervalMs != 0 {
+		base.PingIntervalMs = override.PingIntervalMs
+	}
+	if override.PingIntervalMaxMs != 0 {
+		base.PingIntervalMaxMs = override.PingIntervalMaxMs
+	}
+	if override.TunnelIdleTimeoutMinutes != 0 {
+		base.TunnelIdleTimeoutMinutes = override.TunnelIdleTimeoutMinutes
+	}
+	if override.WSReadInactivitySeconds != 0 {
+		base.WSReadInactivitySeconds = override.WSReadInactivitySeconds
+	}
+	if override.WSMaxTimeouts != 0 {
+		base.WSMaxTimeouts = override.WSMaxTimeouts
+	}
+	if override.WSPingIntervalSeconds != 0 {
+		base.WSPingIntervalSeconds = override.WSPingIntervalSeconds
+	}
+	if override.WSPongTimeoutSeconds != 0 {
+		base.WSPongTimeoutSeconds = override.WSPongTimeoutSeconds
+	}
+	if override.WSFramed != nil {
+		base.WSFramed = override.WSFramed
+	}
+	if override.WSCompression != nil {
+		base.WSCompression = override.WSCompression
+	}
+	if override.WSBearerAuth != nil {
+		base.WSBearerAuth = override.WSBearerAuth
+	}
+	return base
+}
+
+// servicecheckPolicyFlag returns value of policy option, missing option is disabled
+func servicecheckPolicyFlag(b *bool) bool {
+	return b != nil && *b
+}
+
+// servicecheckPolicySanitize replaces missing or invalid values by defaults
+func servicecheckPolicySanitize(p RestrictedNetworkPolicy) RestrictedNetworkPolicy {
+	p.Mode = strings.ToLower(strings.TrimSpace(p.Mode))
+	switch p.Mode {
+	case SERVICECHECK_MODE_AUTO, SERVICECHECK_MODE_FORCEUDP, SERVICECHECK_MODE_FORCEWEBSOCKET:
+	case "":
+		p.Mode = SERVICECHECK_MODE_AUTO
+	default:
+		log.Error("servicecheck - unknown restricted network mode: ", p.Mode)
+		p.Mode = SERVICECHECK_MODE_AUTO
+	}
+	p.SwitchBack = strings.ToLower(strings.TrimSpace(p.SwitchBack))
+	switch p.SwitchBack {
+	case SERVICECHECK_SWITCHBACK_IDLE, SERVICECHECK_SWITCHBACK_ALWAYS, SERVICECHECK_SWITCHBACK_NEVER:
+	case "":
+		p.SwitchBack = SERVICECHECK_SWITCHBACK_IDLE
+	default:
+		log.Error("servicecheck - unknown restricted network switch-back rule: ", p.SwitchBack)
+		p.SwitchBack = SERVICECHECK_SWITCHBACK_IDLE
+	}
+	if p.MaxRetry <= 0 || p.MaxRetry > 1000 {
+		p.MaxRetry = SERVICECHECK_MAXRETRY_RESTRICTEDNET
+	}
+	if p.SwitchBackRetry <= 0 || p.SwitchBackRetry > 1000 {
+		p.SwitchBackRetry = p.MaxRetry
+	}
+	if p.PingIntervalMs < 100 || p.PingIntervalMs > 60000 {
+		p.PingIntervalMs = SVCCHECKPINGINTERVAL
+	}
+	if p.PingIntervalMaxMs < p.PingIntervalMs || p.PingIntervalMaxMs > 600000 {
+		p.PingIntervalMaxMs = p.PingIntervalMs * 10
+	}
+	if p.TunnelIdleTimeoutMinutes <= 0 {
+		p.TunnelIdleTimeoutMinutes = SVCCHECKPTUNNELIDDLETIMEOUTMINUTES
+	}
+	if p.WSReadInactivitySeconds <= 0 {
+		p.WSReadInactivitySeconds = wstunnel.WSST_MAXREADINACTIVITY
+	}
+	if p.WSMaxTimeouts <= 0 {
+		p.WSMaxTimeouts = wstunnel.WSST_MAXTIMEOUTS
+	}
+	if p.WSPingIntervalSeconds < 1 || p.WSPingIntervalSeconds > 300 {
+		p.WSPingIntervalSeconds = wstunnel.WSST_PINGINTERVAL.Seconds()
+	}
+	if p.WSPongTimeoutSeconds < 1 || p.WSPongTimeoutSeconds > 300 {
+		p.WSPongTimeoutSeconds = wstunnel.WSST_PONGTIMEOUT.Seconds()
+	}
+	return p
+}
+
+// ServiceCheckPolicy returns effective policy, values from management server take precedence over local config
+func ServiceCheckPolicy() RestrictedNetworkPolicy {
+	p := RestrictedNetworkPolicy{}
+	if myconfig != nil {
+		p = myconfig.RestrictedNetworkPolicy
+	}
+	if localconf.Loaded && localconf.ConfigData != nil {
+		p = servicecheckPolicyMerge(p, localconf.ConfigData.RestrictedNetworkPolicy)
+	}
+	return servicecheckPolicySanitize(p)
+}
+
+// servicecheckPolicyForcedMode returns required network mode if it is forced by policy
+func servicecheckPolicyForcedMode(p RestrictedNetworkPolicy) (restricted bool, forced bool) {
+	switch p.Mode {
+	case SERVICECHECK_MODE_FORCEUDP:
+		return false, true
+	case SERVICECHECK_MODE_FORCEWEBSOCKET:
+		return true, true
+	}
+	return false, false
+}
+
+// servicecheckEvaluate updates retry counter and probe interval by result of connectivity probe
+// and returns what has to be done with network mode
+func servicecheckEvaluate(p RestrictedNetworkPolicy, restricted bool, success bool) servicecheckDecision {
+	// probe interval grows while connected
+	if !success {
+		servicecheckPingerNextRunTimeinterval = p.PingIntervalMs
+	} else if servicecheckPingerNextRunTimeinterval < p.PingIntervalMaxMs {
+		servicecheckPingerNextRunTimeinterval += p.PingIntervalMs
+		if servicecheckPingerNextRunTimeinterval > p.PingIntervalMaxMs {
+			servicecheckPingerNextRunTimeinterval = p.PingIntervalMaxMs
+		}
+	}
+	if r, forced := servicecheckPolicyForcedMode(p); forced {
+		servicecheckTestRestrictedNetworkCounter = 0
+		switch {
+		case r && !restricted:
+			return SERVICECHECK_FORCE_RESTRICTED
+		case !r && restricted:
+			return SERVICECHECK_FORCE_NORMAL
+		}
+		return SERVICECHECK_KEEP
+	}
+	if restricted && p.SwitchBack == SERVICECHECK_SWITCHBACK_NEVER {
+		servicecheckTestRestrictedNetworkCounter = 0
+		return SERVICECHECK_KEEP
+	}
+	// failed probe in normal mode or working connection in restricted mode (UDP may work again)
+	if (!restricted && !success) || (restricted && success) {
+		servicecheckTestRestrictedNetworkCounter++
+		limit := p.MaxRetry
+		if restricted {
+			limit = p.SwitchBackRetry
+		}
+		if servicecheckTestRestrictedNetworkCounter >= limit {
+			servicecheckTestRestrictedNetworkCounter = 0
+			return SERVICECHECK_TEST
+		}
+		return SERVICECHECK_KEEP
+	}
+	servicecheckTestRestrictedNetworkCounter = 0
+	return SERVICECHECK_KEEP
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+// testServicecheckRun feeds simulated probe results and returns index of first decision other than keep
+func testServicecheckRun(p RestrictedNetworkPolicy, restricted bool, results []bool) (int, servicecheckDecision) {
+	servicecheckTestRestrictedNetworkCounter = 0
+	servicecheckPingerNextRunTimeinterval = p.PingIntervalMs
+	for i, r := range results {
+		if d := servicecheckEvaluate(p, restricted, r); d != SERVICECHECK_KEEP {
+			return i, d
+		}
+	}
+	return -1, SERVICECHECK_KEEP
+}
+
+func testServicecheckResults(n int, r bool) []bool {
+	ret := make([]bool, n)
+	for i := range ret {
+		ret[i] = r
+	}
+	return ret
+}
+
+func TestServicecheckPolicySanitize(t *testing.T) {
+	log = logrus.New()
+	p := servicecheckPolicySanitize(RestrictedNetworkPolicy{Mode: "Force-WebSocket ", SwitchBack: "sometimes", PingIntervalMs: 500, PingIntervalMaxMs: 100})
+	if p.Mode != SERVICECHECK_MODE_FORCEWEBSOCKET {
+		t.Errorf("unexpected mode: %s", p.Mode)
+	}
+	if p.SwitchBack != SERVICECHECK_SWITCHBACK_IDLE {
+		t.Errorf("unknown switch-back rule has to fall back to idle, got: %s", p.SwitchBack)
+	}
+	if p.MaxRetry != SERVICECHECK_MAXRETRY_RESTRICTEDNET || p.SwitchBackRetry != SERVICECHECK_MAXRETRY_RESTRICTEDNET {
+		t.Errorf("unexpected retries: %d %d", p.MaxRetry, p.SwitchBackRetry)
+	}
+	if p.PingIntervalMs != 500 || p.PingIntervalMaxMs != 5000 {
+		t.Errorf("unexpected intervals: %d %d", p.PingIntervalMs, p.PingIntervalMaxMs)
+	}
+
+	p = servicecheckPolicySanitize(RestrictedNetworkPolicy{Mode: "udp-only"})
+	if p.Mode != SERVICECHECK_MODE_AUTO {
+		t.Errorf("unknown mode has to fall back to auto, got: %s", p.Mode)
+	}
+}
+
+func TestServicecheckPolicyMerge(t *testing.T) {
+	local := RestrictedNetworkPolicy{Mode: SERVICECHECK_MODE_FORCEUDP, MaxRetry: 5, WSMaxTimeouts: 3}
+	server := RestrictedNetworkPolicy{Mode: SERVICECHECK_MODE_FORCEWEBSOCKET, SwitchBackRetry: 7}
+	p := servicecheckPolicyMerge(local, server)
+	if p.Mode != SERVICECHECK_MODE_FORCEWEBSOCKET || p.MaxRetry != 5 || p.SwitchBackRetry != 7 || p.WSMaxTimeouts != 3 {
+		t.Errorf("unexpected merged policy: %+v", p)
+	}
+
+	// explicit false of server disables option enabled locally, missing option keeps local value
+	on, off := true, false
+	local = RestrictedNetworkPolicy{WSFramed: &on, WSCompression: &on, WSBearerAuth: &on}
+	server = RestrictedNetworkPolicy{WSFramed: &off, WSBearerAuth: &off}
+	p = servicecheckPolicyMerge(local, server)
+	if servicecheckPolicyFlag(p.WSFramed) || !servicecheckPolicyFlag(p.WSCompression) || servicecheckPolicyFlag(p.WSBearerAuth) {
+		t.Errorf("unexpected merged options: %v %v %v", *p.WSFramed, *p.WSCompression, *p.WSBearerAuth)
+	}
+	p = servicecheckPolicyMerge(RestrictedNetworkPolicy{}, RestrictedNetworkPolicy{WSCompression: &on})
+	if servicecheckPolicyFlag(p.WSFramed) || !servicecheckPolicyFlag(p.WSCompression) {
+		t.Errorf("unexpected options of server: %+v", p)
+	}
+}
+
+func TestServicecheckEvaluateAuto(t *testing.T) {
+	log = logrus.New()
+	p := servicecheckPolicySanitize(RestrictedNetworkPolicy{MaxRetry: 4, SwitchBackRetry: 6})
+
+	// switch to websocket is tested after MaxRetry consecutive failures
+	if i, d := testServicecheckRun(p, false, testServicecheckResults(10, false)); i != 3 || d != SERVICECHECK_TEST {
+		t.Errorf("expected test after 4 failures, got %d %v", i, d)
+	}
+	// successful probe resets counter
+	results := []bool{false, false, false, true, false, false, false}
+	if i, d := testServicecheckRun(p, false, results); i != -1 || d != SERVICECHECK_KEEP {
+		t.Errorf("expected no decision with interrupted failures, got %d %v", i, d)
+	}
+	// switch back is tested after SwitchBackRetry successes in restricted mode
+	if i, d := testServicecheckRun(p, true, testServicecheckResults(10, true)); i != 5 || d != SERVICECHECK_TEST {
+		t.Errorf("expected switch-back test after 6 successes, got %d %v", i, d)
+	}
+	// failures in restricted mode do not switch anything
+	if i, d := testServicecheckRun(p, true, testServicecheckResults(50, false)); i != -1 || d != SERVICECHECK_KEEP {
+		t.Errorf("expected no decision, got %d %v", i, d)
+	}
+
+	p.SwitchBack = SERVICECHECK_SWITCHBACK_NEVER
+	if i, d := testServicecheckRun(p, true, testServicecheckResults(50, true)); i != -1 || d != SERVICECHECK_KEEP {
+		t.Errorf("expected no switch-back with never rule, got %d %v", i, d)
+	}
+}
+
+func TestServicecheckEvaluateForced(t *testing.T) {
+	log = logrus.New()
+	p := servicecheckPolicySanitize(RestrictedNetworkPolicy{Mode: SERVICECHECK_MODE_FORCEWEBSOCKET})
+	if i, d := testServicecheckRun(p, false, []bool{true}); i != 0 || d != SERVICECHECK_FORCE_RESTRICTED {
+		t.Errorf("expected forced switch to websocket, got %d %v", i, d)
+	}
+	if i, d := testServicecheckRun(p, true, testServicecheckResults(50, true)); i != -1 || d != SERVICECHECK_KEEP {
+		t.Errorf("expected websocket to be kept, got %d %v", i, d)
+	}
+
+	p = servicecheckPolicySanitize(RestrictedNetworkPolicy{Mode: SERVICECHECK_MODE_FORCEUDP})
+	if i, d := testServicecheckRun(p, true, []bool{false}); i != 0 || d != SERVICECHECK_FORCE_NORMAL {
+		t.Errorf("expected forced switch to UDP, got %d %v", i, d)
+	}
+	if i, d := testServicecheckRun(p, false, testServicecheckResults(50, false)); i != -1 || d != SERVICECHECK_KEEP {
+		t.Errorf("expected UDP to be kept, got %d %v", i, d)
+	}
+}
+
+func TestServicecheckEvaluateInterval(t *testing.T) {
+	p := servicecheckPolicySanitize(RestrictedNetworkPolicy{PingIntervalMs: 1000, PingIntervalMaxMs: 3500})
+	testServicecheckRun(p, false, testServicecheckResults(10, true))
+	if servicecheckPingerNextRunTimeinterval != 3500 {
+		t.Errorf("interval has to be capped by max, got %d", servicecheckPingerNextRunTimeinterval)
+	}
+	testServicecheckRun(p, false, []bool{true, true, false})
+	if servicecheckPingerNextRunTimeinterval != 1000 {
+		t.Errorf("interval has to be reset after failure, got %d", servicecheckPingerNextRunTimeinterval)
+	}
+}
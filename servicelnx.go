@@ -14,14 +14,6 @@ import (
 
 const connPipeName = "/tmp/shieldoo.sock"
 
-func svcFirewallCleanup() {
-	// Do nothing because it is not needed for linux
-}
-
-func svcFirewallSetup(cidr string) {
-	// Do nothing because it is not needed for linux
-}
-
 func createCommandListener() (l net.Listener, err error) {
 	log.Debug("create listener to: ", connPipeName)
 	os.Remove(connPipeName)
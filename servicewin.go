@@ -8,6 +8,8 @@ import (
 	"net"
 	"os"
 	"os/exec"
+	"regexp"
+	"strings"
 
 	"github.com/Microsoft/go-winio"
 	"github.com/sirupsen/logrus"
@@ -15,15 +17,18 @@ import (
 	"golang.org/x/sys/windows/svc/eventlog"
 )
 
-func svcFirewallSetup(cidr string) {
+func svcFirewallSetup(fw *SvcFirewallConfig) error {
+	// remove previous rule to keep setup idempotent
+	svcFirewallCleanup()
 	cmd := exec.Command("netsh", "advfirewall", "firewall", "add", "rule", "name=ShieldooMesh",
 		"dir=in", "action=allow", "interfacetype=any", "protocol=any", "profile=any",
-		"localip="+cidr, "remoteip="+cidr)
+		"localip="+fw.CIDR, "remoteip="+fw.CIDR)
 	log.Debug("adding firewall rule for ShieldooMesh")
 	err := cmd.Run()
 	if err != nil {
 		log.Error("cannot execute netsh: ", err)
 	}
+	return err
 }
 
 func svcFirewallCleanup() {
@@ -35,6 +40,134 @@ func svcFirewallCleanup() {
 	}
 }
 
+// windows firewall profiles, kill switch changes outbound policy of all of them
+var svcKillSwitchProfiles = []string{"domainprofile", "privateprofile", "publicprofile"}
+
+// windows defaults, they are used if policy is unknown
+const (
+	SVC_KILLSWITCH_DEFAULT_INBOUND  = "blockinbound"
+	SVC_KILLSWITCH_DEFAULT_OUTBOUND = "allowoutbound"
+)
+
+// outbound policies before kill switch are saved in config directory before they are changed,
+// file is removed after they are restored, so they survive crash of service
+const SVC_KILLSWITCH_STATE_FILENAME = "killswitch.state"
+
+var svcKillSwitchPolicyRegex = regexp.MustCompile(`(?i)\b(blockinboundalways|blockinbound|allowinbound),(blockoutbound|allowoutbound)\b`)
+
+// svcKillSwitchPolicy returns inbound and outbound policy of profile, labels of netsh output are localized
+// so only policy value is parsed
+func svcKillSwitchPolicy(profile string) (inbound string, outbound string, err error) {
+	out, err := exec.Command("netsh", "advfirewall", "show", profile, "firewallpolicy").Output()
+	if err != nil {
+		return "", "", err
+	}
+	m := svcKillSwitchPolicyRegex.FindStringSubmatch(string(out))
+	if m == nil {
+		return "", "", fmt.Errorf("unknown firewall policy of %s", profile)
+	}
+	return strings.ToLower(m[1]), strings.ToLower(m[2]), nil
+}
+
+// svcKillSwitchSaveState saves outbound policies of profiles as profile=policy lines
+func svcKillSwitchSaveState() error {
+	var b strings.Builder
+	for _, p := range svcKillSwitchProfiles {
+		_, outbound, err := svcKillSwitchPolicy(p)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&b, "%s=%s\n", p, outbound)
+	}
+	return saveTextFile(SVC_KILLSWITCH_STATE_FILENAME, b.String())
+}
+
+// svcKillSwitchReadState returns saved outbound policies, ok is false if there is no saved state
+func svcKillSwitchReadState() (saved map[string]string, ok bool) {
+	buf, err := os.ReadFile(execPathCreate(SVC_KILLSWITCH_STATE_FILENAME))
+	if err != nil {
+		return nil, false
+	}
+	saved = make(map[string]string)
+	for _, l := range strings.Split(string(buf), "\n") {
+		kv := strings.SplitN(strings.TrimSpace(l), "=", 2)
+		if len(kv) == 2 && (kv[1] == "allowoutbound" || kv[1] == "blockoutbound") {
+			saved[kv[0]] = kv[1]
+		}
+	}
+	return saved, true
+}
+
+// svcKillSwitchSetOutbound changes outbound policy of profile, inbound policy of user is kept
+func svcKillSwitchSetOutbound(profile string, outbound string) error {
+	inbound, _, err := svcKillSwitchPolicy(profile)
+	if err != nil {
+		log.Warn("kill switch - cannot read policy of ", profile, ", using default inbound policy: ", err)
+		inbound = SVC_KILLSWITCH_DEFAULT_INBOUND
+	}
+	return exec.Command("netsh", "advfirewall", "set", profile, "firewallpolicy", inbound+","+outbound).Run()
+}
+
+// svcKillSwitchSetup switches default outbound policy to block and allows only
+// traffic from mesh IP, DHCP and to allowed underlay IPs
+func svcKillSwitchSetup(ks *SvcKillSwitchConfig) error {
+	// remove previous rules to keep setup idempotent, it restores policy before kill switch
+	svcKillSwitchCleanup()
+	if err := svcKillSwitchSaveState(); err != nil {
+		log.Error("kill switch - cannot save firewall policy: ", err)
+		return err
+	}
+	rules := [][]string{
+		{"name=ShieldooMeshKillSwitch", "dir=out", "action=allow", "protocol=udp", "localport=68", "remoteport=67"},
+	}
+	if ks.IPAddress != "" {
+		rules = append(rules, []string{"name=ShieldooMeshKillSwitch", "dir=out", "action=allow", "localip=" + ks.IPAddress})
+	}
+	if len(ks.AllowedIPs) > 0 {
+		rules = append(rules, []string{"name=ShieldooMeshKillSwitch", "dir=out", "action=allow", "remoteip=" + strings.Join(ks.AllowedIPs, ",")})
+	}
+	log.Debug("adding kill switch rules for ShieldooMesh")
+	for _, r := range rules {
+		args := append([]string{"advfirewall", "firewall", "add", "rule"}, r...)
+		if err := exec.Command("netsh", args...).Run(); err != nil {
+			log.Error("cannot execute netsh: ", err)
+			return err
+		}
+	}
+	for _, p := range svcKillSwitchProfiles {
+		if err := svcKillSwitchSetOutbound(p, "blockoutbound"); err != nil {
+			log.Error("cannot execute netsh: ", err)
+			return err
+		}
+	}
+	return nil
+}
+
+func svcKillSwitchCleanup() {
+	// restore policy only if kill switch was set up
+	saved, ok := svcKillSwitchReadState()
+	if !ok && exec.Command("netsh", "advfirewall", "firewall", "show", "rule", "name=ShieldooMeshKillSwitch").Run() != nil {
+		return
+	}
+	log.Info("deleting kill switch rules for ShieldooMesh")
+	for _, p := range svcKillSwitchProfiles {
+		outbound, found := saved[p]
+		if !found {
+			log.Warn("kill switch - outbound policy before kill switch is unknown, restoring default policy of ", p)
+			outbound = SVC_KILLSWITCH_DEFAULT_OUTBOUND
+		}
+		if err := svcKillSwitchSetOutbound(p, outbound); err != nil {
+			log.Error("cannot execute netsh: ", err)
+		}
+	}
+	if err := exec.Command("netsh", "advfirewall", "firewall", "delete", "rule", "name=ShieldooMeshKillSwitch").Run(); err != nil {
+		log.Error("cannot execute netsh: ", err)
+	}
+	if err := os.Remove(execPathCreate(SVC_KILLSWITCH_STATE_FILENAME)); err != nil && !os.IsNotExist(err) {
+		log.Error("kill switch - cannot remove saved firewall policy: ", err)
+	}
+}
+
 const (
 	// This will set permissions for everyone to have full access
 	AllowEveryone = "S:(ML;;NW;;;LW)D:(A;;0x12019f;;;WD)"
@@ -31,6 +31,7 @@ type NebulaClientUPNYamlConfig struct {
 	AutoDisconnect                bool                        `yaml:"autodisconnect"`
 	AutoDisconnectIntervalMinutes int                         `yaml:"autodisconnectintervalminutes"`
 	LighthouseRoute               bool                        `yaml:"lighthouseroute"`
+	KillSwitch                    bool                        `yaml:"killswitch"`
 }
 
 var myconfig *NebulaClientUPNYamlConfig
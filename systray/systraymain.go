@@ -44,6 +44,7 @@ func help(err string, out io.Writer) {
 var (
 	autostartApp            *autostart.App
 	connectionIsConnected   bool = false
+	connectionCaptivePortal bool = false
 	connectionIsRunningFrom time.Time
 	execPath                string
 )
@@ -89,6 +90,7 @@ const msgConnectWithProfile = "Connect with Access Card"
 const msgWaitingForSignIn = "shieldoo - waiting for sign-in"
 const lighthouseMessageEmpty = "Full tunnel mode for communication"
 const lighthouseMessageParam = "Full tunnel mode (via %s)"
+const killSwitchMessage = "Block traffic outside of full tunnel"
 
 func setMsgLighthouse(ip string) {
 	if mLighthouseRoute != nil {
@@ -212,6 +214,7 @@ var mConnectDefault *systray.MenuItem = nil
 var mSignIn *systray.MenuItem = nil
 var mEditUrl *systray.MenuItem = nil
 var mLighthouseRoute *systray.MenuItem = nil
+var mKillSwitch *systray.MenuItem = nil
 var mConnectSub []*systray.MenuItem = nil
 var mFavourites []*systray.MenuItem = nil
 var maxMenuItems int = 24
@@ -275,6 +278,9 @@ func connectNebulaUI(index int) {
 	if mLighthouseRoute != nil {
 		systrayMenuItemDisable(mLighthouseRoute)
 	}
+	if mKillSwitch != nil {
+		systrayMenuItemDisable(mKillSwitch)
+	}
 	if mFavouriteSelector != nil {
 		systrayMenuItemDisable(mFavouriteSelector)
 	}
@@ -293,6 +299,7 @@ func connectNebulaUI(index int) {
 		Secret:            c.Secret,
 		RestrictedNetwork: myconfig.RestrictedNetwork,
 		LighthouseRoute:   myconfig.LighthouseRoute,
+		KillSwitch:        myconfig.KillSwitch,
 		ClientID:          myconfig.ClientID,
 	}
 	rpcSendReceive(&r)
@@ -316,6 +323,9 @@ func disconnectNebulaUI() {
 	if mLighthouseRoute != nil {
 		systrayMenuItemEnable(mLighthouseRoute)
 	}
+	if mKillSwitch != nil {
+		systrayMenuItemEnable(mKillSwitch)
+	}
 	if mFavouriteSelector != nil {
 		systrayMenuItemEnable(mFavouriteSelector)
 	}
@@ -610,6 +620,15 @@ func checkConnectionStatus() {
 						filepath.FromSlash(execPath+msgLogo))
 				}
 				myconfig.RestrictedNetwork = r.RestrictedNetwork
+				// open sign-in page only once per detected captive portal
+				if r.CaptivePortal && !connectionCaptivePortal && r.CaptivePortalURL != "" {
+					beeep.Notify(
+						"SIGN IN TO NETWORK", "Network requires sign-in, please finish it in opened browser window.",
+						filepath.FromSlash(execPath+msgLogo))
+					// URL comes from untrusted network
+					open.Run(SafeBrowserURL(r.CaptivePortalURL))
+				}
+				connectionCaptivePortal = r.CaptivePortal
 				if r.IsConnected && !runningDisconnecting {
 					systraySetToolTip("shieldoo - connected")
 					if !connectionIsConnected {
@@ -658,6 +677,9 @@ func checkConnectionStatus() {
 					iconConnectingIndex++
 					systraySetTemplateIcon(*tmpicn)
 					systraySetToolTip("shieldoo - connecting ..")
+					if r.CaptivePortal {
+						systraySetToolTip("shieldoo - sign in to network required")
+					}
 				}
 				// process auto-disconnect
 				if connectionIsConnected &&
@@ -800,6 +822,7 @@ func onReady() {
 		systray.AddSeparator()
 		mEditUrl = systray.AddMenuItem("Specify Shieldoo network", "Specify Shieldoo network")
 		mLighthouseRoute = systray.AddMenuItemCheckbox(lighthouseMessageEmpty, lighthouseMessageEmpty, myconfig.LighthouseRoute)
+		mKillSwitch = systray.AddMenuItemCheckbox(killSwitchMessage, killSwitchMessage, myconfig.KillSwitch)
 		mFavouriteSelector = systray.AddMenuItem("Favourite Shieldoo networks", "Favourite Shieldoo networks")
 		mFavourites = []*systray.MenuItem{}
 		for i := 0; i < maxMenuItems; i++ {
@@ -950,6 +973,14 @@ func onReady() {
 				} else {
 					mLighthouseRoute.Uncheck()
 				}
+			case <-mKillSwitch.ClickedCh:
+				myconfig.KillSwitch = !myconfig.KillSwitch
+				saveClientConf()
+				if myconfig.KillSwitch {
+					mKillSwitch.Check()
+				} else {
+					mKillSwitch.Uncheck()
+				}
 			case <-mSignIn.ClickedCh:
 				if myconfig.Uri == "" {
 					inputUri()
@@ -3,10 +3,14 @@ package main
 import (
 	"crypto/rand"
 	"encoding/base64"
+	"net/url"
 	"os/user"
 	"strings"
 )
 
+// well known URL which is opened if captive portal sign-in URL is not safe
+const CAPTIVEPORTAL_DEFAULT_URL = "http://connectivitycheck.gstatic.com/generate_204"
+
 func GenerateRandomBytes(n int) []byte {
 	b := make([]byte, n)
 	_, err := rand.Read(b)
@@ -34,3 +38,12 @@ func GetHomeDir() string {
 	}
 	return user.HomeDir
 }
+
+// SafeBrowserURL returns URL which can be opened in browser, only absolute http and https URLs are allowed
+func SafeBrowserURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.User != nil {
+		return CAPTIVEPORTAL_DEFAULT_URL
+	}
+	return u.String()
+}
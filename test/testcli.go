@@ -5,6 +5,9 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
 
 	rpc "github.com/shieldoo/shieldoo-mesh/rpc"
 )
@@ -24,12 +27,16 @@ func main() {
 		fmt.Println(`-start -> start connection - use there json config in format: {"accessid":0,"uri":"","secret":""}`)
 		fmt.Println(`-stop -> stop connection`)
 		fmt.Println(`-status -> get status`)
+		fmt.Println(`-history -> get history of connection state events`)
+		fmt.Println(`-peers -> show tunnels to peers with quality metrics`)
 		os.Exit(1)
 	}
 
 	startFlag := flag.String("start", "", `Start it. Send there json config in format: {"accessid":0,"uri":"","secret":""}`)
 	stopFlag := flag.Bool("stop", false, "Stop it.")
 	statusFlag := flag.Bool("status", false, "Get status.")
+	historyFlag := flag.Bool("history", false, "Get history of connection state events.")
+	peersFlag := flag.Bool("peers", false, "Show tunnels to peers with quality metrics.")
 
 	flag.Parse()
 
@@ -38,6 +45,15 @@ func main() {
 		m := rpc.RpcCommandStatus{Version: rpc.RPCVERSION}
 		send(&m)
 	}
+	if *historyFlag {
+		fmt.Println("history ..")
+		m := rpc.RpcCommandHistory{Version: rpc.RPCVERSION}
+		send(&m)
+	}
+	if *peersFlag {
+		m := rpc.RpcCommandPeers{Version: rpc.RPCVERSION}
+		printPeers(send(&m))
+	}
 	if *stopFlag {
 		fmt.Println("stop ..")
 		m := rpc.RpcCommandStop{Version: rpc.RPCVERSION}
@@ -61,7 +77,32 @@ type CloseWriter interface {
 	CloseWrite() error
 }
 
-func send(msg interface{}) {
+func printPeers(data []byte) {
+	resp := rpc.RpcCommandResponse{}
+	if err := json.Unmarshal(data, &resp); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "VPN IP\tNAME\tREMOTE\tPATH\tHANDSHAKE SEEN\tMESSAGES\tRTT\tLOSS\tRTT HISTORY")
+	for _, p := range resp.Peers {
+		path := "direct"
+		if p.Relayed {
+			path = "relay " + strings.Join(p.Relays, ",")
+		}
+		var hist []string
+		for _, s := range p.History {
+			hist = append(hist, fmt.Sprintf("%.0f", s.RTTMs))
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%.1fms\t%.0f%%\t%s\n",
+			p.VpnIP, p.Name, p.RemoteAddr, path, p.HandshakeSeenAt.Local().Format(time.Stamp),
+			p.MessageCounter, p.RTTMs, p.PacketLoss, strings.Join(hist, " "))
+	}
+	w.Flush()
+}
+
+func send(msg interface{}) []byte {
+	var ret []byte
 	clientDone := make(chan bool)
 
 	client, err := createClient()
@@ -72,14 +113,14 @@ func send(msg interface{}) {
 
 	go func() {
 		// client read back
-		bytes := make([]byte, 1024)
-		n, e := client.Read(bytes)
+		c, data, e := rpc.RpcReadPacket(client)
 		if e != nil {
 			fmt.Println(e)
 		}
-		fmt.Printf("read bytes: %v\n", n)
-		fmt.Printf("read header: %v\n", bytes[0:4])
-		fmt.Printf("response: %v\n", string(bytes[4:]))
+		fmt.Printf("read bytes: %v\n", len(data))
+		fmt.Printf("read command: %v\n", c)
+		fmt.Printf("response: %v\n", string(data))
+		ret = data
 		close(clientDone)
 	}()
 
@@ -90,4 +131,5 @@ func send(msg interface{}) {
 	fmt.Printf("OK send ..")
 	client.(CloseWriter).CloseWrite()
 	<-clientDone
+	return ret
 }
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/shieldoo/shieldoo-mesh/wstunnel/server"
+	log "github.com/sirupsen/logrus"
+)
+
+func main() {
+	cfg := server.Config{}
+	flag.StringVar(&cfg.Listen, "listen", ":8080", "Listen address of HTTP server.")
+	flag.StringVar(&cfg.TLSCert, "cert", "", "TLS certificate file, plain HTTP is used if empty.")
+	flag.StringVar(&cfg.TLSKey, "key", "", "TLS key file.")
+	flag.StringVar(&cfg.Lighthouse, "lighthouse", "", "UDP address of nebula lighthouse, e.g. 10.0.0.1:4242.")
+	flag.StringVar(&cfg.Username, "username", "", "Username of clients.")
+	flag.IntVar(&cfg.MaxConnections, "maxconn", 1000, "Max number of active tunnels, 0 means unlimited.")
+	flag.StringVar(&cfg.MetricsListen, "metrics", "", "Listen address of metrics endpoint, e.g. 127.0.0.1:9090, metrics require client credentials on tunnel listener if empty.")
+	flag.IntVar(&cfg.MaxConnectionsPerUser, "maxconnperuser", 4, "Max number of active tunnels of one user and access, 0 means unlimited.")
+	debug := flag.Bool("debug", false, "Run in debug mode with more detailed logging.")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprintln(os.Stderr, "  Password of clients is read from WSTUNNEL_PASSWORD environment variable.")
+		fmt.Fprintln(os.Stderr, "  Bearer JWT of devices is accepted if HS256 secret is set in WSTUNNEL_JWT_SECRET environment variable,")
+		fmt.Fprintln(os.Stderr, "  its upn and access_id claims have to match tunnel path.")
+	}
+	flag.Parse()
+	// password is not passed on command line, it would be visible in process list
+	cfg.Password = os.Getenv("WSTUNNEL_PASSWORD")
+	if secret := os.Getenv("WSTUNNEL_JWT_SECRET"); secret != "" {
+		cfg.ValidateToken = server.NewJWTValidator([]byte(secret))
+	}
+	if *debug {
+		log.SetLevel(log.DebugLevel)
+	}
+	if cfg.Lighthouse == "" || cfg.Username == "" || cfg.Password == "" {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	srv := server.New(cfg)
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+		<-sig
+		log.Info("wstunnel server - shutting down ..")
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+	}()
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal("wstunnel server - ", err)
+	}
+}
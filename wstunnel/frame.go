@@ -0,0 +1,29 @@
+package wstunnel
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// FrameAppend appends datagram prefixed by its length to framed message
+func FrameAppend(msg []byte, pkt []byte) []byte {
+	msg = binary.BigEndian.AppendUint16(msg, uint16(len(pkt)))
+	return append(msg, pkt...)
+}
+
+// FrameSplit returns datagrams of framed message, datagrams before malformed frame are returned with error
+func FrameSplit(msg []byte) ([][]byte, error) {
+	var ret [][]byte
+	for len(msg) > 0 {
+		if len(msg) < 2 {
+			return ret, fmt.Errorf("truncated frame header")
+		}
+		l := int(binary.BigEndian.Uint16(msg))
+		if len(msg) < 2+l {
+			return ret, fmt.Errorf("truncated frame: %d bytes expected, %d available", l, len(msg)-2)
+		}
+		ret = append(ret, msg[2:2+l])
+		msg = msg[2+l:]
+	}
+	return ret, nil
+}
@@ -0,0 +1,122 @@
+package wstunnel
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestFrameSplit(t *testing.T) {
+	pkts := [][]byte{[]byte("first"), {}, bytes.Repeat([]byte{0xff}, 1500)}
+	var msg []byte
+	for _, p := range pkts {
+		msg = FrameAppend(msg, p)
+	}
+	ret, err := FrameSplit(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ret) != len(pkts) {
+		t.Fatalf("expected %d datagrams, got %d", len(pkts), len(ret))
+	}
+	for i := range pkts {
+		if !bytes.Equal(ret[i], pkts[i]) {
+			t.Errorf("datagram %d differs", i)
+		}
+	}
+
+	// datagrams before malformed frame are kept
+	ret, err = FrameSplit(append(FrameAppend(nil, []byte("ok")), 0x00, 0x10, 0x01))
+	if err == nil || len(ret) != 1 || string(ret[0]) != "ok" {
+		t.Errorf("unexpected result of truncated message: %q %v", ret, err)
+	}
+	if _, err = FrameSplit([]byte{0x01}); err == nil {
+		t.Errorf("truncated header is not detected")
+	}
+}
+
+// testFramedServer echoes messages, it accepts framed subprotocol only if framed is true
+func testFramedServer(framed bool, messages *int32) *httptest.Server {
+	upgrader := websocket.Upgrader{EnableCompression: true}
+	if framed {
+		upgrader.Subprotocols = []string{WSST_SUBPROTOCOL_FRAMED}
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		for {
+			mt, msg, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(messages, 1)
+			if err := c.WriteMessage(mt, msg); err != nil {
+				return
+			}
+		}
+	}))
+}
+
+func testFramedBurst(t *testing.T, framed bool, compression bool) int32 {
+	var messages int32
+	srv := testFramedServer(framed, &messages)
+	defer srv.Close()
+
+	port := testFreeUDPPort(t)
+	tun := &WSTunnel{}
+	tun.SetFraming(true, compression)
+	if err := tun.Start(port, "ws"+strings.TrimPrefix(srv.URL, "http"), "user", "pwd", 1, "test"); err != nil {
+		t.Fatal(err)
+	}
+	defer tun.Stop()
+	to := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	testExchange(t, c, to, "connect")
+	atomic.StoreInt32(&messages, 0)
+
+	// burst of datagrams has to come back complete and in order
+	const count = 100
+	for i := 0; i < count; i++ {
+		c.WriteTo([]byte(fmt.Sprintf("packet-%03d", i)), to)
+	}
+	buf := make([]byte, 2048)
+	for i := 0; i < count; i++ {
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := c.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("packet %d: %v", i, err)
+		}
+		if exp := fmt.Sprintf("packet-%03d", i); string(buf[:n]) != exp {
+			t.Fatalf("received %q, expected %q", buf[:n], exp)
+		}
+	}
+	return atomic.LoadInt32(&messages)
+}
+
+func TestWSTunnelFramed(t *testing.T) {
+	if n := testFramedBurst(t, true, false); n >= 100 {
+		t.Errorf("datagrams were not batched, %d messages", n)
+	}
+	if n := testFramedBurst(t, true, true); n >= 100 {
+		t.Errorf("datagrams were not batched with compression, %d messages", n)
+	}
+	// server without framed mode gets one datagram per message
+	if n := testFramedBurst(t, false, false); n != 100 {
+		t.Errorf("expected 100 messages without framed mode, got %d", n)
+	}
+}
@@ -0,0 +1,155 @@
+package wstunnel
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Long-polling transport is used when websocket upgrade is not possible.
+// Client opens session by empty POST to URL of websocket tunnel with /poll suffix,
+// sends framed datagrams by POST and receives them by GET which waits up to WSST_POLLTIMEOUT,
+// session is closed by DELETE. Session is identified by random ID in query parameter session.
+
+const (
+	// max time of waiting GET request on server
+	WSST_POLLTIMEOUT = 20 * time.Second
+	// server closes session without requests after this time
+	WSST_POLLSESSIONTIMEOUT = time.Minute
+	// max size of request or response body
+	WSST_POLLMAXBODY int64 = 256 * 1024
+)
+
+// PollURL converts websocket URL of tunnel to URL of long-polling transport
+func PollURL(wsurl string) string {
+	u := wsurl
+	if strings.HasPrefix(u, "wss://") {
+		u = "https://" + strings.TrimPrefix(u, "wss://")
+	} else if strings.HasPrefix(u, "ws://") {
+		u = "http://" + strings.TrimPrefix(u, "ws://")
+	}
+	return strings.TrimSuffix(u, "/") + "/poll"
+}
+
+// wstunnelPollFallback returns true if status of failed websocket handshake means that upgrade was not possible,
+// errors of server or authorization are not solved by other transport
+func wstunnelPollFallback(status int) bool {
+	switch status {
+	case http.StatusBadRequest, http.StatusMethodNotAllowed, http.StatusUpgradeRequired:
+		return true
+	}
+	return status >= 200 && status < 300
+}
+
+func wstunnelPollSessionID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// pollRequest sends request of session and returns body of response, nil body means no content
+func (p *wstunnelPeer) pollRequest(ctx context.Context, client *http.Client, authz string, method string, url string, body []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", authz)
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNoContent:
+		return nil, nil
+	case http.StatusOK:
+		return io.ReadAll(io.LimitReader(resp.Body, WSST_POLLMAXBODY))
+	case http.StatusUnauthorized:
+		atomic.StoreInt32(&p.refreshToken, 1)
+	}
+	return nil, fmt.Errorf("long-polling %s request failed with status %d", method, resp.StatusCode)
+}
+
+// pollSession forwards packets over long-polling transport until request fails
+func (p *wstunnelPeer) pollSession(authz string) (connected bool, err error) {
+	ctx, cancel := context.WithCancel(p.ctx)
+	defer cancel()
+	client := &http.Client{Timeout: WSST_POLLTIMEOUT + WSST_DIALTIMEOUT}
+	url := PollURL(p.t.url) + "?session=" + wstunnelPollSessionID()
+
+	// open session
+	if _, err := p.pollRequest(ctx, client, authz, http.MethodPost, url, nil); err != nil {
+		return false, err
+	}
+	log.Info("wstunnel connected ", p.addr, " over long-polling")
+	atomic.StoreInt32(&p.connected, 1)
+	atomic.StoreInt32(&p.polling, 1)
+	atomic.StoreInt32(&p.framed, 1)
+	defer func() {
+		atomic.StoreInt32(&p.connected, 0)
+		atomic.StoreInt32(&p.polling, 0)
+	}()
+
+	// receiver runs waiting GET requests until session ends
+	recverr := make(chan error, 1)
+	go func() {
+		for {
+			msg, err := p.pollRequest(ctx, client, authz, http.MethodGet, url, nil)
+			if err != nil {
+				recverr <- err
+				return
+			}
+			atomic.StoreInt64(&p.lastRead, time.Now().UnixNano())
+			if msg == nil {
+				continue
+			}
+			atomic.AddUint64(&p.t.counters.bytesIn, uint64(len(msg)))
+			pkts, err := FrameSplit(msg)
+			if err != nil {
+				log.Error("wstunnel invalid framed message: ", err)
+			}
+			for _, pkt := range pkts {
+				if _, err := p.udpconn.WriteTo(pkt, p.addr); err != nil && p.ctx.Err() == nil {
+					log.Error("wstunnel error in send udp back to client:", err)
+				}
+			}
+		}
+	}()
+	defer func() {
+		cancel()
+		<-recverr
+	}()
+
+	for {
+		select {
+		case <-p.ctx.Done():
+			// close session on server, parent context is already cancelled
+			dctx, dcancel := context.WithTimeout(context.Background(), time.Second)
+			p.pollRequest(dctx, client, authz, http.MethodDelete, url, nil)
+			dcancel()
+			return true, nil
+		case err := <-recverr:
+			// put error back for deferred wait
+			recverr <- err
+			return true, err
+		case buf := <-p.out:
+			msg := p.batch(buf)
+			start := time.Now()
+			if _, err := p.pollRequest(ctx, client, authz, http.MethodPost, url, msg); err != nil {
+				return true, err
+			}
+			atomic.StoreInt64(&p.rtt, int64(time.Since(start)))
+			atomic.AddUint64(&p.t.counters.bytesOut, uint64(len(msg)))
+		}
+	}
+}
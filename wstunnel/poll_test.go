@@ -0,0 +1,255 @@
+package wstunnel
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testUDPEcho returns datagrams back to sender
+func testUDPEcho(t *testing.T) net.PacketConn {
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := c.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			c.WriteTo(buf[:n], addr)
+		}
+	}()
+	return c
+}
+
+func TestPollURL(t *testing.T) {
+	if u := PollURL("wss://example.com/wstunnel/udp/upn/1"); u != "https://example.com/wstunnel/udp/upn/1/poll" {
+		t.Errorf("unexpected url: %s", u)
+	}
+	if u := PollURL("ws://127.0.0.1:8080/wstunnel/udp/upn/1/"); u != "http://127.0.0.1:8080/wstunnel/udp/upn/1/poll" {
+		t.Errorf("unexpected url: %s", u)
+	}
+}
+
+func TestWSTunnelPollFallback(t *testing.T) {
+	echo := testUDPEcho(t)
+	defer echo.Close()
+
+	poll := &PollHandler{
+		Dial: func(r *http.Request) (net.Conn, error) {
+			return net.Dial("udp", echo.LocalAddr().String())
+		},
+		Authorize: func(r *http.Request) bool {
+			u, p, ok := r.BasicAuth()
+			return ok && u == "user" && p == "pwd"
+		},
+		PollTimeout: 200 * time.Millisecond,
+	}
+	defer poll.Close()
+	// proxy strips upgrade headers, so websocket handshake gets plain response
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/poll") {
+			poll.ServeHTTP(w, r)
+			return
+		}
+		w.Write([]byte("upgrade is not supported"))
+	}))
+	defer srv.Close()
+
+	port := testFreeUDPPort(t)
+	tun := &WSTunnel{}
+	if err := tun.Start(port, "ws"+strings.TrimPrefix(srv.URL, "http"), "user", "pwd", 1, "test"); err != nil {
+		t.Fatal(err)
+	}
+	defer tun.Stop()
+	to := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}
+	a, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	for i := 0; i < 5; i++ {
+		testExchange(t, a, to, "from-a")
+		testExchange(t, b, to, "from-b")
+	}
+	// idle poll requests time out on server and are repeated
+	time.Sleep(500 * time.Millisecond)
+	testExchange(t, a, to, "after-idle")
+
+	st := tun.Stats()
+	if len(st.Peers) != 2 {
+		t.Fatalf("expected 2 peers: %+v", st)
+	}
+	for _, p := range st.Peers {
+		if p.Transport != "poll" || !p.Connected {
+			t.Errorf("peer is not connected over long-polling: %+v", p)
+		}
+	}
+	if st.BytesIn == 0 || st.BytesOut == 0 {
+		t.Errorf("bytes are not counted: %+v", st)
+	}
+}
+
+func TestPollHandler(t *testing.T) {
+	echo := testUDPEcho(t)
+	defer echo.Close()
+	poll := &PollHandler{
+		Dial: func(r *http.Request) (net.Conn, error) {
+			return net.Dial("udp", echo.LocalAddr().String())
+		},
+		Authorize: func(r *http.Request) bool {
+			return r.Header.Get("Authorization") != ""
+		},
+		PollTimeout: 100 * time.Millisecond,
+	}
+	defer poll.Close()
+	srv := httptest.NewServer(poll)
+	defer srv.Close()
+
+	do := func(method string, query string, body string, auth bool) *http.Response {
+		req, _ := http.NewRequest(method, srv.URL+"/poll"+query, strings.NewReader(body))
+		if auth {
+			req.Header.Set("Authorization", "Basic x")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	sid := "?session=0123456789abcdef0123456789abcdef"
+	if r := do(http.MethodPost, sid, "", false); r.StatusCode != http.StatusUnauthorized {
+		t.Errorf("unauthorized request: %d", r.StatusCode)
+	}
+	if r := do(http.MethodPost, "?session=short", "", true); r.StatusCode != http.StatusBadRequest {
+		t.Errorf("invalid session: %d", r.StatusCode)
+	}
+	if r := do(http.MethodGet, sid, "", true); r.StatusCode != http.StatusNotFound {
+		t.Errorf("get of unknown session: %d", r.StatusCode)
+	}
+	if r := do(http.MethodPost, sid, "", true); r.StatusCode != http.StatusNoContent {
+		t.Errorf("open session: %d", r.StatusCode)
+	}
+	if r := do(http.MethodGet, sid, "", true); r.StatusCode != http.StatusNoContent {
+		t.Errorf("poll timeout has to return no content: %d", r.StatusCode)
+	}
+	if r := do(http.MethodPost, sid, string(FrameAppend(nil, []byte("x"))[:2]), true); r.StatusCode != http.StatusBadRequest {
+		t.Errorf("malformed frame: %d", r.StatusCode)
+	}
+	if r := do(http.MethodDelete, sid, "", true); r.StatusCode != http.StatusNoContent {
+		t.Errorf("close session: %d", r.StatusCode)
+	}
+	if r := do(http.MethodGet, sid, "", true); r.StatusCode != http.StatusNotFound {
+		t.Errorf("get of closed session: %d", r.StatusCode)
+	}
+}
+
+func TestPollHandlerExpiresIdleSessions(t *testing.T) {
+	echo := testUDPEcho(t)
+	defer echo.Close()
+	dialed := make(chan net.Conn, 1)
+	poll := &PollHandler{
+		Dial: func(r *http.Request) (net.Conn, error) {
+			c, err := net.Dial("udp", echo.LocalAddr().String())
+			dialed <- c
+			return c, err
+		},
+		SessionTimeout: 200 * time.Millisecond,
+	}
+	defer poll.Close()
+	srv := httptest.NewServer(poll)
+	defer srv.Close()
+
+	resp, err := http.Post(srv.URL+"/poll?session=0123456789abcdef0123456789abcdef", "application/octet-stream", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	c := <-dialed
+	// session is abandoned, no other request arrives
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, err := c.Write([]byte("x")); err != nil {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Error("abandoned session is not expired")
+}
+
+func TestPollHandlerSessionOwner(t *testing.T) {
+	echo := testUDPEcho(t)
+	defer echo.Close()
+	poll := &PollHandler{
+		Dial: func(r *http.Request) (net.Conn, error) {
+			return net.Dial("udp", echo.LocalAddr().String())
+		},
+		PollTimeout: 100 * time.Millisecond,
+	}
+	defer poll.Close()
+	srv := httptest.NewServer(poll)
+	defer srv.Close()
+
+	do := func(method string, path string, body []byte) int {
+		req, _ := http.NewRequest(method, srv.URL+path+"?session=0123456789abcdef0123456789abcdef", bytes.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if c := do(http.MethodPost, "/wstunnel/udp/a/1/poll", nil); c != http.StatusNoContent {
+		t.Fatalf("open session: %d", c)
+	}
+	// session id of other tunnel can not be used to read or inject datagrams
+	for _, m := range []string{http.MethodGet, http.MethodPost} {
+		if c := do(m, "/wstunnel/udp/b/1/poll", nil); c != http.StatusForbidden {
+			t.Errorf("%s of other identity: %d", m, c)
+		}
+	}
+	do(http.MethodDelete, "/wstunnel/udp/b/1/poll", nil)
+
+	// client does not poll, echoed datagrams over queue size are dropped,
+	// they are sent in small batches to not overflow socket buffers
+	var body []byte
+	for i := 0; i < WSST_QUEUESIZE/4; i++ {
+		body = FrameAppend(body, []byte("x"))
+	}
+	for i := 0; i < 8; i++ {
+		if c := do(http.MethodPost, "/wstunnel/udp/a/1/poll", body); c != http.StatusNoContent {
+			t.Fatalf("session is closed by other identity: %d", c)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for poll.Dropped() == 0 && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if poll.Dropped() == 0 {
+		t.Error("dropped datagrams are not counted")
+	}
+
+	// closed handler does not create sessions again
+	poll.Close()
+	if c := do(http.MethodPost, "/wstunnel/udp/a/1/poll", nil); c != http.StatusServiceUnavailable {
+		t.Errorf("request after close: %d", c)
+	}
+	if poll.sessions != nil {
+		t.Error("sessions are created after close")
+	}
+}
@@ -0,0 +1,252 @@
+package wstunnel
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// PollHandler is reference server of long-polling transport, every session gets its own
+// datagram connection created by Dial (usually UDP connection to nebula lighthouse)
+type PollHandler struct {
+	// accessed atomically, first in struct because of 64-bit alignment on 32-bit platforms
+	dropped uint64
+	// Dial creates upstream connection for new session
+	Dial func(r *http.Request) (net.Conn, error)
+	// Authorize checks request, nil means that all requests are allowed
+	Authorize func(r *http.Request) bool
+	// Principal returns authenticated identity of request, session can be used only by identity which
+	// created it, nil means URL path of request (tunnel path, bearer tokens are bound to it)
+	Principal func(r *http.Request) string
+	// zero values mean WSST_POLLTIMEOUT and WSST_POLLSESSIONTIMEOUT
+	PollTimeout    time.Duration
+	SessionTimeout time.Duration
+
+	lock     sync.Mutex
+	sessions map[string]*pollServerSession
+	// closed when handler is closed, it stops expiration of sessions
+	done   chan struct{}
+	closed bool
+}
+
+type pollServerSession struct {
+	conn      net.Conn
+	in        chan []byte
+	lastSeen  time.Time
+	principal string
+}
+
+var errPollClosed = errors.New("poll handler is closed")
+var errPollPrincipal = errors.New("poll session belongs to other identity")
+
+// Dropped returns number of datagrams from upstream dropped because poll queue of session was full
+func (h *PollHandler) Dropped() uint64 {
+	return atomic.LoadUint64(&h.dropped)
+}
+
+func (h *PollHandler) principal(r *http.Request) string {
+	if h.Principal != nil {
+		return h.Principal(r)
+	}
+	return r.URL.Path
+}
+
+func (h *PollHandler) timeouts() (time.Duration, time.Duration) {
+	poll, session := h.PollTimeout, h.SessionTimeout
+	if poll <= 0 {
+		poll = WSST_POLLTIMEOUT
+	}
+	if session <= 0 {
+		session = WSST_POLLSESSIONTIMEOUT
+	}
+	return poll, session
+}
+
+// session returns existing session of request identity, new one is created if create is true
+func (h *PollHandler) session(id string, r *http.Request, create bool) (*pollServerSession, error) {
+	_, sessionTimeout := h.timeouts()
+	principal := h.principal(r)
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.closed {
+		return nil, errPollClosed
+	}
+	if h.sessions == nil {
+		h.sessions = make(map[string]*pollServerSession)
+		h.done = make(chan struct{})
+		go h.expire(h.done, sessionTimeout)
+	}
+	if s, ok := h.sessions[id]; ok {
+		if s.principal != principal {
+			return nil, errPollPrincipal
+		}
+		s.lastSeen = time.Now()
+		return s, nil
+	}
+	if !create {
+		return nil, nil
+	}
+	conn, err := h.Dial(r)
+	if err != nil {
+		return nil, err
+	}
+	s := &pollServerSession{conn: conn, in: make(chan []byte, WSST_QUEUESIZE), lastSeen: time.Now(), principal: principal}
+	h.sessions[id] = s
+	go func() {
+		for {
+			buf := make([]byte, 2048)
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			select {
+			case s.in <- buf[:n]:
+			default:
+				// client does not poll fast enough
+				atomic.AddUint64(&h.dropped, 1)
+			}
+		}
+	}()
+	return s, nil
+}
+
+// expire closes abandoned sessions until done is closed, sessions of idle server are expired too
+func (h *PollHandler) expire(done chan struct{}, sessionTimeout time.Duration) {
+	ticker := time.NewTicker(sessionTimeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		h.lock.Lock()
+		for k, s := range h.sessions {
+			if time.Since(s.lastSeen) > sessionTimeout {
+				log.Debug("wstunnel poll session expired: ", k)
+				s.conn.Close()
+				delete(h.sessions, k)
+			}
+		}
+		h.lock.Unlock()
+	}
+}
+
+func (h *PollHandler) close(id string, r *http.Request) {
+	principal := h.principal(r)
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if s, ok := h.sessions[id]; ok && s.principal == principal {
+		s.conn.Close()
+		delete(h.sessions, id)
+	}
+}
+
+// Close closes all sessions, handler rejects all requests after close
+func (h *PollHandler) Close() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.closed = true
+	for _, s := range h.sessions {
+		s.conn.Close()
+	}
+	h.sessions = nil
+	if h.done != nil {
+		close(h.done)
+		h.done = nil
+	}
+}
+
+func (h *PollHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.Authorize != nil && !h.Authorize(r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	id := r.URL.Query().Get("session")
+	if len(id) < 16 || len(id) > 64 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case http.MethodPost:
+		body, err := io.ReadAll(io.LimitReader(r.Body, WSST_POLLMAXBODY))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		s, err := h.session(id, r, true)
+		if err != nil {
+			h.sessionError(w, err)
+			return
+		}
+		pkts, err := FrameSplit(body)
+		for _, pkt := range pkts {
+			s.conn.Write(pkt)
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodGet:
+		s, err := h.session(id, r, false)
+		if err != nil {
+			h.sessionError(w, err)
+			return
+		}
+		if s == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		pollTimeout, _ := h.timeouts()
+		timer := time.NewTimer(pollTimeout)
+		defer timer.Stop()
+		var msg []byte
+		select {
+		case <-r.Context().Done():
+			return
+		case <-timer.C:
+			w.WriteHeader(http.StatusNoContent)
+			return
+		case pkt := <-s.in:
+			msg = FrameAppend(msg, pkt)
+		}
+		// add everything what is already waiting
+	drain:
+		for int64(len(msg)) < WSST_POLLMAXBODY-2048 {
+			select {
+			case pkt := <-s.in:
+				msg = FrameAppend(msg, pkt)
+			default:
+				break drain
+			}
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.WriteHeader(http.StatusOK)
+		w.Write(msg)
+	case http.MethodDelete:
+		h.close(id, r)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *PollHandler) sessionError(w http.ResponseWriter, err error) {
+	switch err {
+	case errPollClosed:
+		w.WriteHeader(http.StatusServiceUnavailable)
+	case errPollPrincipal:
+		log.Warn("wstunnel poll session used by other identity")
+		w.WriteHeader(http.StatusForbidden)
+	default:
+		log.Error("wstunnel poll cannot create upstream connection: ", err)
+		w.WriteHeader(http.StatusBadGateway)
+	}
+}
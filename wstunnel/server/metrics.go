@@ -0,0 +1,61 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+)
+
+// Metrics are counters of server since start
+type Metrics struct {
+	ConnectionsTotal    uint64
+	ConnectionsRejected uint64
+	AuthFailures        uint64
+	BytesIn             uint64
+	BytesOut            uint64
+	DatagramsIn         uint64
+	DatagramsOut        uint64
+	// datagrams from lighthouse dropped because long-polling client did not poll fast enough
+	DatagramsDropped uint64
+}
+
+func (m *Metrics) add(counter *uint64, v uint64) {
+	atomic.AddUint64(counter, v)
+}
+
+// Metrics returns copy of counters
+func (s *Server) Metrics() Metrics {
+	m := &s.metrics
+	return Metrics{
+		ConnectionsTotal:    atomic.LoadUint64(&m.ConnectionsTotal),
+		ConnectionsRejected: atomic.LoadUint64(&m.ConnectionsRejected),
+		AuthFailures:        atomic.LoadUint64(&m.AuthFailures),
+		BytesIn:             atomic.LoadUint64(&m.BytesIn),
+		BytesOut:            atomic.LoadUint64(&m.BytesOut),
+		DatagramsIn:         atomic.LoadUint64(&m.DatagramsIn),
+		DatagramsOut:        atomic.LoadUint64(&m.DatagramsOut),
+		DatagramsDropped:    s.poll.Dropped(),
+	}
+}
+
+// write writes metrics in prometheus text format
+func (m *Metrics) write(w io.Writer, active int) {
+	counters := []struct {
+		name  string
+		help  string
+		value *uint64
+	}{
+		{"wstunnel_connections_total", "Number of accepted tunnels.", &m.ConnectionsTotal},
+		{"wstunnel_connections_rejected_total", "Number of tunnels rejected by connection limits.", &m.ConnectionsRejected},
+		{"wstunnel_auth_failures_total", "Number of requests with invalid credentials.", &m.AuthFailures},
+		{"wstunnel_received_bytes_total", "Bytes received from clients.", &m.BytesIn},
+		{"wstunnel_sent_bytes_total", "Bytes sent to clients.", &m.BytesOut},
+		{"wstunnel_received_datagrams_total", "Datagrams forwarded from clients to lighthouse.", &m.DatagramsIn},
+		{"wstunnel_sent_datagrams_total", "Datagrams forwarded from lighthouse to clients.", &m.DatagramsOut},
+		{"wstunnel_dropped_datagrams_total", "Datagrams from lighthouse dropped because long-polling client did not poll.", &m.DatagramsDropped},
+	}
+	fmt.Fprintf(w, "# HELP wstunnel_connections_active Number of active tunnels.\n# TYPE wstunnel_connections_active gauge\nwstunnel_connections_active %d\n", active)
+	for _, c := range counters {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", c.name, c.help, c.name, c.name, atomic.LoadUint64(c.value))
+	}
+}
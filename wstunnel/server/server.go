@@ -0,0 +1,389 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/shieldoo/shieldoo-mesh/wstunnel"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// websocket without any message or ping from client is closed after this time
+	SERVER_READTIMEOUT = 60 * time.Second
+	// write timeout of websocket message
+	SERVER_WRITETIMEOUT = 5 * time.Second
+	// datagrams from lighthouse arriving within window are sent in one message in framed mode
+	SERVER_BATCHWINDOW = time.Millisecond
+)
+
+// Config of wstunnel server
+type Config struct {
+	// listen address of HTTP server, e.g. :8080
+	Listen string
+	// TLS certificate and key, plain HTTP is used if empty (e.g. behind reverse proxy)
+	TLSCert string
+	TLSKey  string
+	// UDP address of nebula lighthouse
+	Lighthouse string
+	// basic auth credentials of clients
+	Username string
+	Password string
+	// validates bearer token of client (e.g. device JWT issued by management server), token has to be issued for UPN
+	// and access ID of tunnel path, they are empty for health check which only verifies token,
+	// nil disables bearer authentication
+	ValidateToken func(token string, upn string, accessid int) bool
+	// max number of active tunnels, zero means unlimited
+	MaxConnections int
+	// max number of active tunnels of one UPN and access ID, zero means unlimited
+	MaxConnectionsPerUser int
+	// listen address of admin HTTP server with /metrics (e.g. 127.0.0.1:9090), if empty /metrics is served
+	// on tunnel listener and it requires basic auth credentials
+	MetricsListen string
+}
+
+// Server relays websocket and long-polling tunnels to nebula lighthouse
+type Server struct {
+	// accessed atomically, first in struct because of 64-bit alignment on 32-bit platforms
+	metrics  Metrics
+	cfg      Config
+	upgrader websocket.Upgrader
+	poll     *wstunnel.PollHandler
+	lock     sync.Mutex
+	active   int
+	users    map[string]int
+	http     *http.Server
+	admin    *http.Server
+}
+
+var errServerLimit = errors.New("connection limit reached")
+
+func New(cfg Config) *Server {
+	s := &Server{
+		cfg:   cfg,
+		users: make(map[string]int),
+		upgrader: websocket.Upgrader{
+			Subprotocols:      []string{wstunnel.WSST_SUBPROTOCOL_FRAMED},
+			EnableCompression: true,
+		},
+	}
+	s.poll = &wstunnel.PollHandler{
+		Dial:      s.pollDial,
+		Authorize: s.authorize,
+	}
+	return s
+}
+
+// Handler returns HTTP handler with all endpoints of server
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/health", s.handleHealth)
+	if s.cfg.MetricsListen == "" {
+		mux.HandleFunc("/metrics", s.handleMetricsAuth)
+	}
+	mux.HandleFunc("/wstunnel/udp/", s.handleTunnel)
+	return mux
+}
+
+// AdminHandler returns HTTP handler of admin listener, it is not authenticated
+func (s *Server) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", s.handleMetrics)
+	return mux
+}
+
+func (s *Server) ListenAndServe() error {
+	s.http = &http.Server{
+		Addr:              s.cfg.Listen,
+		Handler:           s.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	if s.cfg.MetricsListen != "" {
+		s.admin = &http.Server{
+			Addr:              s.cfg.MetricsListen,
+			Handler:           s.AdminHandler(),
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		go func() {
+			log.Info("wstunnel server metrics listening on ", s.cfg.MetricsListen)
+			if err := s.admin.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Error("wstunnel server - metrics listener failed: ", err)
+			}
+		}()
+	}
+	log.Info("wstunnel server listening on ", s.cfg.Listen, ", lighthouse: ", s.cfg.Lighthouse)
+	if s.cfg.TLSCert != "" {
+		return s.http.ListenAndServeTLS(s.cfg.TLSCert, s.cfg.TLSKey)
+	}
+	return s.http.ListenAndServe()
+}
+
+// Shutdown stops accepting of new connections and closes long-polling sessions,
+// active websockets are closed by clients or by read timeout
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.poll.Close()
+	if s.admin != nil {
+		s.admin.Shutdown(ctx)
+	}
+	if s.http == nil {
+		return nil
+	}
+	return s.http.Shutdown(ctx)
+}
+
+func (s *Server) authorize(r *http.Request) bool {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && s.cfg.ValidateToken != nil {
+		upn, accessid := "", 0
+		if r.URL.Path != "/api/health" {
+			var err error
+			if upn, accessid, _, err = parseTunnelPath(r.URL.Path); err != nil {
+				s.metrics.add(&s.metrics.AuthFailures, 1)
+				return false
+			}
+		}
+		if s.cfg.ValidateToken(token, upn, accessid) {
+			return true
+		}
+		s.metrics.add(&s.metrics.AuthFailures, 1)
+		return false
+	}
+	usr, pwd, ok := r.BasicAuth()
+	if ok &&
+		subtle.ConstantTimeCompare([]byte(usr), []byte(s.cfg.Username)) == 1 &&
+		subtle.ConstantTimeCompare([]byte(pwd), []byte(s.cfg.Password)) == 1 {
+		return true
+	}
+	s.metrics.add(&s.metrics.AuthFailures, 1)
+	return false
+}
+
+// authorizeAdmin checks basic auth credentials of server, tokens of devices are not accepted
+func (s *Server) authorizeAdmin(r *http.Request) bool {
+	usr, pwd, ok := r.BasicAuth()
+	return ok &&
+		subtle.ConstantTimeCompare([]byte(usr), []byte(s.cfg.Username)) == 1 &&
+		subtle.ConstantTimeCompare([]byte(pwd), []byte(s.cfg.Password)) == 1
+}
+
+// parseTunnelPath returns UPN and access ID from /wstunnel/udp/{upn}/{accessid}[/poll]
+func parseTunnelPath(path string) (upn string, accessid int, poll bool, err error) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(path, "/wstunnel/udp/"), "/"), "/")
+	if len(parts) == 3 && parts[2] == "poll" {
+		poll = true
+		parts = parts[:2]
+	}
+	if len(parts) != 2 || parts[0] == "" {
+		return "", 0, false, fmt.Errorf("invalid tunnel path: %s", path)
+	}
+	accessid, err = strconv.Atoi(parts[1])
+	if err != nil {
+		return "", 0, false, fmt.Errorf("invalid access id: %s", parts[1])
+	}
+	return parts[0], accessid, poll, nil
+}
+
+// acquire reserves slot of tunnel within limits
+func (s *Server) acquire(user string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if (s.cfg.MaxConnections > 0 && s.active >= s.cfg.MaxConnections) ||
+		(s.cfg.MaxConnectionsPerUser > 0 && s.users[user] >= s.cfg.MaxConnectionsPerUser) {
+		s.metrics.add(&s.metrics.ConnectionsRejected, 1)
+		return errServerLimit
+	}
+	s.active++
+	s.users[user]++
+	s.metrics.add(&s.metrics.ConnectionsTotal, 1)
+	return nil
+}
+
+func (s *Server) release(user string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.active--
+	s.users[user]--
+	if s.users[user] <= 0 {
+		delete(s.users, user)
+	}
+}
+
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	if !s.authorize(r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+func (s *Server) handleMetricsAuth(w http.ResponseWriter, r *http.Request) {
+	if !s.authorizeAdmin(r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	s.handleMetrics(w, r)
+}
+
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	active := s.active
+	s.lock.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m := s.Metrics()
+	m.write(w, active)
+}
+
+func (s *Server) handleTunnel(w http.ResponseWriter, r *http.Request) {
+	upn, accessid, poll, err := parseTunnelPath(r.URL.Path)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if poll {
+		s.poll.ServeHTTP(w, r)
+		return
+	}
+	if !s.authorize(r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	user := fmt.Sprintf("%s/%d", upn, accessid)
+	if err := s.acquire(user); err != nil {
+		log.Info("wstunnel server - rejected connection of ", user, ": ", err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	defer s.release(user)
+	udp, err := net.Dial("udp", s.cfg.Lighthouse)
+	if err != nil {
+		log.Error("wstunnel server - cannot connect lighthouse: ", err)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer udp.Close()
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Debug("wstunnel server - upgrade failed: ", err)
+		return
+	}
+	defer conn.Close()
+	log.Info("wstunnel server - connected ", user, " from ", r.RemoteAddr)
+	s.relay(conn, udp)
+	log.Info("wstunnel server - disconnected ", user)
+}
+
+// relay forwards datagrams between websocket and lighthouse until one side fails
+func (s *Server) relay(conn *websocket.Conn, udp net.Conn) {
+	framed := conn.Subprotocol() == wstunnel.WSST_SUBPROTOCOL_FRAMED
+	conn.SetReadDeadline(time.Now().Add(SERVER_READTIMEOUT))
+	conn.SetPingHandler(func(data string) error {
+		conn.SetReadDeadline(time.Now().Add(SERVER_READTIMEOUT))
+		err := conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(SERVER_WRITETIMEOUT))
+		if err != nil && !errors.Is(err, websocket.ErrCloseSent) {
+			return err
+		}
+		return nil
+	})
+
+	// lighthouse to websocket, this goroutine is the only writer of data messages
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer conn.Close()
+		buf := make([]byte, 2048)
+		for {
+			udp.SetReadDeadline(time.Time{})
+			n, err := udp.Read(buf)
+			if err != nil {
+				return
+			}
+			msg := append([]byte{}, buf[:n]...)
+			count := 1
+			if framed {
+				msg = wstunnel.FrameAppend(nil, buf[:n])
+				// add datagrams arriving within batch window
+				udp.SetReadDeadline(time.Now().Add(SERVER_BATCHWINDOW))
+				for len(msg) < wstunnel.WSST_BATCHMAXSIZE {
+					n, err := udp.Read(buf)
+					if err != nil {
+						break
+					}
+					msg = wstunnel.FrameAppend(msg, buf[:n])
+					count++
+				}
+			}
+			conn.SetWriteDeadline(time.Now().Add(SERVER_WRITETIMEOUT))
+			if err := conn.WriteMessage(websocket.BinaryMessage, msg); err != nil {
+				return
+			}
+			s.metrics.add(&s.metrics.BytesOut, uint64(len(msg)))
+			s.metrics.add(&s.metrics.DatagramsOut, uint64(count))
+		}
+	}()
+
+	// websocket to lighthouse
+	for {
+		mt, msg, err := conn.ReadMessage()
+		if err != nil {
+			break
+		}
+		conn.SetReadDeadline(time.Now().Add(SERVER_READTIMEOUT))
+		if mt != websocket.BinaryMessage {
+			continue
+		}
+		s.metrics.add(&s.metrics.BytesIn, uint64(len(msg)))
+		pkts := [][]byte{msg}
+		if framed {
+			if pkts, err = wstunnel.FrameSplit(msg); err != nil {
+				log.Debug("wstunnel server - invalid framed message: ", err)
+			}
+		}
+		for _, pkt := range pkts {
+			udp.Write(pkt)
+		}
+		s.metrics.add(&s.metrics.DatagramsIn, uint64(len(pkts)))
+	}
+	// unblock lighthouse reader
+	udp.Close()
+	<-done
+}
+
+// pollConn releases slot of tunnel when long-polling session is closed
+type pollConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *pollConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
+
+func (s *Server) pollDial(r *http.Request) (net.Conn, error) {
+	upn, accessid, _, err := parseTunnelPath(r.URL.Path)
+	if err != nil {
+		return nil, err
+	}
+	user := fmt.Sprintf("%s/%d", upn, accessid)
+	if err := s.acquire(user); err != nil {
+		return nil, err
+	}
+	udp, err := net.Dial("udp", s.cfg.Lighthouse)
+	if err != nil {
+		s.release(user)
+		return nil, err
+	}
+	log.Info("wstunnel server - connected ", user, " over long-polling from ", r.RemoteAddr)
+	return &pollConn{Conn: udp, release: func() { s.release(user) }}, nil
+}
@@ -0,0 +1,282 @@
+package server
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/shieldoo/shieldoo-mesh/wstunnel"
+)
+
+// testLighthouse is UDP echo server in place of nebula lighthouse
+func testLighthouse(t *testing.T) net.PacketConn {
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := c.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			c.WriteTo(buf[:n], addr)
+		}
+	}()
+	return c
+}
+
+func testServer(t *testing.T, cfg Config) (*Server, *httptest.Server, net.PacketConn) {
+	lh := testLighthouse(t)
+	cfg.Lighthouse = lh.LocalAddr().String()
+	cfg.Username = "user"
+	cfg.Password = "pwd"
+	s := New(cfg)
+	return s, httptest.NewServer(s.Handler()), lh
+}
+
+func testFreeUDPPort(t *testing.T) int {
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	return c.LocalAddr().(*net.UDPAddr).Port
+}
+
+func testExchange(t *testing.T, c net.PacketConn, to net.Addr, msg string) {
+	buf := make([]byte, 2048)
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		c.WriteTo([]byte(msg), to)
+		c.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		n, _, err := c.ReadFrom(buf)
+		if err != nil {
+			continue
+		}
+		if string(buf[:n]) != msg {
+			t.Fatalf("received %q, expected %q", buf[:n], msg)
+		}
+		return
+	}
+	t.Fatalf("%q was not relayed", msg)
+}
+
+func TestParseTunnelPath(t *testing.T) {
+	upn, id, poll, err := parseTunnelPath("/wstunnel/udp/john@example.com/42")
+	if err != nil || upn != "john@example.com" || id != 42 || poll {
+		t.Errorf("unexpected result: %s %d %v %v", upn, id, poll, err)
+	}
+	if _, _, poll, err = parseTunnelPath("/wstunnel/udp/john/42/poll"); err != nil || !poll {
+		t.Errorf("poll path is not recognized: %v %v", poll, err)
+	}
+	for _, p := range []string{"/wstunnel/udp/", "/wstunnel/udp/john", "/wstunnel/udp/john/x", "/wstunnel/udp/john/1/2"} {
+		if _, _, _, err := parseTunnelPath(p); err == nil {
+			t.Errorf("invalid path %s is accepted", p)
+		}
+	}
+}
+
+func TestServerHealth(t *testing.T) {
+	_, srv, lh := testServer(t, Config{})
+	defer srv.Close()
+	defer lh.Close()
+
+	req, _ := http.NewRequest("GET", srv.URL+"/api/health", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("health without credentials: %d", resp.StatusCode)
+	}
+	req.SetBasicAuth("user", "pwd")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("health with credentials: %d", resp.StatusCode)
+	}
+}
+
+func TestServerEndToEnd(t *testing.T) {
+	for _, framed := range []bool{false, true} {
+		s, srv, lh := testServer(t, Config{})
+
+		port := testFreeUDPPort(t)
+		tun := &wstunnel.WSTunnel{}
+		tun.SetFraming(framed, framed)
+		if err := tun.Start(port, "ws"+strings.TrimPrefix(srv.URL, "http"), "user", "pwd", 7, "john@example.com"); err != nil {
+			t.Fatal(err)
+		}
+		c, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		to := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}
+		for i := 0; i < 5; i++ {
+			testExchange(t, c, to, "nebula packet")
+		}
+		st := tun.Stats()
+		if len(st.Peers) != 1 || st.Peers[0].Framed != framed {
+			t.Errorf("framed %v: unexpected tunnel stats %+v", framed, st)
+		}
+		m := s.Metrics()
+		if m.ConnectionsTotal != 1 || m.DatagramsIn < 5 || m.DatagramsOut < 5 {
+			t.Errorf("framed %v: unexpected metrics %+v", framed, m)
+		}
+
+		tun.Stop()
+		c.Close()
+		srv.Close()
+		lh.Close()
+	}
+}
+
+func TestServerLimits(t *testing.T) {
+	s, srv, lh := testServer(t, Config{MaxConnections: 3, MaxConnectionsPerUser: 2})
+	defer srv.Close()
+	defer lh.Close()
+
+	dial := func(upn string) (*websocket.Conn, int) {
+		req := &http.Request{Header: http.Header{}}
+		req.SetBasicAuth("user", "pwd")
+		h := req.Header
+		c, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/wstunnel/udp/"+upn+"/1", h)
+		if err != nil {
+			if resp == nil {
+				t.Fatal(err)
+			}
+			return nil, resp.StatusCode
+		}
+		return c, http.StatusSwitchingProtocols
+	}
+	var conns []*websocket.Conn
+	for _, upn := range []string{"a", "a", "a", "b", "c"} {
+		c, status := dial(upn)
+		if c != nil {
+			conns = append(conns, c)
+		}
+		t.Logf("%s: %d", upn, status)
+	}
+	if len(conns) != 3 {
+		t.Errorf("expected 3 accepted connections, got %d", len(conns))
+	}
+	if m := s.Metrics(); m.ConnectionsRejected != 2 {
+		t.Errorf("expected 2 rejected connections, got %d", m.ConnectionsRejected)
+	}
+
+	// slots are released after disconnect
+	for _, c := range conns {
+		c.Close()
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		c, _ := dial("c")
+		if c != nil {
+			c.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("slot was not released after disconnect")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	resp, err := http.Get(srv.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("metrics without credentials: %d", resp.StatusCode)
+	}
+	req, _ := http.NewRequest("GET", srv.URL+"/metrics", nil)
+	req.SetBasicAuth("user", "pwd")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	for _, m := range []string{"wstunnel_connections_active ", "wstunnel_connections_rejected_total ", "wstunnel_connections_total ", "wstunnel_auth_failures_total 0"} {
+		if !strings.Contains(string(body), m) {
+			t.Errorf("metrics do not contain %q:\n%s", m, body)
+		}
+	}
+}
+
+func TestServerMetricsListener(t *testing.T) {
+	s, srv, lh := testServer(t, Config{MetricsListen: "127.0.0.1:0"})
+	defer srv.Close()
+	defer lh.Close()
+
+	req, _ := http.NewRequest("GET", srv.URL+"/metrics", nil)
+	req.SetBasicAuth("user", "pwd")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("metrics are served on tunnel listener: %d", resp.StatusCode)
+	}
+	admin := httptest.NewServer(s.AdminHandler())
+	defer admin.Close()
+	resp, err = http.Get(admin.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), "wstunnel_connections_active ") {
+		t.Errorf("metrics are not served on admin listener:\n%s", body)
+	}
+}
+
+func TestServerBearerToken(t *testing.T) {
+	secret := []byte("jwt-secret")
+	valid := testJWT(secret, "john@example.com", 7, time.Hour)
+	expired := testJWT(secret, "john@example.com", 7, -time.Hour)
+	s, srv, lh := testServer(t, Config{ValidateToken: NewJWTValidator(secret)})
+	defer srv.Close()
+	defer lh.Close()
+
+	// first token is expired, tunnel has to request new one after rejection
+	var refreshed int32
+	port := testFreeUDPPort(t)
+	tun := &wstunnel.WSTunnel{}
+	tun.SetTokenSource(func(refresh bool) (string, error) {
+		if refresh {
+			atomic.AddInt32(&refreshed, 1)
+			return valid, nil
+		}
+		return expired, nil
+	})
+	if err := tun.Start(port, "ws"+strings.TrimPrefix(srv.URL, "http"), "", "", 7, "john@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	defer tun.Stop()
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	testExchange(t, c, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}, "nebula packet")
+	if atomic.LoadInt32(&refreshed) != 1 {
+		t.Errorf("token was refreshed %d times", refreshed)
+	}
+	if m := s.Metrics(); m.AuthFailures != 1 {
+		t.Errorf("expected 1 auth failure, got %d", m.AuthFailures)
+	}
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// jwtClaims are claims of device JWT which bind token to tunnel
+type jwtClaims struct {
+	Upn       string `json:"upn"`
+	AccessID  int    `json:"access_id"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// NewJWTValidator returns validator of HS256 signed device JWT for Config.ValidateToken, token has to be
+// unexpired and its upn and access_id claims have to match tunnel path
+func NewJWTValidator(secret []byte) func(token string, upn string, accessid int) bool {
+	return func(token string, upn string, accessid int) bool {
+		claims, ok := jwtVerify(token, secret)
+		if !ok || claims.ExpiresAt == 0 || time.Now().Unix() >= claims.ExpiresAt {
+			return false
+		}
+		// health check only verifies token
+		if upn == "" && accessid == 0 {
+			return true
+		}
+		return strings.EqualFold(claims.Upn, upn) && claims.AccessID == accessid
+	}
+}
+
+// jwtVerify checks HS256 signature of token and returns its claims
+func jwtVerify(token string, secret []byte) (*jwtClaims, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, false
+	}
+	header, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, false
+	}
+	var h struct {
+		Alg string `json:"alg"`
+	}
+	if json.Unmarshal(header, &h) != nil || h.Alg != "HS256" {
+		return nil, false
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, false
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return nil, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, false
+	}
+	claims := &jwtClaims{}
+	if json.Unmarshal(payload, claims) != nil {
+		return nil, false
+	}
+	return claims, true
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testJWT(secret []byte, upn string, accessid int, valid time.Duration) string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+	payload, _ := json.Marshal(jwtClaims{Upn: upn, AccessID: accessid, ExpiresAt: time.Now().Add(valid).Unix()})
+	msg := header + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(msg))
+	return msg + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestJWTValidator(t *testing.T) {
+	secret := []byte("jwt-secret")
+	validate := NewJWTValidator(secret)
+	token := testJWT(secret, "john@example.com", 7, time.Hour)
+	tests := []struct {
+		name     string
+		token    string
+		upn      string
+		accessid int
+		want     bool
+	}{
+		{"valid", token, "john@example.com", 7, true},
+		{"health check", token, "", 0, true},
+		{"other access", token, "john@example.com", 8, false},
+		{"other user", token, "eve@example.com", 7, false},
+		{"expired", testJWT(secret, "john@example.com", 7, -time.Minute), "john@example.com", 7, false},
+		{"other secret", testJWT([]byte("other"), "john@example.com", 7, time.Hour), "john@example.com", 7, false},
+		{"malformed", "abc.def", "john@example.com", 7, false},
+	}
+	for _, tt := range tests {
+		if got := validate(tt.token, tt.upn, tt.accessid); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestServerBearerTokenBoundToPath(t *testing.T) {
+	secret := []byte("jwt-secret")
+	_, srv, lh := testServer(t, Config{ValidateToken: NewJWTValidator(secret)})
+	defer srv.Close()
+	defer lh.Close()
+
+	// token of other access cannot open tunnel of access 7
+	req, _ := http.NewRequest("GET", srv.URL+"/wstunnel/udp/john@example.com/7/poll?session=0123456789abcdef0123456789abcdef", nil)
+	req.Header.Set("Authorization", "Bearer "+testJWT(secret, "john@example.com", 8, time.Hour))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("token of other access is accepted: %d", resp.StatusCode)
+	}
+	req, _ = http.NewRequest("GET", strings.Replace(req.URL.String(), "/7/", "/8/", 1), nil)
+	req.Header.Set("Authorization", "Bearer "+testJWT(secret, "john@example.com", 8, time.Hour))
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("token bound to path is rejected: %d", resp.StatusCode)
+	}
+}
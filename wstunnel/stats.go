@@ -0,0 +1,81 @@
+package wstunnel
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+type wstunnelCounters struct {
+	reconnects uint64
+	bytesIn    uint64
+	bytesOut   uint64
+}
+
+// PeerStats describes websocket session of one local peer
+type PeerStats struct {
+	LocalAddr string
+	Connected bool
+	Framed    bool
+	// websocket or poll
+	Transport string
+	RTT       time.Duration
+}
+
+// Stats describes state of tunnel since start
+type Stats struct {
+	IsRunning   bool
+	Reconnects  uint64
+	BytesIn     uint64
+	BytesOut    uint64
+	LastError   string
+	LastErrorAt time.Time
+	// RTT is highest of latest RTTs measured by websocket ping on connected sessions
+	RTT   time.Duration
+	Peers []PeerStats
+}
+
+func (t *WSTunnel) setError(err error) {
+	if err == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.lastErr = err.Error()
+	t.lastErrAt = time.Now().UTC()
+}
+
+// Stats returns counters and state of local peers
+func (t *WSTunnel) Stats() Stats {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	s := Stats{
+		IsRunning:   t.isrunning,
+		Reconnects:  atomic.LoadUint64(&t.counters.reconnects),
+		BytesIn:     atomic.LoadUint64(&t.counters.bytesIn),
+		BytesOut:    atomic.LoadUint64(&t.counters.bytesOut),
+		LastError:   t.lastErr,
+		LastErrorAt: t.lastErrAt,
+		Peers:       []PeerStats{},
+	}
+	for _, p := range t.peers {
+		ps := PeerStats{
+			LocalAddr: p.addr.String(),
+			Connected: atomic.LoadInt32(&p.connected) == 1,
+			Framed:    atomic.LoadInt32(&p.framed) == 1,
+			Transport: "websocket",
+			RTT:       time.Duration(atomic.LoadInt64(&p.rtt)),
+		}
+		if atomic.LoadInt32(&p.polling) == 1 {
+			ps.Transport = "poll"
+		}
+		if ps.Connected && ps.RTT > s.RTT {
+			s.RTT = ps.RTT
+		}
+		s.Peers = append(s.Peers, ps)
+	}
+	sort.Slice(s.Peers, func(i, j int) bool {
+		return s.Peers[i].LocalAddr < s.Peers[j].LocalAddr
+	})
+	return s
+}
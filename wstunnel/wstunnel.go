@@ -1,184 +1,529 @@
 package wstunnel
 
 import (
+	"context"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"math/rand"
 	"net"
 	"net/http"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
 	log "github.com/sirupsen/logrus"
 )
 
+// default timeouts, can be changed by SetTimeouts
 const WSST_MAXREADINACTIVITY float64 = 10
 const WSST_MAXTIMEOUTS int = 5
 
+// websocket session of local peer without outgoing traffic is closed after this time
+const WSST_PEERIDLETIMEOUT = 5 * time.Minute
+
+const (
+	// reconnect backoff, doubled after every failed attempt
+	WSST_BACKOFFMIN = 500 * time.Millisecond
+	WSST_BACKOFFMAX = 30 * time.Second
+	// websocket handshake and write timeout
+	WSST_DIALTIMEOUT  = 10 * time.Second
+	WSST_WRITETIMEOUT = 5 * time.Second
+	// packets waiting for websocket writer, newer packets are dropped when queue is full
+	WSST_QUEUESIZE int = 256
+)
+
+const (
+	// subprotocol of framed mode, websocket message contains datagrams prefixed by uint16 big-endian length
+	WSST_SUBPROTOCOL_FRAMED = "shieldoo-wstunnel-framed"
+	// datagrams arriving within window are sent in one message in framed mode
+	WSST_BATCHWINDOW = time.Millisecond
+	// max size of message in framed mode
+	WSST_BATCHMAXSIZE int = 32 * 1024
+)
+
+// default keepalive, can be changed by SetKeepalive
+const (
+	// websocket ping is sent in this interval also on idle tunnel
+	WSST_PINGINTERVAL = 15 * time.Second
+	// connection without pong or other data for ping interval plus this timeout is dead
+	WSST_PONGTIMEOUT = 10 * time.Second
+)
+
+var errWstunnelTimeout = errors.New("no data received from websocket")
+
+// TokenSource returns bearer token for authentication of websocket session,
+// refresh is true when server rejected previous token
+type TokenSource func(refresh bool) (string, error)
+
+// WSTunnel forwards UDP packets from local peers over websocket,
+// every local source address has its own websocket session so return traffic goes back to right peer.
+// Every peer has one goroutine which owns websocket connection and is the only writer to it.
 type WSTunnel struct {
-	locaddr       net.Addr
-	udpconn       net.PacketConn
-	udplock       sync.Mutex
-	conn          *websocket.Conn
-	url           string
-	auth          string
-	isrunning     bool
-	localport     int
-	lastWrite     time.Time
-	lastRead      time.Time
-	timeoutsCount int
-}
-
-func (t *WSTunnel) receiveHandler() {
+	// accessed atomically, first in struct because of 64-bit alignment on 32-bit platforms
+	counters  wstunnelCounters
+	lock      sync.Mutex
+	udpconn   net.PacketConn
+	peers     map[string]*wstunnelPeer
+	ctx       context.Context
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+	url       string
+	auth      string
+	token     TokenSource
+	isrunning bool
+	localport int
+	// zero values mean defaults
+	maxReadInactivity float64
+	maxTimeouts       int
+	// framed mode and compression are used only if server accepts them
+	framed      bool
+	compression bool
+	// zero values mean defaults
+	pingInterval time.Duration
+	pongTimeout  time.Duration
+	lastErr      string
+	lastErrAt    time.Time
+}
+
+// wstunnelPeer is websocket session of one local UDP peer
+type wstunnelPeer struct {
+	// unix nano timestamps, accessed atomically, first in struct because of 64-bit alignment on 32-bit platforms
+	lastActive int64
+	lastRead   int64
+	rtt        int64
+	connected  int32
+	framed     int32
+	polling    int32
+	// set when server rejected token, next session requests new one
+	refreshToken int32
+	t            *WSTunnel
+	addr         net.Addr
+	udpconn      net.PacketConn
+	ctx          context.Context
+	cancel       context.CancelFunc
+	out          chan []byte
+}
+
+// wstunnelBackoff returns delay before reconnect attempt with random jitter, attempts are counted from 0
+func wstunnelBackoff(attempt int) time.Duration {
+	d := WSST_BACKOFFMIN
+	for i := 0; i < attempt && d < WSST_BACKOFFMAX; i++ {
+		d *= 2
+	}
+	if d > WSST_BACKOFFMAX {
+		d = WSST_BACKOFFMAX
+	}
+	// jitter spreads reconnects of many clients after server restart
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// run keeps websocket session connected until peer context is cancelled
+func (p *wstunnelPeer) run() {
+	defer p.t.wg.Done()
+	attempt := 0
 	for {
-		mt, msg, err := t.conn.ReadMessage()
-		t.lastRead = time.Now()
-		t.timeoutsCount = 0
-		if err != nil {
-			log.Debug("Error in receive:", err)
-			if t.isrunning {
-				log.Info("wstunnel reconnect ..")
-				go t.reconnectWs()
-			} else {
-				log.Info("wstunnel close")
-			}
+		start := time.Now()
+		connected, err := p.session()
+		if p.ctx.Err() != nil {
+			log.Info("wstunnel close ", p.addr)
 			return
 		}
-		if mt == websocket.BinaryMessage {
-			if _, err := t.udpconn.WriteTo(msg, t.locaddr); err != nil {
-				log.Error("wstunnel error in send udp back to client:", err)
-			}
+		// start backoff from beginning only after stable session, server dropping connections is not hammered
+		if connected && time.Since(start) > WSST_BACKOFFMAX {
+			attempt = 0
+		}
+		p.t.setError(err)
+		atomic.AddUint64(&p.t.counters.reconnects, 1)
+		wait := wstunnelBackoff(attempt)
+		attempt++
+		log.Info("wstunnel reconnect ", p.addr, " in ", wait, ": ", err)
+		select {
+		case <-p.ctx.Done():
+			log.Info("wstunnel close ", p.addr)
+			return
+		case <-time.After(wait):
 		}
 	}
 }
 
-func (t *WSTunnel) udpResendToWs(buf []byte) {
-	t.udplock.Lock()
-	defer t.udplock.Unlock()
-	if t.conn != nil {
-		if err := t.conn.WriteMessage(websocket.BinaryMessage, buf); err != nil {
-			log.Debug("wstunnel send error: ", err)
+// session connects websocket and forwards packets until connection fails
+func (p *wstunnelPeer) session() (connected bool, err error) {
+	framed, compression := p.t.framing()
+	dialer := websocket.Dialer{
+		Proxy:             http.ProxyFromEnvironment,
+		HandshakeTimeout:  WSST_DIALTIMEOUT,
+		EnableCompression: compression,
+	}
+	if framed {
+		dialer.Subprotocols = []string{WSST_SUBPROTOCOL_FRAMED}
+	}
+	authz, err := p.t.authorization(atomic.SwapInt32(&p.refreshToken, 0) == 1)
+	if err != nil {
+		return false, err
+	}
+	h := http.Header{"Authorization": []string{authz}}
+	conn, resp, err := dialer.DialContext(p.ctx, p.t.url, h)
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusUnauthorized {
+			atomic.StoreInt32(&p.refreshToken, 1)
+		}
+		// server answered but upgrade failed, proxy on the way probably strips upgrade headers
+		if errors.Is(err, websocket.ErrBadHandshake) && resp != nil && wstunnelPollFallback(resp.StatusCode) {
+			log.Info("wstunnel websocket handshake failed with status ", resp.StatusCode, ", falling back to long-polling")
+			return p.pollSession(authz)
+		}
+		return false, err
+	}
+	defer conn.Close()
+	// older servers do not know framed mode
+	framed = conn.Subprotocol() == WSST_SUBPROTOCOL_FRAMED
+	log.Info("wstunnel connected ", p.addr, " framed: ", framed)
+	atomic.StoreInt64(&p.lastRead, time.Now().UnixNano())
+	atomic.StoreInt32(&p.connected, 1)
+	defer atomic.StoreInt32(&p.connected, 0)
+	if framed {
+		atomic.StoreInt32(&p.framed, 1)
+	} else {
+		atomic.StoreInt32(&p.framed, 0)
+	}
+
+	// dead connection is detected by read deadline, which is extended by every message and pong
+	pingInterval, pongTimeout := p.t.keepalive()
+	conn.SetReadDeadline(time.Now().Add(pingInterval + pongTimeout))
+	conn.SetPongHandler(func(data string) error {
+		if sent, err := strconv.ParseInt(data, 10, 64); err == nil {
+			atomic.StoreInt64(&p.rtt, int64(time.Since(time.Unix(0, sent))))
+		}
+		return conn.SetReadDeadline(time.Now().Add(pingInterval + pongTimeout))
+	})
+	ping := time.NewTicker(pingInterval)
+	defer ping.Stop()
+
+	// reader goroutine only reads from websocket, it ends when connection is closed
+	readerr := make(chan error, 1)
+	go func() {
+		for {
+			mt, msg, err := conn.ReadMessage()
+			if err != nil {
+				readerr <- err
+				return
+			}
+			atomic.StoreInt64(&p.lastRead, time.Now().UnixNano())
+			atomic.AddUint64(&p.t.counters.bytesIn, uint64(len(msg)))
+			conn.SetReadDeadline(time.Now().Add(pingInterval + pongTimeout))
+			if mt != websocket.BinaryMessage {
+				continue
+			}
+			pkts := [][]byte{msg}
+			if framed {
+				if pkts, err = FrameSplit(msg); err != nil {
+					log.Error("wstunnel invalid framed message: ", err)
+				}
+			}
+			for _, pkt := range pkts {
+				if _, err := p.udpconn.WriteTo(pkt, p.addr); err != nil && p.ctx.Err() == nil {
+					log.Error("wstunnel error in send udp back to client:", err)
+				}
+			}
 		}
-		t.lastWrite = time.Now()
-		if t.lastWrite.Sub(t.lastRead).Seconds() > WSST_MAXREADINACTIVITY {
-			log.Debug("wstunnel send TIMEOUT - retry: ", t.timeoutsCount)
-			t.timeoutsCount++
-			if t.timeoutsCount > WSST_MAXTIMEOUTS {
-				t.conn.Close()
-				log.Info("wstunnel send TIMEOUT - closing conn")
+	}()
+	// close connection and wait for reader to finish before return
+	defer func() {
+		conn.Close()
+		<-readerr
+	}()
+
+	maxReadInactivity, maxTimeouts := p.t.timeouts()
+	timeoutsCount := 0
+	for {
+		select {
+		case <-p.ctx.Done():
+			conn.SetWriteDeadline(time.Now().Add(time.Second))
+			err := conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+			if err != nil {
+				log.Debug("wstunnel error during closing websocket:", err)
+			}
+			return true, nil
+		case err := <-readerr:
+			// put error back for deferred wait
+			readerr <- err
+			return true, err
+		case <-ping.C:
+			// timestamp in payload is returned in pong
+			ts := []byte(strconv.FormatInt(time.Now().UnixNano(), 10))
+			if err := conn.WriteControl(websocket.PingMessage, ts, time.Now().Add(WSST_WRITETIMEOUT)); err != nil {
+				return true, err
+			}
+		case buf := <-p.out:
+			if framed {
+				buf = p.batch(buf)
+			}
+			conn.SetWriteDeadline(time.Now().Add(WSST_WRITETIMEOUT))
+			if err := conn.WriteMessage(websocket.BinaryMessage, buf); err != nil {
+				return true, err
+			}
+			atomic.AddUint64(&p.t.counters.bytesOut, uint64(len(buf)))
+			lastRead := time.Unix(0, atomic.LoadInt64(&p.lastRead))
+			if time.Since(lastRead).Seconds() > maxReadInactivity {
+				log.Debug("wstunnel send TIMEOUT - retry: ", timeoutsCount)
+				timeoutsCount++
+				if timeoutsCount > maxTimeouts {
+					log.Info("wstunnel send TIMEOUT - closing conn")
+					return true, errWstunnelTimeout
+				}
+			} else {
+				timeoutsCount = 0
 			}
 		}
 	}
 }
 
-func (t *WSTunnel) udpCreate() error {
-	// listen to incoming udp packets
-	log.Info("wstunnel udp create: ", fmt.Sprintf("127.0.0.1:%d", t.localport))
-	var err error
-	t.udpconn, err = net.ListenPacket("udp", fmt.Sprintf("127.0.0.1:%d", t.localport))
+// batch coalesces queued datagrams arriving within WSST_BATCHWINDOW into one framed message
+func (p *wstunnelPeer) batch(first []byte) []byte {
+	msg := FrameAppend(make([]byte, 0, len(first)+2), first)
+	timer := time.NewTimer(WSST_BATCHWINDOW)
+	defer timer.Stop()
+	for len(msg) < WSST_BATCHMAXSIZE {
+		select {
+		case buf := <-p.out:
+			msg = FrameAppend(msg, buf)
+		case <-timer.C:
+			return msg
+		case <-p.ctx.Done():
+			return msg
+		}
+	}
+	return msg
+}
+
+// send queues packet for websocket writer, packet is dropped if queue is full
+func (p *wstunnelPeer) send(buf []byte) {
+	atomic.StoreInt64(&p.lastActive, time.Now().UnixNano())
+	select {
+	case p.out <- buf:
+	default:
+		log.Debug("wstunnel queue is full, dropping packet from ", p.addr)
+	}
+}
+
+// SetTimeouts sets seconds without received data after which send is timed out
+// and number of timed out sends before reconnect, zero values mean defaults
+func (t *WSTunnel) SetTimeouts(maxReadInactivity float64, maxTimeouts int) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.maxReadInactivity = maxReadInactivity
+	t.maxTimeouts = maxTimeouts
+}
+
+// SetFraming enables framed mode with batching of datagrams and permessage-deflate compression,
+// both are negotiated with server during websocket handshake and used only if server supports them
+func (t *WSTunnel) SetFraming(framed bool, compression bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.framed = framed
+	t.compression = compression
+}
+
+// SetKeepalive sets interval of websocket pings and time to wait for pong, zero values mean defaults
+func (t *WSTunnel) SetKeepalive(pingInterval time.Duration, pongTimeout time.Duration) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.pingInterval = pingInterval
+	t.pongTimeout = pongTimeout
+}
+
+func (t *WSTunnel) keepalive() (time.Duration, time.Duration) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	pingInterval := t.pingInterval
+	if pingInterval <= 0 {
+		pingInterval = WSST_PINGINTERVAL
+	}
+	pongTimeout := t.pongTimeout
+	if pongTimeout <= 0 {
+		pongTimeout = WSST_PONGTIMEOUT
+	}
+	return pingInterval, pongTimeout
+}
+
+// SetTokenSource enables bearer authentication, token is requested before every connection of websocket session,
+// nil token source means basic authentication by username and password
+func (t *WSTunnel) SetTokenSource(token TokenSource) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.token = token
+}
+
+// authorization returns value of Authorization header for new session
+func (t *WSTunnel) authorization(refresh bool) (string, error) {
+	t.lock.Lock()
+	token, auth := t.token, t.auth
+	t.lock.Unlock()
+	if token == nil {
+		return "Basic " + auth, nil
+	}
+	jwt, err := token(refresh)
 	if err != nil {
-		log.Error("wstunnel udp listen error", err)
-		return err
+		return "", fmt.Errorf("cannot get token: %w", err)
 	}
-	return nil
+	return "Bearer " + jwt, nil
+}
+
+func (t *WSTunnel) framing() (bool, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.framed, t.compression
 }
 
-func (t *WSTunnel) udpServe() {
-	if t.udpconn == nil {
-		return
+func (t *WSTunnel) timeouts() (float64, int) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	maxReadInactivity := t.maxReadInactivity
+	if maxReadInactivity <= 0 {
+		maxReadInactivity = WSST_MAXREADINACTIVITY
 	}
-	log.Debug("wstunnel udp start")
+	maxTimeouts := t.maxTimeouts
+	if maxTimeouts <= 0 {
+		maxTimeouts = WSST_MAXTIMEOUTS
+	}
+	return maxReadInactivity, maxTimeouts
+}
+
+// peer returns session of local peer, new session is started on first packet;
+// returns nil if tunnel is stopped
+func (t *WSTunnel) peer(addr net.Addr) *wstunnelPeer {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if !t.isrunning {
+		return nil
+	}
+	if p, ok := t.peers[addr.String()]; ok {
+		return p
+	}
+	log.Info("wstunnel new local peer: ", addr)
+	p := &wstunnelPeer{
+		t:          t,
+		addr:       addr,
+		udpconn:    t.udpconn,
+		out:        make(chan []byte, WSST_QUEUESIZE),
+		lastActive: time.Now().UnixNano(),
+	}
+	p.ctx, p.cancel = context.WithCancel(t.ctx)
+	t.peers[addr.String()] = p
+	t.wg.Add(1)
+	go p.run()
+	return p
+}
+
+// Peers returns number of local peers with websocket session
+func (t *WSTunnel) Peers() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return len(t.peers)
+}
 
-	defer t.udpconn.Close()
+// expirePeers closes sessions of local peers which did not send anything for timeout
+func (t *WSTunnel) expirePeers(timeout time.Duration) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for k, p := range t.peers {
+		if time.Since(time.Unix(0, atomic.LoadInt64(&p.lastActive))) > timeout {
+			log.Info("wstunnel local peer expired: ", p.addr)
+			p.cancel()
+			delete(t.peers, k)
+		}
+	}
+}
 
+func (t *WSTunnel) udpServe(udpconn net.PacketConn) {
+	defer t.wg.Done()
+	log.Debug("wstunnel udp start")
 	for {
 		buf := make([]byte, 2048)
-		n, addr, err := t.udpconn.ReadFrom(buf)
+		n, addr, err := udpconn.ReadFrom(buf)
 		if err != nil {
-			if !t.isrunning {
+			if t.ctx.Err() != nil {
 				log.Info("wstunnel udp close")
 				return
 			}
 			continue
 		}
-		t.locaddr = addr
-		go t.udpResendToWs(buf[:n])
+		if p := t.peer(addr); p != nil {
+			p.send(buf[:n])
+		}
 	}
 }
 
-func (t *WSTunnel) IsRunning() bool {
-	return t.isrunning
-}
-
-func (t *WSTunnel) reconnectWs() error {
-	if t.conn != nil {
-		t.conn.Close()
-		t.conn = nil
-	}
-	err := t.connectWs()
-	log.Println("ws connect:", err)
-	if err != nil && t.isrunning {
-		time.Sleep(1000 * time.Millisecond)
-		if t.isrunning {
-			go t.reconnectWs()
+func (t *WSTunnel) peersServe() {
+	defer t.wg.Done()
+	ticker := time.NewTicker(WSST_PEERIDLETIMEOUT / 10)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.ctx.Done():
+			return
+		case <-ticker.C:
+			t.expirePeers(WSST_PEERIDLETIMEOUT)
 		}
 	}
-	t.lastRead = time.Now()
-	t.lastWrite = time.Now()
-	t.timeoutsCount = 0
-	return err
 }
 
-func (t *WSTunnel) connectWs() error {
-	h := http.Header{"Authorization": []string{"Basic " + t.auth}}
-	con, _, err := websocket.DefaultDialer.Dial(t.url, h)
-	if err != nil {
-		if con != nil {
-			con.Close()
-		}
-		t.conn = nil
-		return err
-	}
-	t.conn = con
-	go t.receiveHandler()
-	return nil
+func (t *WSTunnel) IsRunning() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.isrunning
 }
 
 func (t *WSTunnel) Start(UdpLocalPort int, Url string, Username string, Password string, AccessId int, UPN string) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
 	if t.isrunning {
 		return nil
 	}
 	t.url = fmt.Sprintf("%s/wstunnel/udp/%s/%d", Url, UPN, AccessId)
 	log.Info("wstunnel start: ", t.url)
 	t.auth = base64.StdEncoding.EncodeToString([]byte(Username + ":" + Password))
-	log.Info("wstunnel auth: ", t.auth)
 	t.localport = UdpLocalPort
-	err := t.udpCreate()
+	// listen to incoming udp packets
+	log.Info("wstunnel udp create: ", fmt.Sprintf("127.0.0.1:%d", t.localport))
+	udpconn, err := net.ListenPacket("udp", fmt.Sprintf("127.0.0.1:%d", t.localport))
 	if err != nil {
 		log.Error("wstunnel cannot create udp server: ", err)
 		return err
 	}
+	t.udpconn = udpconn
+	t.peers = make(map[string]*wstunnelPeer)
+	atomic.StoreUint64(&t.counters.reconnects, 0)
+	atomic.StoreUint64(&t.counters.bytesIn, 0)
+	atomic.StoreUint64(&t.counters.bytesOut, 0)
+	t.lastErr = ""
+	t.lastErrAt = time.Time{}
+	t.ctx, t.cancel = context.WithCancel(context.Background())
 	t.isrunning = true
-	go t.reconnectWs()
-	go t.udpServe()
+	t.wg.Add(2)
+	go t.udpServe(udpconn)
+	go t.peersServe()
 	return nil
 }
 
+// Stop closes all sessions and waits until all goroutines of tunnel are finished
 func (t *WSTunnel) Stop() error {
-	t.isrunning = false
-	if t.conn != nil {
-		err := t.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
-		if err != nil {
-			log.Error("wstunnel error during closing websocket:", err)
-		}
-		t.isrunning = false
-		t.conn.Close()
-	}
-	if t.udpconn != nil {
-		t.udpconn.Close()
+	t.lock.Lock()
+	if !t.isrunning {
+		t.lock.Unlock()
+		return nil
 	}
-	t.udpconn = nil
-	t.conn = nil
 	t.isrunning = false
+	t.cancel()
+	t.udpconn.Close()
+	t.peers = make(map[string]*wstunnelPeer)
+	t.lock.Unlock()
+	t.wg.Wait()
+	t.lock.Lock()
+	t.udpconn = nil
+	t.lock.Unlock()
 	return nil
 }
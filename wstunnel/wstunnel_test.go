@@ -0,0 +1,346 @@
+package wstunnel
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// testEchoServer returns every binary message back to the same websocket session
+func testEchoServer(sessions *int32) *httptest.Server {
+	upgrader := websocket.Upgrader{}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/wstunnel/udp/") || r.Header.Get("Authorization") == "" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		atomic.AddInt32(sessions, 1)
+		for {
+			mt, msg, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := c.WriteMessage(mt, msg); err != nil {
+				return
+			}
+		}
+	}))
+}
+
+func testFreeUDPPort(t *testing.T) int {
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	return c.LocalAddr().(*net.UDPAddr).Port
+}
+
+// testExchange sends message from local peer until echo arrives, first packets are lost until websocket is connected
+func testExchange(t *testing.T, c net.PacketConn, to net.Addr, msg string) {
+	buf := make([]byte, 2048)
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, err := c.WriteTo([]byte(msg), to); err != nil {
+			t.Fatal(err)
+		}
+		c.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		n, _, err := c.ReadFrom(buf)
+		if err != nil {
+			continue
+		}
+		if string(buf[:n]) != msg {
+			t.Fatalf("peer %v received %q, expected %q", c.LocalAddr(), buf[:n], msg)
+		}
+		return
+	}
+	t.Fatalf("peer %v did not receive %q", c.LocalAddr(), msg)
+}
+
+func TestWSTunnelMultiplePeers(t *testing.T) {
+	var sessions int32
+	srv := testEchoServer(&sessions)
+	defer srv.Close()
+
+	port := testFreeUDPPort(t)
+	tun := &WSTunnel{}
+	if err := tun.Start(port, "ws"+strings.TrimPrefix(srv.URL, "http"), "user", "pwd", 1, "test"); err != nil {
+		t.Fatal(err)
+	}
+	defer tun.Stop()
+	to := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}
+
+	a, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	testExchange(t, a, to, "from-a")
+	testExchange(t, b, to, "from-b")
+	// interleaved traffic has to go back to its sender
+	for i := 0; i < 10; i++ {
+		testExchange(t, a, to, "a")
+		testExchange(t, b, to, "b")
+	}
+	if n := tun.Peers(); n != 2 {
+		t.Errorf("expected 2 local peers, got %d", n)
+	}
+	if n := atomic.LoadInt32(&sessions); n != 2 {
+		t.Errorf("expected 2 websocket sessions, got %d", n)
+	}
+
+	// idle peers are closed
+	tun.expirePeers(0)
+	if n := tun.Peers(); n != 0 {
+		t.Errorf("expected no local peers after expiration, got %d", n)
+	}
+	// and new session is created on next packet
+	testExchange(t, a, to, "again")
+	if n := tun.Peers(); n != 1 {
+		t.Errorf("expected 1 local peer, got %d", n)
+	}
+}
+
+func TestWSTunnelStop(t *testing.T) {
+	var sessions int32
+	srv := testEchoServer(&sessions)
+	defer srv.Close()
+
+	port := testFreeUDPPort(t)
+	tun := &WSTunnel{}
+	if err := tun.Start(port, "ws"+strings.TrimPrefix(srv.URL, "http"), "user", "pwd", 1, "test"); err != nil {
+		t.Fatal(err)
+	}
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	testExchange(t, c, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}, "hello")
+
+	tun.Stop()
+	if tun.IsRunning() || tun.Peers() != 0 {
+		t.Errorf("tunnel is running after stop")
+	}
+	// local port is released and tunnel can be started again
+	if err := tun.Start(port, "ws"+strings.TrimPrefix(srv.URL, "http"), "user", "pwd", 1, "test"); err != nil {
+		t.Fatalf("cannot restart tunnel: %v", err)
+	}
+	tun.Stop()
+}
+
+func TestWSTunnelBackoff(t *testing.T) {
+	base := WSST_BACKOFFMIN
+	for i := 0; i < 20; i++ {
+		for j := 0; j < 10; j++ {
+			if d := wstunnelBackoff(i); d < base/2 || d > base {
+				t.Errorf("attempt %d: backoff %v is out of range %v - %v", i, d, base/2, base)
+			}
+		}
+		if base < WSST_BACKOFFMAX {
+			base *= 2
+		}
+		if base > WSST_BACKOFFMAX {
+			base = WSST_BACKOFFMAX
+		}
+	}
+}
+
+// TestWSTunnelDroppedConnections runs traffic against server which drops first sessions, run it with -race
+func TestWSTunnelDroppedConnections(t *testing.T) {
+	var sessions int32
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		// first two sessions are dropped after two messages
+		drop := atomic.AddInt32(&sessions, 1) <= 2
+		for i := 0; ; i++ {
+			if drop && i == 2 {
+				return
+			}
+			mt, msg, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := c.WriteMessage(mt, msg); err != nil {
+				return
+			}
+		}
+	}))
+	defer srv.Close()
+
+	port := testFreeUDPPort(t)
+	tun := &WSTunnel{}
+	if err := tun.Start(port, "ws"+strings.TrimPrefix(srv.URL, "http"), "user", "pwd", 1, "test"); err != nil {
+		t.Fatal(err)
+	}
+	to := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for i := 0; i < 10; i++ {
+		testExchange(t, c, to, "ping")
+	}
+	if n := atomic.LoadInt32(&sessions); n < 3 {
+		t.Errorf("expected reconnects after dropped sessions, got %d sessions", n)
+	}
+
+	// stop while local peers are sending
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				c.WriteTo([]byte("flood"), to)
+			}
+		}
+	}()
+	time.Sleep(50 * time.Millisecond)
+	tun.Stop()
+	close(done)
+	if tun.IsRunning() || tun.Peers() != 0 {
+		t.Errorf("tunnel is running after stop")
+	}
+}
+
+func TestWSTunnelStopDuringReconnect(t *testing.T) {
+	var attempts int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	port := testFreeUDPPort(t)
+	tun := &WSTunnel{}
+	if err := tun.Start(port, "ws"+strings.TrimPrefix(srv.URL, "http"), "user", "pwd", 1, "test"); err != nil {
+		t.Fatal(err)
+	}
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.WriteTo([]byte("hello"), &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port})
+	time.Sleep(time.Second)
+	// backoff has to slow down retries
+	if n := atomic.LoadInt32(&attempts); n < 1 || n > 3 {
+		t.Errorf("unexpected number of connection attempts: %d", n)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		tun.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("stop is blocked by reconnect")
+	}
+}
+
+func TestWSTunnelKeepalive(t *testing.T) {
+	var sessions int32
+	srv := testEchoServer(&sessions)
+	defer srv.Close()
+
+	port := testFreeUDPPort(t)
+	tun := &WSTunnel{}
+	tun.SetKeepalive(50*time.Millisecond, 200*time.Millisecond)
+	if err := tun.Start(port, "ws"+strings.TrimPrefix(srv.URL, "http"), "user", "pwd", 1, "test"); err != nil {
+		t.Fatal(err)
+	}
+	defer tun.Stop()
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	testExchange(t, c, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}, "hello")
+
+	// idle tunnel is kept alive by pings and RTT is measured
+	time.Sleep(500 * time.Millisecond)
+	st := tun.Stats()
+	if len(st.Peers) != 1 || !st.Peers[0].Connected {
+		t.Fatalf("expected one connected peer: %+v", st)
+	}
+	if st.RTT <= 0 || st.RTT > time.Second {
+		t.Errorf("unexpected RTT: %v", st.RTT)
+	}
+	if st.Reconnects != 0 || atomic.LoadInt32(&sessions) != 1 {
+		t.Errorf("idle tunnel was reconnected: %+v", st)
+	}
+	if st.BytesIn < 5 || st.BytesOut < 5 {
+		t.Errorf("bytes are not counted: %+v", st)
+	}
+}
+
+func TestWSTunnelDeadConnection(t *testing.T) {
+	var sessions int32
+	upgrader := websocket.Upgrader{}
+	release := make(chan struct{})
+	defer close(release)
+	// server accepts connection and then stops responding, like expired NAT mapping
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		atomic.AddInt32(&sessions, 1)
+		<-release
+	}))
+	defer srv.Close()
+
+	port := testFreeUDPPort(t)
+	tun := &WSTunnel{}
+	tun.SetKeepalive(50*time.Millisecond, 100*time.Millisecond)
+	if err := tun.Start(port, "ws"+strings.TrimPrefix(srv.URL, "http"), "user", "pwd", 1, "test"); err != nil {
+		t.Fatal(err)
+	}
+	defer tun.Stop()
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.WriteTo([]byte("hello"), &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&sessions) < 2 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	st := tun.Stats()
+	if atomic.LoadInt32(&sessions) < 2 || st.Reconnects < 1 {
+		t.Fatalf("dead connection was not detected: %+v", st)
+	}
+	if st.LastError == "" || st.LastErrorAt.IsZero() {
+		t.Errorf("last error is not set: %+v", st)
+	}
+}